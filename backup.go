@@ -0,0 +1,528 @@
+package esl
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// pinnedFile is a data file or hint file which is pinned by backup. The file
+// has been opened, so that it's still readable even if it's removed by merge.
+type pinnedFile struct {
+	name   string // base name of the file
+	fileId uint16
+	hint   bool
+	fd     afero.File
+	size   int64
+}
+
+// pinFiles pauses file rolling and compaction, and opens all data files and
+// hint files, the active data file is pinned with its current length. The
+// caller MUST call release to close the pinned files.
+func (db *DB) pinFiles() (files []*pinnedFile, head Position, release func(), err error) {
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+
+	return db.pinFilesLocked()
+}
+
+// pinFilesLocked is the same as pinFiles, but the caller MUST hold compactLock,
+// so that the names of pinned files still refer to them until it's released.
+func (db *DB) pinFilesLocked() (files []*pinnedFile, head Position, release func(), err error) {
+	db.activeLock.Lock()
+	defer db.activeLock.Unlock()
+
+	release = func() {
+		for _, f := range files {
+			_ = f.fd.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	// the active data file should be synced, so that the pinned length
+	// is readable.
+	if err = db.activeDataFile.Sync(); err != nil {
+		return nil, head, nil, errors.Wrap(err, "sync active data file")
+	}
+	head = db.head()
+
+	snap, err := takeDBPathSnap(db.filesystem(), db.path)
+	if err != nil {
+		return nil, head, nil, errors.Wrap(err, "takeDBPathSnap")
+	}
+
+	filenames := append(append([]string{}, snap.dataFiles...), snap.hintFiles...)
+	sort.Strings(filenames)
+	files = make([]*pinnedFile, 0, len(filenames))
+	for _, filename := range filenames {
+		fd, err2 := db.filesystem().OpenFile(filename, os.O_RDONLY, 0666)
+		if err2 != nil {
+			return nil, head, nil, errors.Wrap(err2, "open "+filename)
+		}
+		fileId, err2 := fileIdFromFilename(filename)
+		if err2 != nil {
+			_ = fd.Close()
+			return nil, head, nil, errors.Wrap(err2, "parse "+filename)
+		}
+		f := &pinnedFile{
+			name:   filepath.Base(filename),
+			fileId: fileId,
+			hint:   filepath.Ext(filename) == hintFileExt,
+			fd:     fd,
+		}
+		files = append(files, f)
+
+		if filename == dataFilename(db.path, head.FileId) {
+			f.size = int64(head.Offset)
+			continue
+		}
+
+		fi, err2 := fd.Stat()
+		if err2 != nil {
+			return nil, head, nil, errors.Wrap(err2, "stat "+filename)
+		}
+		f.size = fi.Size()
+	}
+
+	return files, head, release, nil
+}
+
+// BackupPosition is the position where the last backup ends, it's used to take
+// incremental backup by BackupSince.
+type BackupPosition struct {
+	Position
+
+	// Layout is the fingerprint of data files and hint files before
+	// Position.FileId, it changes while merge process rewrites them. The data
+	// file of Position itself is told by Position.Generation.
+	Layout uint64
+}
+
+// backupManifest is the first entry of the backup archive, it describes how
+// to apply the archive.
+type backupManifest struct {
+	// Incremental indicates the archive contains only the changes since From,
+	// otherwise it's a full backup.
+	Incremental bool                 `json:"incremental"`
+	From        BackupPosition       `json:"from"`
+	To          BackupPosition       `json:"to"`
+	Files       []backupManifestFile `json:"files"`
+}
+
+type backupManifestFile struct {
+	Name string `json:"name"`
+	// Tail indicates the content is the tail of an existing data file, and it
+	// should be appended to the data file at Offset.
+	Tail   bool  `json:"tail"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+const backupManifestName = "MANIFEST"
+
+// layoutFingerprint calculates the fingerprint of the data files and hint files
+// those id is less than fileId.
+func layoutFingerprint(files []*pinnedFile, fileId uint16) uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	for _, f := range files {
+		if f.fileId >= fileId {
+			continue
+		}
+
+		_, _ = h.Write([]byte(f.name))
+		binary.BigEndian.PutUint64(buf, uint64(f.size))
+		_, _ = h.Write(buf)
+	}
+
+	return h.Sum64()
+}
+
+// continuable reports whether the increment since pos could be taken from the
+// pinned files, that is the files before pos are not rewritten, and the data
+// file of pos is still the file which pos was taken from.
+func continuable(files []*pinnedFile, pos BackupPosition, head Position) bool {
+	if pos == (BackupPosition{}) || pos.Layout != layoutFingerprint(files, pos.FileId) {
+		return false
+	}
+	if pos.FileId > head.FileId || (pos.FileId == head.FileId && pos.Offset > head.Offset) {
+		return false
+	}
+
+	for _, f := range files {
+		if f.hint || f.fileId != pos.FileId {
+			continue
+		}
+		generation, err := readFormatHeader(f.fd)
+		return err == nil && generation == pos.Generation && f.size >= int64(pos.Offset)
+	}
+
+	// the data file of pos has been merged.
+	return false
+}
+
+// Backup takes a consistent hot backup of the DB and writes it into w as a
+// tar archive, the archive could be restored by Restore. Writings are allowed
+// while backing up, but the records written after Backup is called are not
+// included in the archive.
+func (db *DB) Backup(w io.Writer) error {
+	_, err := db.BackupSince(BackupPosition{}, w)
+	return err
+}
+
+// BackupSince takes an incremental backup which contains the changes since pos,
+// and returns the position of this backup which should be passed to the next
+// BackupSince. Since data files are immutable once archived, the incremental
+// backup only contains the new data files, their hint files and the new tail
+// of the data file of pos.
+//
+// If pos is zero value or the data file of pos or any file before it has been
+// rewritten by merge process since pos, a full backup is taken instead. The archive should be applied
+// by ApplyIncrement to the path restored from the base backup.
+func (db *DB) BackupSince(pos BackupPosition, w io.Writer) (BackupPosition, error) {
+	files, head, release, err := db.pinFiles()
+	if err != nil {
+		return BackupPosition{}, errors.Wrap(err, "BackupSince pinFiles")
+	}
+	defer release()
+
+	manifest := &backupManifest{
+		Incremental: false,
+		From:        pos,
+		To: BackupPosition{
+			Position: head,
+			Layout:   layoutFingerprint(files, head.FileId),
+		},
+	}
+
+	manifest.Incremental = continuable(files, pos, head)
+
+	sections := make([]*io.SectionReader, 0, len(files))
+	for _, f := range files {
+		mf := backupManifestFile{Name: f.name, Offset: 0, Size: f.size}
+		if manifest.Incremental {
+			if f.fileId < pos.FileId {
+				continue
+			}
+			if f.fileId == pos.FileId && !f.hint {
+				mf.Tail = true
+				mf.Offset = int64(pos.Offset)
+				mf.Size = f.size - mf.Offset
+			}
+		}
+
+		manifest.Files = append(manifest.Files, mf)
+		sections = append(sections, io.NewSectionReader(f.fd, mf.Offset, mf.Size))
+	}
+
+	if err = writeBackupArchive(w, manifest, sections); err != nil {
+		return BackupPosition{}, errors.Wrap(err, "BackupSince")
+	}
+
+	return manifest.To, nil
+}
+
+func writeBackupArchive(w io.Writer, manifest *backupManifest, sections []*io.SectionReader) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "marshal manifest")
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     backupManifestName,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  now,
+	}
+	if err = tw.WriteHeader(header); err != nil {
+		return errors.Wrap(err, "write tar header")
+	}
+	if _, err = tw.Write(data); err != nil {
+		return errors.Wrap(err, "write manifest")
+	}
+
+	for idx, f := range manifest.Files {
+		header = &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Name,
+			Size:     f.Size,
+			Mode:     0644,
+			ModTime:  now,
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return errors.Wrap(err, "write tar header")
+		}
+		if _, err = io.Copy(tw, sections[idx]); err != nil {
+			return errors.Wrap(err, "write "+f.Name)
+		}
+	}
+
+	return tw.Close()
+}
+
+// BackupToDir takes a consistent hot backup of the DB into dir which should be
+// empty or not exist. Immutable data files and hint files are hard-linked into
+// dir if the DB uses the OS file system, otherwise they are copied. The backup
+// dir could be opened by Open directly.
+func (db *DB) BackupToDir(dir string) error {
+	fs := db.filesystem()
+	if err := ensureEmptyPath(fs, dir); err != nil {
+		return errors.Wrap(err, "BackupToDir")
+	}
+
+	// the immutable files are linked while holding compactLock, since merge
+	// writes its output with the names of the files it replaces.
+	db.compactLock.Lock()
+	files, head, release, err := db.pinFilesLocked()
+	if err != nil {
+		db.compactLock.Unlock()
+		return errors.Wrap(err, "BackupToDir pinFiles")
+	}
+	defer release()
+
+	linkable := isOsFs(fs)
+	activeName := filepath.Base(dataFilename(db.path, head.FileId))
+	copies := make([]*pinnedFile, 0, 1)
+	for _, f := range files {
+		if linkable && f.name != activeName &&
+			os.Link(filepath.Join(db.path, f.name), filepath.Join(dir, f.name)) == nil {
+			continue
+		}
+		copies = append(copies, f)
+	}
+	db.compactLock.Unlock()
+
+	for _, f := range copies {
+		target := filepath.Join(dir, f.name)
+		if err = copyFile(fs, target, io.NewSectionReader(f.fd, 0, f.size)); err != nil {
+			return errors.Wrap(err, "BackupToDir copy "+f.name)
+		}
+	}
+
+	return nil
+}
+
+// Restore extracts the archive created by Backup into path, path should be
+// empty or not exist. The restored path could be opened by Open.
+func Restore(archive io.Reader, path string, options ...Option) error {
+	dbOpts := defaultOptions()
+	for _, opt := range options {
+		opt.apply(dbOpts)
+	}
+
+	if err := ensureEmptyPath(dbOpts.fs, path); err != nil {
+		return errors.Wrap(err, "Restore")
+	}
+
+	tr := tar.NewReader(archive)
+	manifest, err := readBackupManifest(tr)
+	if err != nil {
+		return errors.Wrap(err, "Restore")
+	}
+	if manifest.Incremental {
+		return errors.New("Restore could not restore from an incremental backup, use ApplyIncrement instead")
+	}
+
+	return extractBackupFiles(dbOpts.fs, tr, path, manifest)
+}
+
+// ApplyIncrement applies the archive created by BackupSince into path which has
+// been restored from the base backup and previous increments in order. If the
+// archive is a full backup, all files in path are replaced.
+func ApplyIncrement(archive io.Reader, path string, options ...Option) error {
+	dbOpts := defaultOptions()
+	for _, opt := range options {
+		opt.apply(dbOpts)
+	}
+
+	tr := tar.NewReader(archive)
+	manifest, err := readBackupManifest(tr)
+	if err != nil {
+		return errors.Wrap(err, "ApplyIncrement")
+	}
+
+	snap, err := takeDBPathSnap(dbOpts.fs, path)
+	if err != nil {
+		return errors.Wrap(err, "ApplyIncrement takeDBPathSnap")
+	}
+
+	if !manifest.Incremental {
+		if err = ensurePath(dbOpts.fs, path); err != nil {
+			return errors.Wrap(err, "ApplyIncrement ensurePath")
+		}
+		for _, filename := range append(snap.dataFiles, snap.hintFiles...) {
+			if err = dbOpts.fs.Remove(filename); err != nil {
+				return errors.Wrap(err, "ApplyIncrement remove "+filename)
+			}
+		}
+
+		return extractBackupFiles(dbOpts.fs, tr, path, manifest)
+	}
+
+	// the increment must be applied right after the last backup.
+	fi, err := dbOpts.fs.Stat(dataFilename(path, manifest.From.FileId))
+	if err != nil {
+		return errors.Wrap(err, "ApplyIncrement stat the last data file")
+	}
+	if snap.lastDataFileId != manifest.From.FileId || fi.Size() != int64(manifest.From.Offset) {
+		return errors.Errorf("ApplyIncrement the increment starts from (%d, %d), but path ends at (%d, %d)",
+			manifest.From.FileId, manifest.From.Offset, snap.lastDataFileId, fi.Size())
+	}
+	generation, err := readFileGeneration(dbOpts.fs, dataFilename(path, manifest.From.FileId))
+	if err != nil {
+		return errors.Wrap(err, "ApplyIncrement read generation of the last data file")
+	}
+	if generation != manifest.From.Generation {
+		return errors.Errorf("ApplyIncrement the increment starts from generation %d, but path is at generation %d",
+			manifest.From.Generation, generation)
+	}
+
+	return extractBackupFiles(dbOpts.fs, tr, path, manifest)
+}
+
+func readBackupManifest(tr *tar.Reader) (*backupManifest, error) {
+	header, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "read tar")
+	}
+	if header.Name != backupManifestName {
+		return nil, errors.Errorf("the first entry %s is not manifest", header.Name)
+	}
+
+	manifest := new(backupManifest)
+	if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, errors.Wrap(err, "decode manifest")
+	}
+
+	return manifest, nil
+}
+
+// extractBackupFiles extracts files described by manifest from tr into path.
+func extractBackupFiles(fs FileSystem, tr *tar.Reader, path string, manifest *backupManifest) error {
+	for _, f := range manifest.Files {
+		header, err := tr.Next()
+		if err != nil {
+			return errors.Wrap(err, "read tar")
+		}
+
+		name, err := backupEntryName(header)
+		if err != nil {
+			return err
+		}
+		if name != f.Name || header.Size != f.Size {
+			return errors.Errorf("entry %s mismatches the manifest", header.Name)
+		}
+
+		filename := filepath.Join(path, name)
+		if f.Tail {
+			err = appendFile(fs, filename, f.Offset, tr)
+		} else {
+			err = copyFile(fs, filename, tr)
+		}
+		if err != nil {
+			return errors.Wrap(err, "write "+name)
+		}
+	}
+
+	return nil
+}
+
+// backupEntryName validates the tar entry and returns the file name, only data
+// files and hint files are allowed.
+func backupEntryName(header *tar.Header) (string, error) {
+	if header.Typeflag != tar.TypeReg {
+		return "", errors.Errorf("unexpected entry type %c of %s", header.Typeflag, header.Name)
+	}
+
+	name := filepath.Base(header.Name)
+	if name != header.Name {
+		return "", errors.Errorf("unexpected entry %s", header.Name)
+	}
+	if _, err := fileIdFromFilename(name); err != nil {
+		return "", errors.Wrapf(err, "unexpected entry %s", header.Name)
+	}
+
+	return name, nil
+}
+
+// ensureEmptyPath makes sure the path exists and contains no data files or
+// hint files.
+func ensureEmptyPath(fs FileSystem, path string) error {
+	if err := ensurePath(fs, path); err != nil {
+		return errors.Wrap(err, "ensurePath")
+	}
+
+	snap, err := takeDBPathSnap(fs, path)
+	if err != nil {
+		return errors.Wrap(err, "takeDBPathSnap")
+	}
+	if !snap.isEmpty() {
+		return errors.Errorf("path %s is not empty", path)
+	}
+
+	return nil
+}
+
+func copyFile(fs FileSystem, filename string, r io.Reader) error {
+	fd, err := fs.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(fd, r); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
+
+// appendFile appends content from r to the end of filename, the size of filename
+// must be off.
+func appendFile(fs FileSystem, filename string, off int64, r io.Reader) error {
+	fd, err := fs.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if fi.Size() != off {
+		_ = fd.Close()
+		return errors.Errorf("file size %d mismatches the offset %d", fi.Size(), off)
+	}
+
+	if _, err = io.Copy(fd, r); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
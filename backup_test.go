@@ -0,0 +1,302 @@
+package esl
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func putKeys(t *testing.T, db *DB, from, to int) {
+	for i := from; i < to; i++ {
+		require.NoError(t, db.Put([]byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i))))
+	}
+}
+
+func assertKeys(t *testing.T, db *DB, from, to int) {
+	for i := from; i < to; i++ {
+		value, err := db.Get([]byte("key-" + strconv.Itoa(i)))
+		require.NoError(t, err, "key-"+strconv.Itoa(i))
+		assert.Equal(t, "value-"+strconv.Itoa(i), string(value))
+	}
+}
+
+func Test_DB_Backup_Restore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(fs),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	putKeys(t, db, 0, 30)
+	require.NoError(t, db.Delete([]byte("key-0")))
+	// merge to make sure hint files are included.
+	require.NoError(t, db.merge())
+
+	archive := bytes.NewBuffer(nil)
+	require.NoError(t, db.Backup(archive))
+
+	// writings after backup are not included.
+	putKeys(t, db, 30, 40)
+
+	restoreFs := afero.NewMemMapFs()
+	require.NoError(t, Restore(bytes.NewReader(archive.Bytes()), "/tmp/esl-restore", WithFileSystem(restoreFs)))
+
+	snap, err := takeDBPathSnap(restoreFs, "/tmp/esl-restore")
+	require.NoError(t, err)
+	assert.NotEmpty(t, snap.hintFiles)
+
+	restored, err := Open("/tmp/esl-restore", WithFileSystem(restoreFs))
+	require.NoError(t, err)
+	defer restored.Close()
+
+	assertKeys(t, restored, 1, 30)
+	_, err = restored.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = restored.Get([]byte("key-30"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// restore into a non-empty path is not allowed.
+	err = Restore(bytes.NewReader(archive.Bytes()), "/tmp/esl-restore", WithFileSystem(restoreFs))
+	assert.Error(t, err)
+}
+
+func Test_DB_Backup_concurrentWrite(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(fs),
+		WithMaxFileBytes(256),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	putKeys(t, db, 0, 100)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		putKeys(t, db, 100, 300)
+	}()
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, db.merge())
+	}()
+
+	archive := bytes.NewBuffer(nil)
+	require.NoError(t, db.Backup(archive))
+	wg.Wait()
+
+	restoreFs := afero.NewMemMapFs()
+	require.NoError(t, Restore(archive, "/tmp/esl-restore", WithFileSystem(restoreFs)))
+	restored, err := Open("/tmp/esl-restore", WithFileSystem(restoreFs))
+	require.NoError(t, err)
+	defer restored.Close()
+
+	assertKeys(t, restored, 0, 100)
+}
+
+func Test_DB_BackupToDir(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(
+		filepath.Join(dir, "db"),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	putKeys(t, db, 0, 30)
+
+	target := filepath.Join(dir, "backup")
+	require.NoError(t, db.BackupToDir(target))
+	putKeys(t, db, 30, 40)
+
+	// the linked files are not changed by merge, which writes the files with
+	// the same names.
+	require.NoError(t, db.Delete([]byte("key-0")))
+	require.NoError(t, db.MergeContext(context.Background()))
+
+	restored, err := Open(target)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	assertKeys(t, restored, 0, 30)
+	_, err = restored.Get([]byte("key-30"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// backup into a non-empty path is not allowed.
+	assert.Error(t, db.BackupToDir(target))
+}
+
+func Test_backupEntryName(t *testing.T) {
+	tests := []struct {
+		header  *tar.Header
+		want    string
+		wantErr bool
+	}{
+		{header: &tar.Header{Typeflag: tar.TypeReg, Name: "0000000001.esld"}, want: "0000000001.esld"},
+		{header: &tar.Header{Typeflag: tar.TypeReg, Name: "0000000001.hint"}, want: "0000000001.hint"},
+		{header: &tar.Header{Typeflag: tar.TypeReg, Name: "../0000000001.esld"}, wantErr: true},
+		{header: &tar.Header{Typeflag: tar.TypeReg, Name: "passwd"}, wantErr: true},
+		{header: &tar.Header{Typeflag: tar.TypeSymlink, Name: "0000000001.esld"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header.Name, func(t *testing.T) {
+			got, err := backupEntryName(tt.header)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func readManifestFromArchive(t *testing.T, archive []byte) *backupManifest {
+	manifest, err := readBackupManifest(tar.NewReader(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	return manifest
+}
+
+func Test_DB_BackupSince(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(fs),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	restoreFs := afero.NewMemMapFs()
+	restorePath := "/tmp/esl-restore"
+	openRestored := func() *DB {
+		restored, err := Open(restorePath, WithFileSystem(restoreFs))
+		require.NoError(t, err)
+		return restored
+	}
+
+	// base backup
+	putKeys(t, db, 0, 10)
+	base := bytes.NewBuffer(nil)
+	pos, err := db.BackupSince(BackupPosition{}, base)
+	require.NoError(t, err)
+	assert.False(t, readManifestFromArchive(t, base.Bytes()).Incremental)
+	require.NoError(t, Restore(bytes.NewReader(base.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	// the first increment contains the new data files and the tail of the last one.
+	putKeys(t, db, 10, 30)
+	inc1 := bytes.NewBuffer(nil)
+	pos1, err := db.BackupSince(pos, inc1)
+	require.NoError(t, err)
+	manifest := readManifestFromArchive(t, inc1.Bytes())
+	assert.True(t, manifest.Incremental)
+	assert.Equal(t, pos, manifest.From)
+	assert.Equal(t, pos1, manifest.To)
+	for _, f := range manifest.Files {
+		fileId, err := fileIdFromFilename(f.Name)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, fileId, pos.FileId)
+	}
+
+	// increment could not be restored directly.
+	assert.Error(t, Restore(bytes.NewReader(inc1.Bytes()), "/tmp/esl-other", WithFileSystem(restoreFs)))
+
+	require.NoError(t, ApplyIncrement(bytes.NewReader(inc1.Bytes()), restorePath, WithFileSystem(restoreFs)))
+	restored := openRestored()
+	assertKeys(t, restored, 0, 30)
+	require.NoError(t, restored.Close())
+
+	// apply the same increment again is not allowed.
+	assert.Error(t, ApplyIncrement(bytes.NewReader(inc1.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	// merge rewrites immutable files, so the next backup falls back to a full one.
+	require.NoError(t, db.Delete([]byte("key-0")))
+	require.NoError(t, db.merge())
+	putKeys(t, db, 30, 40)
+	inc2 := bytes.NewBuffer(nil)
+	pos2, err := db.BackupSince(pos1, inc2)
+	require.NoError(t, err)
+	assert.False(t, readManifestFromArchive(t, inc2.Bytes()).Incremental)
+	require.NoError(t, ApplyIncrement(bytes.NewReader(inc2.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	// the increment after merge is incremental again.
+	putKeys(t, db, 40, 50)
+	inc3 := bytes.NewBuffer(nil)
+	_, err = db.BackupSince(pos2, inc3)
+	require.NoError(t, err)
+	assert.True(t, readManifestFromArchive(t, inc3.Bytes()).Incremental)
+	require.NoError(t, ApplyIncrement(bytes.NewReader(inc3.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	restored = openRestored()
+	defer restored.Close()
+	assertKeys(t, restored, 1, 50)
+	_, err = restored.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func Test_DB_BackupSince_mergedBetween(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(fs),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	restoreFs := afero.NewMemMapFs()
+	restorePath := "/tmp/esl-restore"
+
+	// the base backup ends in the first data file, so no file is before it.
+	putKeys(t, db, 0, 1)
+	base := bytes.NewBuffer(nil)
+	pos, err := db.BackupSince(BackupPosition{}, base)
+	require.NoError(t, err)
+	require.NoError(t, Restore(bytes.NewReader(base.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	// merge rewrites the data file of pos between base and increment.
+	require.NoError(t, db.Delete([]byte("key-0")))
+	putKeys(t, db, 1, 30)
+	require.NoError(t, db.MergeContext(context.Background()))
+
+	inc := bytes.NewBuffer(nil)
+	pos1, err := db.BackupSince(pos, inc)
+	require.NoError(t, err)
+	assert.False(t, readManifestFromArchive(t, inc.Bytes()).Incremental)
+	require.NoError(t, ApplyIncrement(bytes.NewReader(inc.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	// the next backup after another merge is applicable too.
+	putKeys(t, db, 30, 60)
+	require.NoError(t, db.MergeContext(context.Background()))
+	putKeys(t, db, 60, 70)
+	inc2 := bytes.NewBuffer(nil)
+	_, err = db.BackupSince(pos1, inc2)
+	require.NoError(t, err)
+	require.NoError(t, ApplyIncrement(bytes.NewReader(inc2.Bytes()), restorePath, WithFileSystem(restoreFs)))
+
+	restored, err := Open(restorePath, WithFileSystem(restoreFs))
+	require.NoError(t, err)
+	defer restored.Close()
+	assertKeys(t, restored, 1, 70)
+	_, err = restored.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
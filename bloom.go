@@ -0,0 +1,59 @@
+package esl
+
+import (
+	"hash/fnv"
+)
+
+const (
+	// bloomBitsPerKey keeps the false positive rate about 1%.
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloomFilter tells whether a key is definitely not in a set.
+type bloomFilter struct {
+	bits  []uint64
+	nbits uint64
+}
+
+// newBloomFilter creates a bloom filter for about n keys.
+func newBloomFilter(n int) *bloomFilter {
+	nbits := uint64(max(n, 1)) * bloomBitsPerKey
+	nbits = (nbits + 63) / 64 * 64
+
+	return &bloomFilter{
+		bits:  make([]uint64, nbits/64),
+		nbits: nbits,
+	}
+}
+
+// hashes returns two hashes of key, the others are derived from them by
+// double hashing.
+func (f *bloomFilter) hashes(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+
+	return sum, (sum >> 33) | (sum << 31) | 1
+}
+
+func (f *bloomFilter) add(key []byte) {
+	h1, h2 := f.hashes(key)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % f.nbits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain returns false if the key is definitely not added.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	h1, h2 := f.hashes(key)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % f.nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
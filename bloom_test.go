@@ -0,0 +1,35 @@
+package esl
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_bloomFilter(t *testing.T) {
+	f := newBloomFilter(10000)
+	for i := 0; i < 10000; i++ {
+		f.add([]byte("key-" + strconv.Itoa(i)))
+	}
+
+	for i := 0; i < 10000; i++ {
+		assert.True(t, f.mayContain([]byte("key-"+strconv.Itoa(i))))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain([]byte("absent-" + strconv.Itoa(i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 200)
+}
+
+func Test_bloomFilter_empty(t *testing.T) {
+	f := newBloomFilter(0)
+	assert.False(t, f.mayContain([]byte("key")))
+
+	f.add([]byte("key"))
+	assert.True(t, f.mayContain([]byte("key")))
+}
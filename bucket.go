@@ -0,0 +1,687 @@
+package esl
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The records of buckets are flagged by entryFlag_bucket, and their keys are
+// prefixed by the bucket id:
+//
+// | crc | tstamp | seq | key_sz | value_sz | flags | bucket_id | key | value |
+//
+// The buckets are described by the catalog records, which are stored in the
+// reserved bucket catalogBucketId, the key is the name of bucket and the value
+// is formed as:
+//
+// | id(2) | ttl(8) | dropped(1) |
+//
+// Dropping a bucket only appends a catalog record, the records of the dropped
+// bucket are removed by the merge process. The dropped catalog records are kept,
+// so that the id of dropped bucket would never be reused.
+const (
+	bucketIdSize = 2
+
+	catalogBucketId   uint16 = 0
+	catalogRecordSize        = 11
+)
+
+// bucketKey returns the stored key of key in bucket id.
+func bucketKey(id uint16, key []byte) []byte {
+	stored := make([]byte, bucketIdSize+len(key))
+	binary.BigEndian.PutUint16(stored, id)
+	copy(stored[bucketIdSize:], key)
+
+	return stored
+}
+
+// bucketIdOf returns the bucket id of the stored key.
+func bucketIdOf(stored []byte) uint16 {
+	return binary.BigEndian.Uint16(stored)
+}
+
+// bucketMeta is the value of catalog record.
+type bucketMeta struct {
+	id      uint16
+	ttl     time.Duration
+	dropped bool
+}
+
+func (m bucketMeta) bytes() []byte {
+	data := make([]byte, catalogRecordSize)
+	binary.BigEndian.PutUint16(data, m.id)
+	binary.BigEndian.PutUint64(data[2:], uint64(m.ttl))
+	if m.dropped {
+		data[10] = 1
+	}
+
+	return data
+}
+
+func decodeBucketMeta(data []byte) (bucketMeta, error) {
+	if len(data) != catalogRecordSize {
+		return bucketMeta{}, errors.Errorf("invalid catalog record size: %d", len(data))
+	}
+
+	return bucketMeta{
+		id:      binary.BigEndian.Uint16(data),
+		ttl:     time.Duration(binary.BigEndian.Uint64(data[2:])),
+		dropped: data[10] == 1,
+	}, nil
+}
+
+type bucketOptions struct {
+	ttl    *time.Duration
+	filter func(key, value []byte) bool
+}
+
+type BucketOption interface {
+	apply(*bucketOptions)
+}
+
+type funcBucketOption struct {
+	fn func(*bucketOptions)
+}
+
+func (funcOpt funcBucketOption) apply(o *bucketOptions) {
+	funcOpt.fn(o)
+}
+
+func newFuncBucketOption(fn func(*bucketOptions)) *funcBucketOption {
+	return &funcBucketOption{
+		fn: fn,
+	}
+}
+
+// WithBucketTTL set the time to live of the keys in bucket, the expired keys are
+// not readable, and they are removed by the merge process. 0 means the keys
+// never expire. The TTL is persisted, so it's kept after reopening.
+// NOTE: the timestamp of record is in nanoseconds, so the TTL is not rounded.
+func WithBucketTTL(ttl time.Duration) BucketOption {
+	return newFuncBucketOption(func(o *bucketOptions) {
+		o.ttl = &ttl
+	})
+}
+
+// WithBucketCompactionFilter set the compaction policy of bucket, the merge process
+// removes the records which filter returns false. The filter is not persisted, it
+// should be set again after reopening.
+func WithBucketCompactionFilter(filter func(key, value []byte) bool) BucketOption {
+	return newFuncBucketOption(func(o *bucketOptions) {
+		o.filter = filter
+	})
+}
+
+// Bucket is a named keyspace of DB, the keys of different buckets never conflict
+// with each other or with the keys of DB. All buckets share the active data file
+// and the fsync of DB, but each bucket has its own keydir, TTL and compaction
+// policy, and it could be dropped in O(1) by DB.DropBucket. The keys and names
+// of buckets are limited to 2 bytes less than WithMaxKeyBytes, since the id of
+// bucket is prefixed to the stored key.
+type Bucket struct {
+	db     *DB
+	id     uint16
+	name   string
+	keyDir keydir
+
+	ttl     atomic.Int64
+	filter  atomic.Pointer[func(key, value []byte) bool]
+	dropped atomic.Bool
+}
+
+// Name returns the name of bucket.
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// TTL returns the time to live of the keys in bucket, 0 means never expire.
+func (b *Bucket) TTL() time.Duration {
+	return time.Duration(b.ttl.Load())
+}
+
+// expired reports whether the record written at tsTimestamp is expired at now.
+func (b *Bucket) expired(tsTimestamp uint64, now time.Time) bool {
+	ttl := b.TTL()
+	if ttl <= 0 {
+		return false
+	}
+
+	return !time.Unix(0, int64(tsTimestamp)).Add(ttl).After(now)
+}
+
+func (b *Bucket) Put(key, value []byte) error {
+	return b.PutContext(context.Background(), key, value)
+}
+
+// PutContext is the same as Put, but it gives up waiting if ctx is done.
+func (b *Bucket) PutContext(ctx context.Context, key, value []byte) error {
+	db := b.db
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if b.dropped.Load() {
+		return ErrBucketNotFound
+	}
+	if err := db.opt.validate(key, value); err != nil {
+		return err
+	}
+	if limit := db.opt.maxBucketKeyBytes(); len(key) > limit {
+		return &KeyTooLargeError{Size: len(key), Limit: limit}
+	}
+
+	entry := newEntry(bucketKey(b.id, key), value)
+	entry.flags = entryFlag_bucket
+	defer releaseEntry(entry)
+
+	if err := db.compressEntry(entry); err != nil {
+		return err
+	}
+
+	return db.write(ctx, entry, PriorityNormal)
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+// GetContext is the same as Get, but it gives up waiting if ctx is done.
+func (b *Bucket) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if b.dropped.Load() {
+		return nil, ErrBucketNotFound
+	}
+
+	// the timestamp is needed to check the expiration.
+	quick := b.TTL() <= 0
+	entry, err := b.db.getFrom(ctx, b.keyDir, key, quick)
+	if err != nil {
+		return nil, err
+	}
+	if !quick && b.expired(entry.tsTimestamp, time.Now()) {
+		return nil, ErrKeyNotFound
+	}
+
+	return entry.value, nil
+}
+
+// Delete removes the key from bucket, see DB.Delete.
+func (b *Bucket) Delete(key []byte) error {
+	return b.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is the same as Delete, but it gives up waiting if ctx is done.
+func (b *Bucket) DeleteContext(ctx context.Context, key []byte) error {
+	db := b.db
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if b.dropped.Load() {
+		return ErrBucketNotFound
+	}
+	dir, err := b.keyDir.get(key)
+	if err != nil {
+		return errors.Wrap(err, "bucket.Delete lookup keydir failed")
+	}
+	if absent(dir) {
+		return nil
+	}
+
+	entry := newTombstone(bucketKey(b.id, key))
+	entry.flags |= entryFlag_bucket
+	defer releaseEntry(entry)
+
+	return db.write(ctx, entry, PriorityNormal)
+}
+
+// ListKeys lists the keys of bucket, ErrBucketNotFound is returned if the bucket
+// has been dropped.
+// NOTE: the expired keys are listed until they are removed by the merge process.
+func (b *Bucket) ListKeys() ([]Key, error) {
+	if b.dropped.Load() {
+		return nil, ErrBucketNotFound
+	}
+
+	keys := make([]Key, 0, b.keyDir.len())
+	err := b.keyDir.rangeKeys(func(key []byte, keydir *keydirMemEntry) bool {
+		if !keydir.tombstone() {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "list keys of bucket %s", b.name)
+	}
+
+	return keys, nil
+}
+
+// ForEach calls fn with each key and its value of bucket until fn returns false,
+// see DB.ForEachContext.
+func (b *Bucket) ForEach(fn func(key, value []byte) bool) error {
+	keys, err := b.ListKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		value, err := b.Get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// bucketSet indexes the records of buckets, each bucket has its own keydir.
+type bucketSet struct {
+	db        *DB
+	newKeydir func() keydir
+
+	// createLock serializes creating and dropping buckets.
+	createLock sync.Mutex
+
+	mu      sync.RWMutex
+	keydirs map[uint16]keydir
+	buckets map[string]*Bucket
+	nextId  uint32
+	// loading indicates the keydirs are being restored, the keydirs of unknown
+	// buckets are created, since the catalog is not loaded yet.
+	loading bool
+}
+
+func newBucketSet(mode IndexMode) *bucketSet {
+	newKeydir := func() keydir { return newKeyDir() }
+	if mode == IndexModeCompact {
+		newKeydir = func() keydir { return newKeydirArenaTable() }
+	}
+
+	return &bucketSet{
+		newKeydir: newKeydir,
+		keydirs:   map[uint16]keydir{catalogBucketId: newKeydir()},
+		buckets:   make(map[string]*Bucket, 4),
+		nextId:    uint32(catalogBucketId) + 1,
+		loading:   true,
+	}
+}
+
+func (bs *bucketSet) keydir(id uint16) keydir {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return bs.keydirs[id]
+}
+
+func (bs *bucketSet) lookup(name string) *Bucket {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return bs.buckets[name]
+}
+
+// set indexes the entry of the stored key, the entries of dropped buckets are
+// ignored.
+func (bs *bucketSet) set(stored []byte, ent *keydirMemEntry) {
+	if len(stored) < bucketIdSize {
+		return
+	}
+
+	id := bucketIdOf(stored)
+	kd := bs.keydir(id)
+	if kd == nil {
+		bs.mu.Lock()
+		if kd = bs.keydirs[id]; kd == nil && bs.loading {
+			kd = bs.newKeydir()
+			bs.keydirs[id] = kd
+		}
+		bs.mu.Unlock()
+	}
+	if kd == nil {
+		return
+	}
+
+	indexKey(kd, stored[bucketIdSize:], ent)
+}
+
+// apply applies the catalog record of bucket name.
+func (bs *bucketSet) apply(name string, value []byte) error {
+	meta, err := decodeBucketMeta(value)
+	if err != nil {
+		return errors.Wrapf(err, "bucket %s", name)
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if uint32(meta.id) >= bs.nextId {
+		bs.nextId = uint32(meta.id) + 1
+	}
+
+	cur := bs.buckets[name]
+	if cur != nil && cur.id == meta.id && !meta.dropped {
+		cur.ttl.Store(int64(meta.ttl))
+		return nil
+	}
+	if cur != nil {
+		cur.dropped.Store(true)
+		delete(bs.buckets, name)
+		delete(bs.keydirs, cur.id)
+	}
+	if meta.dropped {
+		delete(bs.keydirs, meta.id)
+		return nil
+	}
+
+	kd := bs.keydirs[meta.id]
+	if kd == nil {
+		kd = bs.newKeydir()
+		bs.keydirs[meta.id] = kd
+	}
+	b := &Bucket{db: bs.db, id: meta.id, name: name, keyDir: kd}
+	b.ttl.Store(int64(meta.ttl))
+	bs.buckets[name] = b
+
+	return nil
+}
+
+// loaded is called after the catalog is loaded, the keydirs of dropped buckets
+// are released.
+func (bs *bucketSet) loaded() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	live := make(map[uint16]struct{}, len(bs.buckets)+1)
+	live[catalogBucketId] = struct{}{}
+	for _, b := range bs.buckets {
+		live[b.id] = struct{}{}
+	}
+	for id := range bs.keydirs {
+		if _, ok := live[id]; !ok {
+			delete(bs.keydirs, id)
+		}
+	}
+	bs.loading = false
+}
+
+// merged updates the keydirs of buckets after the data files are merged, the
+// keydirs are the entries of buckets in merged files.
+func (bs *bucketSet) merged(activeFileId uint16, keydirs []*keydirFileEntry) error {
+	grouped := make(map[uint16][]*keydirFileEntry, 4)
+	for _, keydir := range keydirs {
+		id := bucketIdOf(keydir.key)
+		stripped := *keydir
+		stripped.key = keydir.key[bucketIdSize:]
+		stripped.keySize = uint16(len(stripped.key))
+		grouped[id] = append(grouped[id], &stripped)
+	}
+
+	for id, group := range grouped {
+		kd := bs.keydir(id)
+		if kd == nil {
+			// the bucket has been dropped.
+			continue
+		}
+		if err := kd.merged(activeFileId, group); err != nil {
+			return errors.Wrapf(err, "bucket %d", id)
+		}
+	}
+
+	return nil
+}
+
+// compactionFilter returns the function to decide whether the record should be
+// removed by the merge process. The records of dropped buckets, the expired
+// records and the records rejected by the compaction filter of bucket are removed.
+func (bs *bucketSet) compactionFilter(now time.Time) func(kv *kvEntry) bool {
+	bs.mu.RLock()
+	buckets := make(map[uint16]*Bucket, len(bs.buckets))
+	for _, b := range bs.buckets {
+		buckets[b.id] = b
+	}
+	bs.mu.RUnlock()
+
+	return func(kv *kvEntry) bool {
+		if kv.flags&entryFlag_bucket == 0 || len(kv.key) < bucketIdSize {
+			return false
+		}
+		id := bucketIdOf(kv.key)
+		if id == catalogBucketId {
+			return false
+		}
+
+		b, ok := buckets[id]
+		if !ok {
+			return true
+		}
+		if b.expired(kv.tsTimestamp, now) {
+			return true
+		}
+
+		filter := b.filter.Load()
+		if filter == nil || kv.tombstone() {
+			return false
+		}
+		rawSize, err := kv.rawValueSize()
+		if err != nil {
+			return false
+		}
+		value, err := decompress(kv.codec(), kv.value, rawSize)
+		if err != nil {
+			return false
+		}
+
+		return !(*filter)(kv.key[bucketIdSize:], value)
+	}
+}
+
+// maxSeq returns the greatest sequence number of the entries of buckets.
+func (bs *bucketSet) maxSeq() (uint64, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	var seq uint64
+	for _, kd := range bs.keydirs {
+		n, err := kd.maxSeq()
+		if err != nil {
+			return 0, err
+		}
+		seq = max(seq, n)
+	}
+
+	return seq, nil
+}
+
+// bucketRouter routes the entries of buckets to their own keydirs while
+// restoring keydir.
+type bucketRouter struct {
+	keyDir   keydir
+	buckets  *bucketSet
+	operands *operandIndex
+	// seq is the greatest sequence number of restored entries, including the
+	// tombstones those are not indexed.
+	seq uint64
+}
+
+func (r *bucketRouter) set(key []byte, ent *keydirMemEntry) {
+	r.seq = max(r.seq, ent.seq)
+	if ent.flags&entryFlag_bucket != 0 {
+		r.buckets.set(key, ent)
+		return
+	}
+
+	r.operands.index(r.keyDir, key, ent)
+	indexKey(r.keyDir, key, ent)
+}
+
+// delRange applies the range tombstone, which never deletes the keys of buckets.
+func (r *bucketRouter) delRange(kr keyRange, ent *keydirMemEntry) {
+	r.seq = max(r.seq, ent.seq)
+	r.operands.delRange(kr)
+	r.keyDir.delRange(kr, ent)
+}
+
+// indexEntry indexes the written entry, the entries of buckets are indexed by
+// their own keydirs, and the catalog records are applied.
+func (db *DB) indexEntry(e *kvEntry, keydir *keydirMemEntry) error {
+	if e.rangeTombstone() {
+		r := keyRange{start: e.key, end: e.value}
+		db.operands.delRange(r)
+		db.keyDir.delRange(r, keydir)
+		return nil
+	}
+	if e.flags&entryFlag_bucket == 0 {
+		db.operands.index(db.keyDir, e.key, keydir)
+		indexKey(db.keyDir, e.key, keydir)
+		return nil
+	}
+
+	db.buckets.set(e.key, keydir)
+	if len(e.key) >= bucketIdSize && bucketIdOf(e.key) == catalogBucketId {
+		if err := db.buckets.apply(string(e.key[bucketIdSize:]), e.value); err != nil {
+			return errors.Wrap(err, "apply catalog record")
+		}
+	}
+
+	return nil
+}
+
+// loadBuckets loads the catalog after the keydirs are restored.
+func (db *DB) loadBuckets() error {
+	catalog := db.buckets.keydir(catalogBucketId)
+	names := make([]string, 0, catalog.len())
+	err := catalog.rangeKeys(func(key []byte, ent *keydirMemEntry) bool {
+		if !ent.tombstone() {
+			names = append(names, string(key))
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "range catalog")
+	}
+
+	for _, name := range names {
+		entry, err := db.getFrom(context.Background(), catalog, []byte(name), true)
+		if err != nil {
+			return errors.Wrapf(err, "read catalog record of bucket %s", name)
+		}
+		if err = db.buckets.apply(name, entry.value); err != nil {
+			return err
+		}
+	}
+	db.buckets.loaded()
+
+	return nil
+}
+
+// writeCatalog appends the catalog record of bucket name.
+func (db *DB) writeCatalog(name string, meta bucketMeta) error {
+	entry := newEntry(bucketKey(catalogBucketId, []byte(name)), meta.bytes())
+	entry.flags = entryFlag_bucket
+	defer releaseEntry(entry)
+
+	return db.write(context.Background(), entry, PriorityHigh)
+}
+
+// Bucket returns the bucket named name, it's created if it doesn't exist. The
+// options are applied to the bucket, and the options not given keep unchanged.
+// Buckets are not supported by IndexModeHint.
+func (db *DB) Bucket(name string, options ...BucketOption) (*Bucket, error) {
+	if db.opt.indexMode == IndexModeHint {
+		return nil, ErrBucketsUnsupported
+	}
+	if name == "" || len(name) > db.opt.maxBucketKeyBytes() {
+		return nil, ErrInvalidBucketName
+	}
+
+	opts := &bucketOptions{}
+	for _, opt := range options {
+		opt.apply(opts)
+	}
+
+	db.buckets.createLock.Lock()
+	defer db.buckets.createLock.Unlock()
+
+	b := db.buckets.lookup(name)
+	if b == nil || (opts.ttl != nil && *opts.ttl != b.TTL()) {
+		if db.readOnly.Load() {
+			if b == nil {
+				return nil, ErrBucketNotFound
+			}
+			return nil, ErrReadOnly
+		}
+
+		meta := bucketMeta{}
+		if b != nil {
+			meta.id, meta.ttl = b.id, b.TTL()
+		} else {
+			db.buckets.mu.RLock()
+			next := db.buckets.nextId
+			db.buckets.mu.RUnlock()
+			if next > 0xFFFF {
+				return nil, ErrTooManyBuckets
+			}
+			meta.id = uint16(next)
+		}
+		if opts.ttl != nil {
+			meta.ttl = *opts.ttl
+		}
+		if err := db.writeCatalog(name, meta); err != nil {
+			return nil, errors.Wrap(err, "write catalog record")
+		}
+
+		if b = db.buckets.lookup(name); b == nil {
+			return nil, ErrBucketNotFound
+		}
+	}
+	if opts.filter != nil {
+		b.filter.Store(&opts.filter)
+	}
+
+	return b, nil
+}
+
+// DropBucket drops the bucket named name in O(1), the keys of bucket are not
+// readable anymore, and they are removed by the merge process.
+func (db *DB) DropBucket(name string) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+
+	db.buckets.createLock.Lock()
+	defer db.buckets.createLock.Unlock()
+
+	b := db.buckets.lookup(name)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+
+	meta := bucketMeta{id: b.id, ttl: b.TTL(), dropped: true}
+	if err := db.writeCatalog(name, meta); err != nil {
+		return errors.Wrap(err, "write catalog record")
+	}
+
+	return nil
+}
+
+// Buckets returns the names of all buckets.
+func (db *DB) Buckets() []string {
+	db.buckets.mu.RLock()
+	defer db.buckets.mu.RUnlock()
+
+	names := make([]string, 0, len(db.buckets.buckets))
+	for name := range db.buckets.buckets {
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,247 @@
+package esl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bucketMeta(t *testing.T) {
+	meta := bucketMeta{id: 3, ttl: time.Hour, dropped: true}
+	decoded, err := decodeBucketMeta(meta.bytes())
+	require.NoError(t, err)
+	assert.Equal(t, meta, decoded)
+
+	_, err = decodeBucketMeta([]byte{1, 2})
+	assert.Error(t, err)
+}
+
+func openBucketTestDB(t *testing.T, fs afero.Fs, options ...Option) *DB {
+	options = append(options,
+		WithFileSystem(fs),
+		WithMaxFileBytes(256),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	db, err := Open("/tmp/esl", options...)
+	require.NoError(t, err)
+
+	return db
+}
+
+func listBucketKeys(t *testing.T, b *Bucket) []Key {
+	keys, err := b.ListKeys()
+	require.NoError(t, err)
+
+	return keys
+}
+
+func Test_DB_Bucket(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db := openBucketTestDB(t, fs)
+
+	users, err := db.Bucket("users")
+	require.NoError(t, err)
+	orders, err := db.Bucket("orders", WithBucketTTL(time.Hour))
+	require.NoError(t, err)
+	same, err := db.Bucket("users")
+	require.NoError(t, err)
+	assert.Same(t, users, same)
+	assert.ElementsMatch(t, []string{"users", "orders"}, db.Buckets())
+
+	// the same key in different keyspaces.
+	key := []byte("key")
+	require.NoError(t, db.Put(key, []byte("db")))
+	require.NoError(t, users.Put(key, []byte("users")))
+	require.NoError(t, orders.Put(key, []byte("orders")))
+	require.NoError(t, users.Put([]byte("only-users"), []byte("value")))
+
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("db"), value)
+	value, err = users.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+	value, err = orders.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("orders"), value)
+
+	assert.ElementsMatch(t, []Key{Key("key")}, db.ListKeys())
+	assert.ElementsMatch(t, []Key{Key("key"), Key("only-users")}, listBucketKeys(t, users))
+	_, err = orders.Get([]byte("only-users"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, users.Delete([]byte("only-users")))
+	_, err = users.Get([]byte("only-users"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// buckets are restored after reopening.
+	require.NoError(t, db.Close())
+	db = openBucketTestDB(t, fs)
+	defer db.Close()
+
+	users, err = db.Bucket("users")
+	require.NoError(t, err)
+	value, err = users.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+	assert.ElementsMatch(t, []Key{Key("key")}, listBucketKeys(t, users))
+
+	orders, err = db.Bucket("orders")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, orders.TTL())
+	visited := 0
+	require.NoError(t, orders.ForEach(func(k, v []byte) bool {
+		visited++
+		assert.Equal(t, key, k)
+		assert.Equal(t, []byte("orders"), v)
+		return true
+	}))
+	assert.Equal(t, 1, visited)
+}
+
+func Test_DB_DropBucket(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db := openBucketTestDB(t, fs)
+
+	users, err := db.Bucket("users")
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, users.Put([]byte{byte(i)}, []byte("value")))
+	}
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	require.NoError(t, db.DropBucket("users"))
+	assert.ErrorIs(t, db.DropBucket("users"), ErrBucketNotFound)
+	_, err = users.Get([]byte{0})
+	assert.ErrorIs(t, err, ErrBucketNotFound)
+	assert.ErrorIs(t, users.Put([]byte{0}, []byte("value")), ErrBucketNotFound)
+	_, err = users.ListKeys()
+	assert.ErrorIs(t, err, ErrBucketNotFound)
+	assert.Empty(t, db.Buckets())
+
+	// the new bucket with the same name is empty.
+	recreated, err := db.Bucket("users")
+	require.NoError(t, err)
+	assert.NotEqual(t, users.id, recreated.id)
+	assert.Empty(t, listBucketKeys(t, recreated))
+	require.NoError(t, recreated.Put([]byte{0}, []byte("new")))
+
+	require.NoError(t, db.merge())
+
+	// the records of dropped bucket are removed by merge.
+	require.NoError(t, db.Close())
+	db = openBucketTestDB(t, fs)
+	defer db.Close()
+
+	recreated, err = db.Bucket("users")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Key{{0}}, listBucketKeys(t, recreated))
+	value, err := recreated.Get([]byte{0})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+	value, err = db.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	_, ok := db.buckets.keydirs[users.id]
+	assert.False(t, ok)
+}
+
+func Test_Bucket_TTLAndCompactionFilter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db := openBucketTestDB(t, fs)
+	defer db.Close()
+
+	sessions, err := db.Bucket("sessions", WithBucketTTL(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, sessions.Put([]byte("fresh"), []byte("value")))
+
+	// write a record as if it was written an hour ago.
+	entry := newEntry(bucketKey(sessions.id, []byte("stale")), []byte("value"))
+	entry.flags = entryFlag_bucket
+	entry.tsTimestamp = uint64(time.Now().Add(-time.Hour).UnixNano())
+	require.NoError(t, db.write(context.Background(), entry, PriorityNormal))
+
+	_, err = sessions.Get([]byte("stale"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = sessions.Get([]byte("fresh"))
+	assert.NoError(t, err)
+
+	logs, err := db.Bucket("logs", WithBucketCompactionFilter(func(key, value []byte) bool {
+		return string(value) != "debug"
+	}))
+	require.NoError(t, err)
+	require.NoError(t, logs.Put([]byte("1"), []byte("debug")))
+	require.NoError(t, logs.Put([]byte("2"), []byte("error")))
+
+	// make sure the records are in the immutable data files.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Put([]byte{byte(i)}, []byte("value")))
+	}
+	require.NoError(t, db.merge())
+
+	_, err = sessions.Get([]byte("stale"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ElementsMatch(t, []Key{Key("fresh")}, listBucketKeys(t, sessions))
+	_, err = logs.Get([]byte("1"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	value, err := logs.Get([]byte("2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("error"), value)
+
+	// TTL could be changed.
+	sessions, err = db.Bucket("sessions", WithBucketTTL(0))
+	require.NoError(t, err)
+	assert.Zero(t, sessions.TTL())
+}
+
+func Test_DB_Bucket_unsupported(t *testing.T) {
+	db := openBucketTestDB(t, afero.NewMemMapFs(), WithIndexMode(IndexModeHint))
+	defer db.Close()
+
+	_, err := db.Bucket("users")
+	assert.ErrorIs(t, err, ErrBucketsUnsupported)
+
+	db2 := openBucketTestDB(t, afero.NewMemMapFs())
+	defer db2.Close()
+	_, err = db2.Bucket("")
+	assert.ErrorIs(t, err, ErrInvalidBucketName)
+}
+
+func Test_Bucket_keyLimit(t *testing.T) {
+	db := openBucketTestDB(t, afero.NewMemMapFs(), WithMaxKeyBytes(8))
+	defer db.Close()
+
+	// the stored name and key are prefixed by the bucket id.
+	_, err := db.Bucket("12345678")
+	assert.ErrorIs(t, err, ErrInvalidBucketName)
+	users, err := db.Bucket("123456")
+	require.NoError(t, err)
+
+	err = users.Put([]byte("12345678"), []byte("value"))
+	var keyErr *KeyTooLargeError
+	require.ErrorAs(t, err, &keyErr)
+	assert.Equal(t, 6, keyErr.Limit)
+	assert.ErrorIs(t, err, ErrKeyOrValueTooLong)
+
+	require.NoError(t, users.Put([]byte("123456"), []byte("value")))
+	value, err := users.Get([]byte("123456"))
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func Test_DB_indexEntry_badCatalog(t *testing.T) {
+	db := openBucketTestDB(t, afero.NewMemMapFs())
+	defer db.Close()
+
+	// the catalog record could not be decoded.
+	entry := newEntry(bucketKey(catalogBucketId, []byte("users")), []byte("bad"))
+	entry.flags |= entryFlag_bucket
+	defer releaseEntry(entry)
+	assert.Error(t, db.write(context.Background(), entry, PriorityNormal))
+	assert.Empty(t, db.Buckets())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	cli "github.com/urfave/cli/v2"
 	esl "github.com/yeqown/enchanted-sleeve"
@@ -16,6 +17,9 @@ import (
 // - set:  esl-ctl set  [global flags] key value
 // - del:  esl-ctl del  [global flags] key
 // - keys: esl-ctl keys [global flags]
+// - backup:  esl-ctl backup  [global flags] [--output file | --dir dir]
+// - restore: esl-ctl restore [global flags] --input file
+// - migrate: esl-ctl migrate [global flags]
 //
 // Global flags:
 // - path: path to db, default is ./testdata
@@ -33,6 +37,12 @@ func newCliApp() *cli.App {
 	app.Usage = "enchanted-sleeve control tool"
 	app.Version = "0.0.1"
 	app.Before = func(c *cli.Context) error {
+		// restore command writes into an empty path, and migrate command converts
+		// the files in place, so the db should not be opened.
+		if cmd := c.Args().First(); cmd == "restore" || cmd == "migrate" {
+			return nil
+		}
+
 		dbpath := c.String("path")
 		db, err := esl.Open(dbpath)
 		if err != nil {
@@ -60,6 +70,9 @@ func newCliApp() *cli.App {
 		newSetCommand(),
 		newDelCommand(),
 		newKeysCommand(),
+		newBackupCommand(),
+		newRestoreCommand(),
+		newMigrateCommand(),
 	}
 
 	return app
@@ -150,3 +163,100 @@ func newKeysCommand() *cli.Command {
 		},
 	}
 }
+
+func newBackupCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "backup",
+		Usage: "take a hot backup of db into a tar archive or a directory",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "path to the tar archive",
+			},
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "path to the backup directory, files are hard-linked if possible",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			db := dbFromContext(c.Context)
+			output := c.String("output")
+			dir := c.String("dir")
+			if (output == "") == (dir == "") {
+				return fmt.Errorf("one of output or dir is required")
+			}
+
+			if dir != "" {
+				if err := db.BackupToDir(dir); err != nil {
+					return err
+				}
+
+				fmt.Printf("backup into dir: %s\n", dir)
+				return nil
+			}
+
+			fd, err := os.OpenFile(output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+
+			if err = db.Backup(fd); err != nil {
+				_ = os.Remove(output)
+				return err
+			}
+
+			fmt.Printf("backup into archive: %s\n", output)
+			return fd.Sync()
+		},
+	}
+}
+
+func newRestoreCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "restore",
+		Usage: "restore db from a tar archive into the empty path",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "input",
+				Aliases:  []string{"i"},
+				Usage:    "path to the tar archive",
+				Required: true,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			dbpath := filepath.Clean(c.String("path"))
+			input := c.String("input")
+
+			fd, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+
+			if err = esl.Restore(fd, dbpath); err != nil {
+				return err
+			}
+
+			fmt.Printf("restore from archive: %s into %s\n", input, dbpath)
+			return nil
+		},
+	}
+}
+
+func newMigrateCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "migrate",
+		Usage: "convert db written by the former format into the current format in place",
+		Action: func(c *cli.Context) error {
+			dbpath := filepath.Clean(c.String("path"))
+			if err := esl.Migrate(dbpath); err != nil {
+				return err
+			}
+
+			fmt.Printf("migrate db: %s\n", dbpath)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,201 @@
+package esl
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Codec compresses and decompresses values. The codec id is stored in each
+// record, so that records compressed by different codecs could be read from
+// the same data file.
+type Codec interface {
+	// ID identifies the codec in records, it must be in [1, 7], and 1 and 2
+	// are reserved by CodecSnappy and CodecZstd.
+	ID() uint8
+	// Encode compresses src into dst if dst has enough capacity, otherwise
+	// a new slice is allocated.
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode decompresses src into dst if dst has enough capacity, otherwise
+	// a new slice is allocated.
+	Decode(dst, src []byte) ([]byte, error)
+	// DecodedLen returns the length of the decompressed data of src.
+	DecodedLen(src []byte) (int, error)
+}
+
+const (
+	codecIdSnappy uint8 = 1
+	codecIdZstd   uint8 = 2
+)
+
+var (
+	// CodecSnappy compresses values by snappy, it's fast and has a reasonable
+	// compression ratio.
+	CodecSnappy Codec = snappyCodec{}
+	// CodecZstd compresses values by zstd, it has a better compression ratio
+	// than snappy, but it's slower.
+	CodecZstd Codec = &zstdCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = [entryFlag_codecMask + 1]Codec{
+		codecIdSnappy: CodecSnappy,
+		codecIdZstd:   CodecZstd,
+	}
+)
+
+// RegisterCodec registers a custom codec, so that the records compressed by the
+// codec could be read. It panics if the codec id is invalid or has been registered.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	id := codec.ID()
+	if id == 0 || id > entryFlag_codecMask {
+		panic("esl: invalid codec id")
+	}
+	if codecs[id] != nil {
+		panic("esl: codec has been registered")
+	}
+
+	codecs[id] = codec
+}
+
+func lookupCodec(id uint8) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	if id > entryFlag_codecMask || codecs[id] == nil {
+		return nil, errors.Wrapf(ErrUnknownCodec, "codec id %d", id)
+	}
+
+	return codecs[id], nil
+}
+
+// decodedLen returns the length of the value before compression.
+func decodedLen(codecId uint8, value []byte) (int, error) {
+	codec, err := lookupCodec(codecId)
+	if err != nil {
+		return 0, err
+	}
+
+	return codec.DecodedLen(value)
+}
+
+// decompress decompresses the value by the codec, rawSize is the size of value
+// before compression.
+func decompress(codecId uint8, value []byte, rawSize uint16) ([]byte, error) {
+	if codecId == 0 {
+		return value, nil
+	}
+
+	codec, err := lookupCodec(codecId)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := codec.Decode(make([]byte, 0, rawSize), value)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress value")
+	}
+
+	return raw, nil
+}
+
+// compressEntry compresses the value of entry if the codec is configured and the
+// value is larger than the threshold. The entry would not be compressed if the
+// compressed value is not smaller.
+func (db *DB) compressEntry(e *kvEntry) error {
+	codec := db.opt.codec
+	if codec == nil || len(e.value) < int(db.opt.compressThreshold) || e.tombstone() {
+		return nil
+	}
+
+	compressed, err := codec.Encode(nil, e.value)
+	if err != nil {
+		return errors.Wrap(err, "compress value")
+	}
+	if len(compressed) >= len(e.value) {
+		return nil
+	}
+
+	e.value = compressed
+	e.valueSize = uint16(len(compressed))
+	e.flags = (e.flags &^ entryFlag_codecMask) | codec.ID()
+
+	return nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() uint8 { return codecIdSnappy }
+
+func (snappyCodec) Encode(dst, src []byte) ([]byte, error) {
+	return s2.EncodeSnappy(dst[:cap(dst)], src), nil
+}
+
+func (snappyCodec) Decode(dst, src []byte) ([]byte, error) {
+	return s2.Decode(dst[:cap(dst)], src)
+}
+
+func (snappyCodec) DecodedLen(src []byte) (int, error) {
+	return s2.DecodedLen(src)
+}
+
+// zstdCodec shares encoder and decoder, since EncodeAll and DecodeAll are
+// safe for concurrent use.
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		if c.encoder, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+
+	return c.err
+}
+
+func (c *zstdCodec) ID() uint8 { return codecIdZstd }
+
+func (c *zstdCodec) Encode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.encoder.EncodeAll(src, dst[:0]), nil
+}
+
+func (c *zstdCodec) Decode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.decoder.DecodeAll(src, dst[:0])
+}
+
+func (c *zstdCodec) DecodedLen(src []byte) (int, error) {
+	header := zstd.Header{}
+	if err := header.Decode(src); err != nil {
+		return 0, err
+	}
+	if header.HasFCS {
+		return int(header.FrameContentSize), nil
+	}
+
+	raw, err := c.Decode(nil, src)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(raw), nil
+}
@@ -0,0 +1,133 @@
+package esl
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Codec_roundtrip(t *testing.T) {
+	src := bytes.Repeat([]byte("enchanted-sleeve"), 64)
+
+	for _, codec := range []Codec{CodecSnappy, CodecZstd} {
+		encoded, err := codec.Encode(nil, src)
+		require.NoError(t, err)
+		assert.Less(t, len(encoded), len(src))
+
+		n, err := codec.DecodedLen(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, len(src), n)
+
+		decoded, err := decompress(codec.ID(), encoded, uint16(n))
+		require.NoError(t, err)
+		assert.Equal(t, src, decoded)
+	}
+}
+
+func Test_RegisterCodec(t *testing.T) {
+	assert.Panics(t, func() { RegisterCodec(CodecSnappy) })
+
+	_, err := lookupCodec(7)
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+}
+
+func compressibleValue(i int) []byte {
+	return bytes.Repeat([]byte("value-"+strconv.Itoa(i)), 32)
+}
+
+func Test_DB_compression(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func(options ...Option) *DB {
+		options = append(options,
+			WithFileSystem(fs),
+			WithMaxFileBytes(1024),
+			WithCompactThreshold(1000), // avoid auto merge
+		)
+		db, err := Open("/tmp/esl", options...)
+		require.NoError(t, err)
+		return db
+	}
+
+	// records written without compression.
+	db := open()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte("key-"+strconv.Itoa(i)), compressibleValue(i)))
+	}
+	require.NoError(t, db.Close())
+
+	// mixed with compressed records and small values.
+	db = open(WithCompression(CodecSnappy))
+	for i := 10; i < 20; i++ {
+		require.NoError(t, db.Put([]byte("key-"+strconv.Itoa(i)), compressibleValue(i)))
+	}
+	require.NoError(t, db.Put([]byte("small"), []byte("small")))
+
+	clue, err := db.keyDir.get([]byte("key-10"))
+	require.NoError(t, err)
+	require.NotNil(t, clue)
+	assert.Equal(t, codecIdSnappy, clue.codec())
+	assert.Less(t, clue.valueSize, clue.rawSize)
+	clue, err = db.keyDir.get([]byte("small"))
+	require.NoError(t, err)
+	require.NotNil(t, clue)
+	assert.Zero(t, clue.codec())
+	require.NoError(t, db.Close())
+
+	// zstd is readable together with snappy, reopen without hint files.
+	db = open(WithCompression(CodecZstd))
+	for i := 20; i < 30; i++ {
+		require.NoError(t, db.Put([]byte("key-"+strconv.Itoa(i)), compressibleValue(i)))
+	}
+	assertValues := func(db *DB) {
+		for i := 0; i < 30; i++ {
+			value, err := db.Get([]byte("key-" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			assert.Equal(t, compressibleValue(i), value)
+		}
+		value, err := db.Get([]byte("small"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("small"), value)
+	}
+	assertValues(db)
+
+	// merge keeps records compressed, and values are still readable from hint files.
+	require.NoError(t, db.merge())
+	assertValues(db)
+	require.NoError(t, db.Close())
+
+	db = open()
+	defer db.Close()
+	assertValues(db)
+}
+
+func Test_DB_compression_watch(t *testing.T) {
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithCompression(CodecSnappy),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("key"), compressibleValue(1)))
+
+	select {
+	case ev := <-ch:
+		assert.Equal(t, compressibleValue(1), ev.Value)
+		// the record is rebuilt as the same bytes as the data file.
+		assert.Equal(t, ev.size, uint32(len(ev.entry().encode(nil))))
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event received")
+	}
+}
@@ -1,6 +1,8 @@
 package esl
 
 import (
+	"context"
+	"io"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -8,6 +10,8 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
+
+	"github.com/yeqown/enchanted-sleeve/byteslice"
 )
 
 const (
@@ -24,11 +28,18 @@ const (
 // the log file in the order they are written. The log file is structured as
 // follows:
 //
-// | crc | tstamp | key_sz | value_sz | key | value |
-// | crc | tstamp | key_sz | value_sz | key | value |
+// | format header |
+// | crc | tstamp | seq | key_sz | value_sz | flags | key | value |
+// | crc | tstamp | seq | key_sz | value_sz | flags | key | value |
+//
+// The format header records the version of the layout, the data files written
+// by former versions which have no format header could not be opened, see
+// ErrIncompatibleFormat. If the encryption is enabled, an encryption header
+// follows the format header, and the key and value of each entry are encrypted.
 //
 // Since it's append-only, so modification and deletion would also append a new
-// entry to overwrite old value.
+// entry to overwrite old value. The entries of buckets are stored in the same
+// data files, see Bucket.
 type DB struct {
 	opt *options
 
@@ -43,6 +54,16 @@ type DB struct {
 	activeFileId      uint16
 	activeDataFile    afero.File
 	activeDataFileOff uint32
+	// activeCipher encrypts entries of activeDataFile, nil if it's not encrypted.
+	activeCipher *fileCipher
+	// seq is the sequence number of the last written entry, it's guarded by
+	// activeLock too.
+	seq uint64
+	// generation is the greatest generation of data files, new data files are
+	// created with it, and merge process increases it. activeGeneration is the
+	// generation of activeDataFile. They are guarded by activeLock too.
+	generation       uint64
+	activeGeneration uint64
 
 	// // The hint file for activeDataFile to store the keydir index of activeDataFile,
 	// // so that we can quickly restore keyDir from the hint file while db restart or recover from a crash.
@@ -53,12 +74,33 @@ type DB struct {
 	path string
 
 	// keyDir is a key-value index for all key-value pairs.
-	keyDir *keydirMemTable
+	keyDir keydir
+	// operands indexes the operands of keys in keyDir, see MergeOperator.
+	operands *operandIndex
 
 	// inCompaction is a flag to indicate whether the DB is in compaction.
 	inCompaction atomic.Bool
+	// compactLock is held while merging, so that backup could pin a consistent
+	// set of data files.
+	compactLock sync.Mutex
 	// compactCommand is a channel to receive startCompactRoutine command.
 	compactCommand chan struct{}
+
+	// watchHub dispatches committed changes to watchers.
+	watchHub *watchHub
+
+	// readOnly rejects writing operations while it's true.
+	readOnly atomic.Bool
+	// replica tails the primary if the DB is opened by OpenReplica.
+	replica *replica
+	// writer writes entries in sequence if the async writer is enabled.
+	writer *writer
+	// mmaps maps the immutable data files if mmap reads are enabled.
+	mmaps *mmapCache
+	// valueCache caches the hot values if it's enabled.
+	valueCache *valueCache
+	// buckets indexes the records of buckets.
+	buckets *bucketSet
 }
 
 // Open create or restore from the path.
@@ -68,6 +110,12 @@ func Open(path string, options ...Option) (*DB, error) {
 		opt.apply(dbOpts)
 	}
 
+	if dbOpts.codec != nil {
+		if _, err := lookupCodec(dbOpts.codec.ID()); err != nil {
+			return nil, errors.Wrap(err, "Open codec is not registered")
+		}
+	}
+
 	if err := ensurePath(dbOpts.fs, path); err != nil {
 		return nil, errors.Wrap(err, "Open ensurePath failed")
 	}
@@ -81,17 +129,49 @@ func Open(path string, options ...Option) (*DB, error) {
 }
 
 func newDB(path string, snap *dbPathSnap, opts *options) (*DB, error) {
+	start := time.Now()
+
+	generation, err := lastGeneration(opts.fs, snap)
+	if err != nil {
+		return nil, errors.Wrap(err, "lastGeneration")
+	}
 
 	activeFileId := snap.lastDataFileId
-	dataFile, dataFileOff, err := openDataFile(opts.fs, path, activeFileId)
+	dataFile, dataFileOff, dataCipher, activeGeneration, err :=
+		openDataFile(opts.fs, opts.encryption(), path, activeFileId, generation)
 	if err != nil {
 		return nil, errors.Wrap(err, "openDataFile")
 	}
 
-	keyDir := newKeyDir()
-	if !snap.isEmpty() {
-		if err = restoreKeydirIndex(opts.fs, snap, keyDir); err != nil {
-			return nil, errors.Wrap(err, "restoreKeydirIndex")
+	var (
+		keyDir keydir
+		// restoredSeq is the greatest sequence number of restored records.
+		restoredSeq uint64
+	)
+	buckets := newBucketSet(opts.indexMode)
+	operands := newOperandIndex()
+	switch opts.indexMode {
+	case IndexModeHint:
+		if keyDir, err = openKeydirHintTable(opts.fs, opts.encryption(), path, snap, activeFileId); err != nil {
+			_ = dataFile.Close()
+			return nil, errors.Wrap(err, "openKeydirHintTable")
+		}
+	default:
+		newShard := func() keydir { return newKeyDir() }
+		if opts.indexMode == IndexModeCompact {
+			newShard = func() keydir { return newKeydirArenaTable() }
+		}
+		keyDir = newShard()
+		if opts.keydirShards > 1 {
+			keyDir = newKeydirShards(opts.keydirShards, newShard)
+		}
+		if !snap.isEmpty() {
+			router := &bucketRouter{keyDir: keyDir, buckets: buckets, operands: operands}
+			if err = restoreKeydirIndex(opts.fs, opts.encryption(), snap, router, &opts.hooks); err != nil {
+				_ = dataFile.Close()
+				return nil, errors.Wrap(err, "restoreKeydirIndex")
+			}
+			restoredSeq = router.seq
 		}
 	}
 
@@ -103,24 +183,88 @@ func newDB(path string, snap *dbPathSnap, opts *options) (*DB, error) {
 		activeFileId:      activeFileId,
 		activeDataFile:    dataFile,
 		activeDataFileOff: dataFileOff,
+		activeCipher:      dataCipher,
+		generation:        generation,
+		activeGeneration:  activeGeneration,
 
 		path: path,
 
-		keyDir: keyDir,
+		keyDir:   keyDir,
+		operands: operands,
 
 		inCompaction:   atomic.Bool{},
 		compactCommand: make(chan struct{}, 1),
+
+		watchHub: newWatchHub(),
+		buckets:  buckets,
 	}
+	buckets.db = db
 
 	db.inArchived.Store(false)
 	db.inCompaction.Store(false)
+	db.readOnly.Store(opts.readOnly)
+	if opts.valueCacheBytes > 0 {
+		db.valueCache = newValueCache(opts.valueCacheBytes)
+	}
+	if opts.mmapReads && canMmap(opts.fs) {
+		db.mmaps = newMmapCache(opts.fs, opts.encryption(), path, opts.hooks.reportError)
+	}
+	if err = db.loadBuckets(); err != nil {
+		_ = dataFile.Close()
+		return nil, errors.Wrap(err, "loadBuckets")
+	}
+	if db.seq, err = db.lastSeq(); err != nil {
+		_ = dataFile.Close()
+		return nil, errors.Wrap(err, "lastSeq")
+	}
+	// the tombstones are not indexed, but their sequence numbers must not be
+	// reused while they are still in data files.
+	db.seq = max(db.seq, restoredSeq)
+	if opts.writeQueueSize > 0 {
+		db.writer = newWriter(db, opts.writeQueueSize)
+		go db.writer.run()
+	}
+
+	opts.hooks.recover(RecoverReport{
+		DataFiles:        len(snap.dataFiles),
+		HintFiles:        len(snap.hintFiles),
+		Keys:             keyDir.len(),
+		ActiveFileId:     activeFileId,
+		ActiveFileOffset: dataFileOff,
+		Duration:         time.Since(start),
+	})
 
 	go db.startCompactRoutine()
 
 	return db, nil
 }
 
+// lastSeq returns the greatest sequence number of indexed entries, which is the
+// sequence number of the last written entry unless it's a tombstone. Reusing the
+// sequence number of a tombstone removed by the merge process is safe.
+func (db *DB) lastSeq() (uint64, error) {
+	seq, err := db.keyDir.maxSeq()
+	if err != nil {
+		return 0, err
+	}
+	bucketSeq, err := db.buckets.maxSeq()
+	if err != nil {
+		return 0, err
+	}
+
+	return max(seq, bucketSeq), nil
+}
+
 func (db *DB) Close() error {
+	db.stopReplica()
+	if db.writer != nil {
+		db.writer.close()
+	}
+	db.watchHub.close()
+	if db.mmaps != nil {
+		db.mmaps.close()
+	}
+
 	if db.activeDataFile != nil {
 		if err := db.activeDataFile.Sync(); err != nil {
 			return errors.Wrap(err, "could not sync file")
@@ -154,21 +298,39 @@ func (db *DB) filesystem() FileSystem {
 
 // openDataFile open a data file for writing. If the file does not exist, it
 // creates a new active file with given fileId which should be formed as 10 digits,
-// for example, 0000000001.esld
-func openDataFile(fs FileSystem, path string, fileId uint16) (afero.File, uint32, error) {
+// for example, 0000000001.esld, and the new file is stamped with generation.
+// The cipher of data file is returned, it's nil if the data file is not encrypted.
+// The generation of the existing data file is returned as it is.
+func openDataFile(fs FileSystem, enc *encryption, path string, fileId uint16, generation uint64,
+) (afero.File, uint32, *fileCipher, uint64, error) {
 	dataFName := dataFilename(path, fileId)
 
 	dataFd, err := fs.OpenFile(dataFName, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
-		return nil, 0, errors.Wrap(err, "open data file failed")
+		return nil, 0, nil, 0, errors.Wrap(err, "open data file failed")
 	}
 	st, err := dataFd.Stat()
 	if err != nil {
 		_ = dataFd.Close()
-		return nil, 0, errors.Wrap(err, "read file stat failed")
+		return nil, 0, nil, 0, errors.Wrap(err, "read file stat failed")
+	}
+
+	// the existing data file keeps its own format header and encryption, and the
+	// new one is encrypted if the encryption is enabled.
+	var c *fileCipher
+	off := uint32(st.Size())
+	if off == 0 {
+		c, err = writeFileHeader(dataFd, enc, generation)
+		off = c.headerSize()
+	} else if generation, err = readFormatHeader(dataFd); err == nil {
+		c, err = readFileHeader(dataFd, enc)
+	}
+	if err != nil {
+		_ = dataFd.Close()
+		return nil, 0, nil, 0, errors.Wrap(err, "open data file header failed")
 	}
 
-	return dataFd, uint32(st.Size()), nil
+	return dataFd, off, c, generation, nil
 }
 
 // func openHintFile(fs FileSystem, path string, fileId uint16) (afero.File, uint32, error) {
@@ -188,7 +350,14 @@ func openDataFile(fs FileSystem, path string, fileId uint16) (afero.File, uint32
 // 	return hintFd, uint32(st.Size()), nil
 // }
 
-func (db *DB) archive() (err error) {
+func (db *DB) archive() error {
+	return db.archiveAs(db.generation)
+}
+
+// archiveAs archives the active data file, and the new active data file is
+// stamped with generation, the replica stamps its data files with the
+// generations of primary's.
+func (db *DB) archiveAs(generation uint64) (err error) {
 	if !db.inArchived.CompareAndSwap(false, true) {
 		// has been in archiving, return.
 		return
@@ -198,46 +367,116 @@ func (db *DB) archive() (err error) {
 	_ = db.activeDataFile.Close()
 	db.activeDataFile = nil
 
+	oldFileId := db.activeFileId
 	db.activeFileId++
-	db.activeDataFile, db.activeDataFileOff, err = openDataFile(db.filesystem(), db.path, db.activeFileId)
+	db.activeDataFile, db.activeDataFileOff, db.activeCipher, db.activeGeneration, err =
+		openDataFile(db.filesystem(), db.opt.encryption(), db.path, db.activeFileId, generation)
 	if err != nil {
 		return errors.Wrap(err, "openDataFile failed")
 	}
+	db.generation = max(db.generation, db.activeGeneration)
 
 	db.inArchived.Store(false)
+
+	// the keys of archived file are still indexed in memory if it fails.
+	if err = db.keyDir.archived(oldFileId); err != nil {
+		db.opt.hooks.reportError(errors.Wrapf(err, "index archived data file %d", oldFileId))
+	}
+	db.opt.hooks.archive(oldFileId, db.activeFileId)
+
 	return nil
 }
 
 func (db *DB) Put(key, value []byte) error {
-	if len(key) > int(db.opt.maxKeyBytes) || len(value) > int(db.opt.maxValueBytes) {
-		return ErrKeyOrValueTooLong
+	return db.put(context.Background(), key, value, PriorityNormal)
+}
+
+// PutContext is the same as Put, but it gives up waiting if ctx is done. The entry
+// is either written entirely or not written at all, and ctx.Err() is returned if
+// it's not written.
+func (db *DB) PutContext(ctx context.Context, key, value []byte) error {
+	return db.put(ctx, key, value, PriorityNormal)
+}
+
+// PutWithPriority is the same as Put, but the write is queued into the lane of
+// priority if the async writer is enabled, see WithAsyncWrite.
+func (db *DB) PutWithPriority(key, value []byte, priority WritePriority) error {
+	return db.put(context.Background(), key, value, priority)
+}
+
+func (db *DB) put(ctx context.Context, key, value []byte, priority WritePriority) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := db.opt.validate(key, value); err != nil {
+		return err
 	}
 
 	entry := newEntry(key, value)
 	defer releaseEntry(entry)
 
-	return db.write(entry)
+	if err := db.compressEntry(entry); err != nil {
+		return err
+	}
+
+	return db.write(ctx, entry, priority)
 }
 
 // Delete removes the key from the DB. Note that the key is not removed from the DB,
 // but marked as deleted, and the key will be removed from the DB when the DB is compacted.
 func (db *DB) Delete(key []byte) error {
-	if dir := db.keyDir.get(key); dir == nil || dir.valueSize == 0 {
+	return db.delete(context.Background(), key, PriorityNormal)
+}
+
+// DeleteContext is the same as Delete, but it gives up waiting if ctx is done,
+// see PutContext.
+func (db *DB) DeleteContext(ctx context.Context, key []byte) error {
+	return db.delete(ctx, key, PriorityNormal)
+}
+
+// DeleteWithPriority is the same as Delete, but the write is queued into the lane
+// of priority if the async writer is enabled, see WithAsyncWrite.
+func (db *DB) DeleteWithPriority(key []byte, priority WritePriority) error {
+	return db.delete(context.Background(), key, priority)
+}
+
+func (db *DB) delete(ctx context.Context, key []byte, priority WritePriority) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	dir, err := db.keyDir.get(key)
+	if err != nil {
+		return errors.Wrap(err, "db.Delete lookup keydir failed")
+	}
+	if absent(dir) {
 		return nil
 	}
 
-	entry := newEntry(key, nil)
+	entry := newTombstone(key)
 	defer releaseEntry(entry)
 
-	return db.write(entry)
+	return db.write(ctx, entry, priority)
 }
 
-// write to activate file and update keyDir index.
-// TODO: use channel to write to active file in sequence. also can set different channel for diff priority write.
-func (db *DB) write(e *kvEntry) error {
-	for db.inArchived.Load() {
-		// spin to wait for archiving finish
-		time.Sleep(time.Millisecond)
+// write to activate file and update keyDir index. If the async writer is enabled,
+// the entry is queued and written in sequence by the writer goroutine with other
+// entries together, otherwise it's written by the caller under activeLock.
+// It gives up if ctx is done before the entry is written.
+func (db *DB) write(ctx context.Context, e *kvEntry, priority WritePriority) error {
+	return db.writeIf(ctx, e, priority, nil)
+}
+
+// writeIf is the same as write, but the entry is written only if cond returns
+// true, otherwise errConditionFailed is returned. cond is evaluated while holding
+// activeLock, so that nothing could be written between evaluating and writing.
+func (db *DB) writeIf(ctx context.Context, e *kvEntry, priority WritePriority, cond func() bool) error {
+	if db.writer != nil {
+		return db.writer.submit(ctx, e, priority, cond)
+	}
+
+	// spin to wait for archiving finish
+	if err := waitWhile(ctx, &db.inArchived); err != nil {
+		return err
 	}
 
 	// FIXED: maybe deadlock with keyDir.lock? no, since keyDir only called in write method and
@@ -246,24 +485,19 @@ func (db *DB) write(e *kvEntry) error {
 	db.activeLock.Lock()
 	defer db.activeLock.Unlock()
 
-	keydir := &keydirMemEntry{
-		fileId:      db.activeFileId,
-		valueSize:   e.valueSize,
-		entryOffset: db.activeDataFileOff,
-		valueOffset: db.activeDataFileOff + kvEntry_fixedBytes + uint32(e.keySize),
+	// the entry is written entirely once it's started.
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	// fmt.Printf("entry(key=%s, value=%s) keydir: %+v\n", key, e.value, keydir)
-	n, err := e.write(db.activeDataFile)
-	if err != nil {
-		return errors.Wrap(err, "db.Put could not write to file")
+	if cond != nil && !cond() {
+		return errConditionFailed
+	}
+	if err := db.appendEntry(e); err != nil {
+		return err
 	}
-
-	db.keyDir.set(e.key, keydir)
-	db.activeDataFileOff += uint32(n)
 
 	if db.activeDataFileOff >= db.opt.maxFileBytes {
-		if err = db.archive(); err != nil {
+		if err := db.archive(); err != nil {
 			return errors.Wrap(err, "db archive failed")
 		}
 	}
@@ -271,8 +505,156 @@ func (db *DB) write(e *kvEntry) error {
 	return nil
 }
 
+// writeBatch writes the entries in order, see write. If the async writer is
+// disabled, the entries are appended under one acquisition of activeLock,
+// otherwise they are queued together. It's not atomic, the entries before the
+// failure may have been written.
+func (db *DB) writeBatch(ctx context.Context, entries []*kvEntry, priority WritePriority) error {
+	if db.writer != nil {
+		return db.writer.submitBatch(ctx, entries, priority)
+	}
+
+	// spin to wait for archiving finish
+	if err := waitWhile(ctx, &db.inArchived); err != nil {
+		return err
+	}
+
+	db.activeLock.Lock()
+	defer db.activeLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := db.appendBatch(entries)
+	return err
+}
+
+// appendEntry appends the entry to the active data file, updates keyDir index
+// and notifies watchers. It MUST be called while holding activeLock.
+func (db *DB) appendEntry(e *kvEntry) error {
+	_, err := db.appendEntries([]*kvEntry{e})
+	return err
+}
+
+// appendBatch appends the entries to the active data file, and archives the active
+// data file once it's full. It returns the number of appended entries.
+// It MUST be called while holding activeLock.
+func (db *DB) appendBatch(entries []*kvEntry) (int, error) {
+	written := 0
+	for written < len(entries) {
+		n, err := db.appendEntries(entries[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if db.activeDataFileOff >= db.opt.maxFileBytes {
+			if err = db.archive(); err != nil {
+				return written, errors.Wrap(err, "db archive failed")
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// appendEntries appends the entries to the active data file by one Write call,
+// updates keyDir index and notifies watchers. It stops after the entry which makes
+// the active data file full, and returns the number of appended entries, the
+// caller should archive the active data file and append the rest.
+// It MUST be called while holding activeLock.
+func (db *DB) appendEntries(entries []*kvEntry) (int, error) {
+	sealedEntries := make([]*kvEntry, 0, len(entries))
+	keydirs := make([]*keydirMemEntry, 0, len(entries))
+
+	off := db.activeDataFileOff
+	seq := db.seq
+	for _, e := range entries {
+		// the replicated entries keep the sequence numbers of primary.
+		if e.seq == 0 {
+			e.seq = seq + 1
+		}
+		seq = max(seq, e.seq)
+
+		rawSize, err := e.rawValueSize()
+		if err != nil {
+			return 0, errors.Wrap(err, "db.Put could not decode value size")
+		}
+
+		sealed, err := db.activeCipher.sealEntry(e, off)
+		if err != nil {
+			return 0, errors.Wrap(err, "db.Put could not encrypt entry")
+		}
+
+		keydir := &keydirMemEntry{
+			fileId:      db.activeFileId,
+			valueSize:   sealed.valueSize,
+			entryOffset: off,
+			valueOffset: off + kvEntry_fixedBytes + uint32(sealed.keySize),
+			rawSize:     rawSize,
+			flags:       e.flags,
+			seq:         e.seq,
+			tstamp:      e.tsTimestamp,
+		}
+		sealedEntries = append(sealedEntries, sealed)
+		keydirs = append(keydirs, keydir)
+
+		off = keydir.valueOffset + uint32(sealed.valueSize)
+		if off >= db.opt.maxFileBytes {
+			break
+		}
+	}
+
+	buf := byteslice.Get(int(off - db.activeDataFileOff))
+	defer byteslice.Put(buf)
+	pos := 0
+	for _, sealed := range sealedEntries {
+		sealed.encode(buf[pos:])
+		pos += kvEntry_fixedBytes + len(sealed.key) + len(sealed.value)
+	}
+
+	// fmt.Printf("entry(key=%s, value=%s) keydir: %+v\n", key, e.value, keydir)
+	if _, err := db.activeDataFile.Write(buf[:pos]); err != nil {
+		return 0, errors.Wrap(err, "db.Put could not write to file")
+	}
+	if db.opt.syncWrites {
+		if err := db.activeDataFile.Sync(); err != nil {
+			return 0, errors.Wrap(err, "db.Put could not sync file")
+		}
+	}
+
+	// the entries have been written, so all of them are indexed, and the error
+	// of the first failed one is returned with the number of entries before it.
+	indexed := len(keydirs)
+	var indexErr error
+	for i, keydir := range keydirs {
+		if err := db.indexEntry(entries[i], keydir); err != nil && indexErr == nil {
+			indexed, indexErr = i, err
+		}
+	}
+	db.activeDataFileOff = off
+	db.seq = seq
+
+	if db.watchHub.active() {
+		for i, keydir := range keydirs {
+			ev, err := newChangeEvent(entries[i], keydir, db.activeGeneration, true)
+			if err != nil {
+				return len(keydirs), errors.Wrap(err, "db.Put could not build change event")
+			}
+			db.watchHub.publish(ev)
+		}
+	}
+
+	return indexed, indexErr
+}
+
 func (db *DB) Get(key []byte) (value []byte, err error) {
-	entry, err := db.get(key, true)
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is the same as Get, but it gives up waiting if ctx is done.
+func (db *DB) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
+	entry, err := db.get(ctx, key, true)
 	if err != nil {
 		return nil, err
 	}
@@ -280,48 +662,172 @@ func (db *DB) Get(key []byte) (value []byte, err error) {
 	return entry.value, nil
 }
 
-func (db *DB) get(key []byte, quick bool) (entry *kvEntry, err error) {
-	for db.inCompaction.Load() {
-		// spin to wait for compaction finish
-		time.Sleep(time.Millisecond)
+// Meta describes the record of the latest value of a key.
+type Meta struct {
+	// Seq is the sequence number of the record, it increases with each write.
+	Seq uint64
+	// Timestamp is the time when the record was written, in nanoseconds.
+	Timestamp time.Time
+	// FileId is the id of the data file where the record is stored.
+	FileId uint16
+	// Size is the number of bytes the record costs in the data file.
+	Size uint32
+}
+
+// GetWithMeta is similar to Get, but it also returns the metadata of the record.
+func (db *DB) GetWithMeta(key []byte) (value []byte, meta *Meta, err error) {
+	// spin to wait for compaction finish
+	if err = waitWhile(context.Background(), &db.inCompaction); err != nil {
+		return nil, nil, err
+	}
+
+	clue, err := db.keyDir.get(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "lookup keydir failed")
+	}
+	if absent(clue) {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	entry, err := db.readClue(key, clue, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta = &Meta{
+		Seq:       entry.seq,
+		Timestamp: entry.timestamp(),
+		FileId:    clue.fileId,
+		Size:      clue.valueOffset + uint32(clue.valueSize) - clue.entryOffset,
+	}
+
+	return entry.value, meta, nil
+}
+
+// GetView is similar to Get, but the value is borrowed from the mapping of the
+// immutable data file without copying if WithMmapReads is set. The value is only
+// valid until release is called, and it MUST NOT be modified.
+//
+// The value is copied if it's in the active data file, compressed or encrypted,
+// and release is still required to be called.
+func (db *DB) GetView(key []byte) (value []byte, release func(), err error) {
+	noop := func() {}
+	if db.mmaps == nil {
+		value, err = db.Get(key)
+		return value, noop, err
+	}
+
+	// spin to wait for compaction finish
+	if err = waitWhile(context.Background(), &db.inCompaction); err != nil {
+		return nil, noop, err
+	}
+
+	clue, err := db.keyDir.get(key)
+	if err != nil {
+		return nil, noop, errors.Wrap(err, "lookup keydir failed")
+	}
+	if absent(clue) {
+		return nil, noop, ErrKeyNotFound
+	}
+
+	r, c, release, err := db.openReader(clue)
+	if err != nil {
+		return nil, noop, err
+	}
+	if m, ok := r.(*mmapFile); ok && c == nil && clue.codec() == 0 && !clue.operand() {
+		if value = m.slice(clue.valueOffset, clue.valueSize); value == nil {
+			release()
+			return nil, noop, errors.Wrap(io.ErrUnexpectedEOF, "read entry failed")
+		}
+		return value, release, nil
 	}
+	release()
 
-	clue := db.keyDir.get(key)
-	if clue == nil || clue.valueSize == 0 {
+	value, err = db.Get(key)
+	return value, noop, err
+}
+
+func (db *DB) get(ctx context.Context, key []byte, quick bool) (entry *kvEntry, err error) {
+	return db.getFrom(ctx, db.keyDir, key, quick)
+}
+
+// getFrom reads the entry of key located by keyDir.
+func (db *DB) getFrom(ctx context.Context, keyDir keydir, key []byte, quick bool) (entry *kvEntry, err error) {
+	// spin to wait for compaction finish
+	if err = waitWhile(ctx, &db.inCompaction); err != nil {
+		return nil, err
+	}
+
+	clue, err := keyDir.get(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup keydir failed")
+	}
+	if absent(clue) {
 		return nil, ErrKeyNotFound
 	}
 
-	var fd afero.File
-	if clue.fileId == db.activeFileId {
-		fd = db.activeDataFile
-	} else {
-		fd, err = db.openInactiveFile(clue)
-		if err != nil {
-			return nil, errors.Wrap(err, "open inactive file failed")
+	return db.readClue(key, clue, quick)
+}
+
+// readClue reads the entry of key located by clue, the operands of key are
+// folded if clue locates an operand.
+func (db *DB) readClue(key []byte, clue *keydirMemEntry, quick bool) (entry *kvEntry, err error) {
+	if clue.operand() {
+		return db.readOperands(key, clue)
+	}
+
+	return db.readRecord(key, clue, quick)
+}
+
+// readRecord reads the record of key located by clue.
+func (db *DB) readRecord(key []byte, clue *keydirMemEntry, quick bool) (entry *kvEntry, err error) {
+	if quick && db.valueCache != nil {
+		if value, ok := db.valueCache.get(key, clue); ok {
+			return &kvEntry{keySize: uint16(len(key)), valueSize: uint16(len(value)), key: key, value: value}, nil
 		}
 	}
 
-	// FIXED: activeFile concurrent read/write may cause read entry incorrectly.
-	db.activeLock.Lock()
-	defer db.activeLock.Unlock()
+	fd, c, release, err := db.openReader(clue)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	if quick {
 		entry = new(kvEntry)
 		entry.value = make([]byte, clue.valueSize)
-		err = readValueOnly(fd, clue, entry.value)
+		entry.flags = clue.flags
+		if err = readValueOnly(fd, clue, entry.value); err == nil {
+			entry.value, err = c.open(entry.value, clue.entryOffset, sealPartValue, recordAAD(clue.tstamp, clue.seq, clue.flags))
+		}
 	} else {
-		entry, err = readEntryEntire(fd, clue)
+		if entry, err = readEntryEntire(fd, clue); err == nil {
+			err = c.openEntry(entry, clue.entryOffset)
+		}
 	}
 	if err != nil {
 		return nil, errors.Wrap(err, "read entry failed")
 	}
 
+	// decompress the value transparently.
+	if codec := entry.codec(); codec != 0 {
+		if entry.value, err = decompress(codec, entry.value, clue.rawSize); err != nil {
+			return nil, errors.Wrap(err, "read entry failed")
+		}
+		entry.valueSize = uint16(len(entry.value))
+		entry.flags &^= entryFlag_codecMask
+	}
+
+	if quick && db.valueCache != nil {
+		db.valueCache.add(key, clue, entry.value)
+	}
+
 	// fmt.Printf("get key=%s, value=%s, clue: %+v\n", key, entry.value, clue)
 
 	return entry, nil
 }
 
-func readEntryEntire(dataFile afero.File, clue *keydirMemEntry) (*kvEntry, error) {
+func readEntryEntire(dataFile io.ReaderAt, clue *keydirMemEntry) (*kvEntry, error) {
 	// TODO: use buffer pool to reduce memory allocation.
 	header := make([]byte, kvEntry_fixedBytes)
 	n, err := dataFile.ReadAt(header, int64(clue.entryOffset))
@@ -354,7 +860,7 @@ func readEntryEntire(dataFile afero.File, clue *keydirMemEntry) (*kvEntry, error
 	return entry, nil
 }
 
-func readValueOnly(dataFile afero.File, clue *keydirMemEntry, value []byte) error {
+func readValueOnly(dataFile io.ReaderAt, clue *keydirMemEntry, value []byte) error {
 	n, err := dataFile.ReadAt(value, int64(clue.valueOffset))
 	if err != nil || n != int(clue.valueSize) {
 		return errors.Wrap(err, "read from dataFile failed")
@@ -363,6 +869,50 @@ func readValueOnly(dataFile afero.File, clue *keydirMemEntry, value []byte) erro
 	return nil
 }
 
+// openReader returns the data file to read the entry of clue and its cipher,
+// release must be called after reading.
+//
+// FIXED: activeFile concurrent read/write may cause read entry incorrectly.
+// Reading the active data file is serialized with writing since the handle is
+// shared, the readers share the lock if the file system supports concurrent
+// ReadAt. The inactive data files are read without lock.
+func (db *DB) openReader(clue *keydirMemEntry) (r io.ReaderAt, c *fileCipher, release func(), err error) {
+	db.activeLock.RLock()
+	active := clue.fileId == db.activeFileId
+	if active && isOsFs(db.filesystem()) {
+		return db.activeDataFile, db.activeCipher, db.activeLock.RUnlock, nil
+	}
+	db.activeLock.RUnlock()
+
+	if active {
+		db.activeLock.Lock()
+		if clue.fileId == db.activeFileId {
+			return db.activeDataFile, db.activeCipher, db.activeLock.Unlock, nil
+		}
+		// the active data file has been archived.
+		db.activeLock.Unlock()
+	}
+
+	if db.mmaps != nil {
+		m, err := db.mmaps.acquire(clue.fileId)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "map inactive file failed")
+		}
+		return m, m.cipher, m.release, nil
+	}
+
+	fd, err := db.openInactiveFile(clue)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "open inactive file failed")
+	}
+	if c, err = readFileHeader(fd, db.opt.encryption()); err != nil {
+		_ = fd.Close()
+		return nil, nil, nil, errors.Wrap(err, "read file cipher failed")
+	}
+
+	return fd, c, func() { _ = fd.Close() }, nil
+}
+
 // openInactiveFile open inactive file for reading.
 // TODO: add cache pool to reduce file open/close operations.
 func (db *DB) openInactiveFile(clue *keydirMemEntry) (afero.File, error) {
@@ -375,20 +925,114 @@ func (db *DB) openInactiveFile(clue *keydirMemEntry) (afero.File, error) {
 	return fd, nil
 }
 
+// Has reports whether the key exists, the value is not read from disk.
+func (db *DB) Has(key []byte) (bool, error) {
+	// spin to wait for compaction finish
+	if err := waitWhile(context.Background(), &db.inCompaction); err != nil {
+		return false, err
+	}
+
+	clue, err := db.keyDir.get(key)
+	if err != nil {
+		return false, errors.Wrap(err, "lookup keydir failed")
+	}
+
+	return !absent(clue), nil
+}
+
+// Len returns the number of live keys in O(1), the keys of buckets are not
+// counted. ErrLenUnsupported is returned in IndexModeHint, since the keys of
+// immutable data files are not kept in memory, and they could not be counted
+// without scanning the hint files.
+func (db *DB) Len() (int, error) {
+	if db.opt.indexMode == IndexModeHint {
+		return 0, ErrLenUnsupported
+	}
+
+	return db.keyDir.len(), nil
+}
+
 type Key []byte
 
+// ListKeys returns all keys of the DB. The keys listed before an error are
+// returned, and the error is reported to WithOnError, use ListKeysContext to
+// get the error.
 func (db *DB) ListKeys() []Key {
-	keys := make([]Key, 0, len(db.keyDir.indexes))
-	for key, keydir := range db.keyDir.indexes {
-		if keydir.valueSize == 0 {
-			continue
+	keys := make([]Key, 0, db.keyDir.len())
+	err := db.keyDir.rangeKeys(func(key []byte, keydir *keydirMemEntry) bool {
+		if !keydir.tombstone() {
+			keys = append(keys, key)
 		}
-		keys = append(keys, Key(key))
+		return true
+	})
+	if err != nil {
+		db.opt.hooks.reportError(errors.Wrap(err, "list keys"))
 	}
 
 	return keys
 }
 
+// ListKeysContext is the same as ListKeys, but it stops and returns ctx.Err()
+// if ctx is done before all keys are listed.
+func (db *DB) ListKeysContext(ctx context.Context) ([]Key, error) {
+	keys := make([]Key, 0, db.keyDir.len())
+	var ctxErr error
+	err := db.keyDir.rangeKeys(func(key []byte, keydir *keydirMemEntry) bool {
+		if len(keys)%1024 == 0 {
+			if ctxErr = ctx.Err(); ctxErr != nil {
+				return false
+			}
+		}
+		if !keydir.tombstone() {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "list keys")
+	}
+
+	return keys, nil
+}
+
+// ForEach calls fn with each key and its value until fn returns false.
+func (db *DB) ForEach(fn func(key, value []byte) bool) error {
+	return db.ForEachContext(context.Background(), fn)
+}
+
+// ForEachContext is the same as ForEach, but it stops and returns ctx.Err() if
+// ctx is done before all keys are visited. The keys are listed first, so the
+// keys written during iteration may be not visited, and the keys deleted during
+// iteration are skipped.
+func (db *DB) ForEachContext(ctx context.Context, fn func(key, value []byte) bool) error {
+	keys, err := db.ListKeysContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		value, err := db.GetContext(ctx, key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
 // Merge compacts the DB which developer uses to reduce disk usage manually.
 func (db *DB) Merge() error {
 	select {
@@ -398,6 +1042,13 @@ func (db *DB) Merge() error {
 	return nil
 }
 
+// MergeContext compacts the DB synchronously, unlike Merge, it waits until the
+// merge process is finished. It gives up if ctx is done, and the data files are
+// restored as if the merge process has never run.
+func (db *DB) MergeContext(ctx context.Context) error {
+	return db.mergeContext(ctx)
+}
+
 // Sync forces any writings to sync to disk
 func (db *DB) Sync() {
 	if db.inArchived.Load() {
@@ -84,3 +84,200 @@ func Benchmark_DB_Get(b *testing.B) {
 		require.NoError(b, err)
 	}
 }
+
+// benchmarkParallelKeys is the number of keys prepared for parallel benchmarks.
+const benchmarkParallelKeys = 100_000
+
+func openBenchmarkDB(b *testing.B, shards int) *DB {
+	b.Helper()
+
+	path := benchmarkDataPath + "-" + strconv.Itoa(shards)
+	require.NoError(b, os.MkdirAll(path, 0744))
+	b.Cleanup(func() {
+		_ = os.RemoveAll(path)
+	})
+
+	db, err := Open(path, WithKeydirShards(shards))
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for i := 0; i < benchmarkParallelKeys; i++ {
+		require.NoError(b, db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+
+	return db
+}
+
+// Benchmark_DB_Get_parallel compares the sharded keydir with the single one.
+// go test -run=^$ -bench=Benchmark_DB_.*_parallel -benchmem -cpu 1,4,16
+func Benchmark_DB_Get_parallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			db := openBenchmarkDB(b, shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					_, err := db.Get([]byte("key" + strconv.Itoa(r.Intn(benchmarkParallelKeys))))
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func Benchmark_DB_Put_parallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			db := openBenchmarkDB(b, shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					i := strconv.Itoa(r.Intn(benchmarkParallelKeys))
+					if err := db.Put([]byte("key"+i), []byte("value"+i)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Benchmark_DB_GetPut_parallel mixes 90% Get and 10% Put.
+func Benchmark_DB_GetPut_parallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			db := openBenchmarkDB(b, shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					i := strconv.Itoa(r.Intn(benchmarkParallelKeys))
+					var err error
+					if r.Intn(10) == 0 {
+						err = db.Put([]byte("key"+i), []byte("value"+i))
+					} else {
+						_, err = db.Get([]byte("key" + i))
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Benchmark_DB_Put_async compares the async writer with writing under activeLock,
+// the records are synced to disk in both cases.
+// go test -run=^$ -bench=Benchmark_DB_Put_async -benchmem -cpu 1,4,16
+func Benchmark_DB_Put_async(b *testing.B) {
+	for _, async := range []bool{false, true} {
+		b.Run("async="+strconv.FormatBool(async), func(b *testing.B) {
+			path := benchmarkDataPath + "-async"
+			require.NoError(b, os.MkdirAll(path, 0744))
+			defer func() {
+				_ = os.RemoveAll(path)
+			}()
+
+			options := []Option{WithSyncWrites()}
+			if async {
+				options = append(options, WithAsyncWrite(1024))
+			}
+			db, err := Open(path, options...)
+			require.NoError(b, err)
+			defer db.Close()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					i := strconv.Itoa(r.Intn(benchmarkParallelKeys))
+					if err := db.Put([]byte("key"+i), []byte("value"+i)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Benchmark_DB_Get_cache reads the keys in zipf distribution with and without
+// the value cache.
+// go test -run=^$ -bench=Benchmark_DB_Get_cache -benchmem
+func Benchmark_DB_Get_cache(b *testing.B) {
+	for _, capacity := range []int64{0, 4 << 20} {
+		b.Run("cache="+strconv.FormatInt(capacity, 10), func(b *testing.B) {
+			path := benchmarkDataPath + "-cache"
+			require.NoError(b, os.MkdirAll(path, 0744))
+			defer func() {
+				_ = os.RemoveAll(path)
+			}()
+
+			db, err := Open(path, WithValueCache(capacity))
+			require.NoError(b, err)
+			defer db.Close()
+			for i := 0; i < benchmarkParallelKeys; i++ {
+				require.NoError(b, db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+			}
+
+			zipf := rand.NewZipf(rand.New(rand.NewSource(time.Now().UnixNano())), 1.1, 1, benchmarkParallelKeys-1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = db.Get([]byte("key" + strconv.FormatUint(zipf.Uint64(), 10)))
+				require.NoError(b, err)
+			}
+			b.StopTimer()
+
+			stats := db.CacheStats()
+			if total := stats.Hits + stats.Misses; total > 0 {
+				b.ReportMetric(float64(stats.Hits)/float64(total), "hit-ratio")
+			}
+		})
+	}
+}
+
+// Benchmark_DB_MultiGet compares MultiGet with calling Get for each key, each
+// operation gets 100 keys from 1000 keys those are written together.
+// go test -run=^$ -bench=Benchmark_DB_MultiGet -benchmem
+func Benchmark_DB_MultiGet(b *testing.B) {
+	for _, multi := range []bool{false, true} {
+		b.Run("multi="+strconv.FormatBool(multi), func(b *testing.B) {
+			db := openBenchmarkDB(b, 1)
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			keys := make([][]byte, 100)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				base := r.Intn(benchmarkParallelKeys - 1000)
+				for j := range keys {
+					keys[j] = []byte("key" + strconv.Itoa(base+r.Intn(1000)))
+				}
+
+				if multi {
+					_, errs := db.MultiGet(keys)
+					for _, err := range errs {
+						require.NoError(b, err)
+					}
+					continue
+				}
+				for _, key := range keys {
+					_, err := db.Get(key)
+					require.NoError(b, err)
+				}
+			}
+		})
+	}
+}
@@ -1,12 +1,12 @@
 package esl
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"time"
-	"unsafe"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
@@ -19,7 +19,7 @@ func (db *DB) startCompactRoutine() {
 	needCompact := func() bool {
 		snap, er := takeDBPathSnap(db.filesystem(), db.path)
 		if er != nil {
-			fmt.Printf("takeDBPathSnap failed: %v\n", er)
+			db.opt.hooks.reportError(errors.Wrap(er, "takeDBPathSnap"))
 			return false
 		}
 
@@ -36,7 +36,8 @@ func (db *DB) startCompactRoutine() {
 	for {
 		select {
 		case <-ticker.C:
-			if needCompact() {
+			// the read-only DB, such as replica, never rewrites data files.
+			if !db.readOnly.Load() && needCompact() {
 				select {
 				case db.compactCommand <- struct{}{}:
 				default:
@@ -46,8 +47,8 @@ func (db *DB) startCompactRoutine() {
 		case <-db.compactCommand:
 		}
 
-		if err := db.merge(); err != nil {
-			fmt.Printf("merge failed: %v\n", err)
+		if err := db.merge(); err != nil && !errors.Is(err, ErrReadOnly) {
+			db.opt.hooks.reportError(errors.Wrap(err, "merge"))
 		}
 	}
 }
@@ -56,18 +57,88 @@ func (db *DB) startCompactRoutine() {
 // NOTE: if merge process is running, we should disable the operations
 // those are reading data, especially reading immutable data files.
 func (db *DB) merge() error {
+	return db.mergeContext(context.Background())
+}
+
+// mergeContext is similar to merge, but it gives up if ctx is done. The data
+// files are restored if the merge process is interrupted. ErrReadOnly is
+// returned if the DB is read-only, since the replica must keep the same data
+// files as primary.
+func (db *DB) mergeContext(ctx context.Context) (err error) {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+
+	for !db.compactLock.TryLock() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	defer db.compactLock.Unlock()
+
 	if !db.inCompaction.CompareAndSwap(false, true) {
 		return nil
 	}
+
+	start := time.Now()
+	stats := MergeStats{}
+	db.opt.hooks.mergeStart()
 	defer func() {
 		db.inCompaction.Store(false)
+
+		stats.Duration = time.Since(start)
+		db.opt.hooks.mergeDone(stats, err)
 	}()
 
 	oversize := func(off uint32) bool {
 		return off >= db.opt.maxFileBytes
 	}
 
-	return mergeFiles(db.filesystem(), db.path, db.activeFileId, oversize)
+	db.activeLock.RLock()
+	activeFileId := db.activeFileId
+	// the merged files are stamped with a new generation.
+	generation := db.generation + 1
+	db.activeLock.RUnlock()
+	// the buckets created after here write into the active data file or newer.
+	drop := db.buckets.compactionFilter(time.Now())
+
+	var merged []*keydirFileEntry
+	stats, merged, err = mergeFiles(ctx, db.filesystem(), db.opt.encryption(), db.path, activeFileId, generation,
+		oversize, drop, db.opt.fold)
+	// the merged data files have been replaced or removed.
+	if db.mmaps != nil {
+		db.mmaps.retire(activeFileId)
+	}
+	if db.valueCache != nil {
+		db.valueCache.purge(activeFileId)
+	}
+	if err != nil {
+		return err
+	}
+
+	db.activeLock.Lock()
+	defer db.activeLock.Unlock()
+	db.generation = generation
+
+	// the entries of buckets are indexed by their own keydirs.
+	var bucketed []*keydirFileEntry
+	n := 0
+	for _, keydir := range merged {
+		if keydir.flags&entryFlag_bucket != 0 {
+			bucketed = append(bucketed, keydir)
+			continue
+		}
+		merged[n] = keydir
+		n++
+	}
+	if err = db.buckets.merged(activeFileId, bucketed); err != nil {
+		return err
+	}
+	db.operands.merged(activeFileId, merged[:n])
+
+	return db.keyDir.merged(activeFileId, merged[:n])
 }
 
 // mergeFiles merges the older closed datafiles into one or many merged files
@@ -78,18 +149,34 @@ func (db *DB) merge() error {
 //
 // NOTE: mergeFiles is reading all immutable datafiles and writing to a new datafile,
 // and it only keeps the "live" or the latest version of the key-value pairs.
-func mergeFiles(fs FileSystem, path string, activeFileId uint16, oversize oversizeFunc) error {
+// The keydir entries of merged files are returned to update the KeyDir.
+// If enc is not nil, the merged files are encrypted by the current key.
+// The merged files are stamped with generation, which should be greater than
+// the generation of any existing data file.
+// The backup datafiles are restored if any error occurs or ctx is done.
+// The records which drop returns true and the tombstones are removed, and the
+// tombstone entries are returned for them, so that they are not readable anymore.
+// drop could be nil. The range tombstones and the records they cover are removed
+// too, the keydir has dropped the covered keys already.
+// The operands of each key are folded by fold into one record.
+func mergeFiles(ctx context.Context, fs FileSystem, enc *encryption, path string, activeFileId uint16, generation uint64,
+	oversize oversizeFunc, drop func(kv *kvEntry) bool, fold foldFunc,
+) (stats MergeStats, merged []*keydirFileEntry, err error) {
 	pattern := filepath.Join(path, dataFilePattern)
 	matched, err := afero.Glob(fs, pattern)
 	if err != nil {
-		return err
+		return stats, nil, err
 	}
 
 	orderedFileIds := make([]int, 0, len(matched))
 	for _, filename := range matched {
 		fileId, err := fileIdFromFilename(filename)
 		if err != nil {
-			return errors.Wrap(err, "fileIdFromFilename parse data file id")
+			return stats, nil, errors.Wrap(err, "fileIdFromFilename parse data file id")
+		}
+		// the active datafile and the newer ones are still written, skip them.
+		if fileId >= activeFileId {
+			continue
 		}
 		orderedFileIds = append(orderedFileIds, int(fileId))
 	}
@@ -97,34 +184,84 @@ func mergeFiles(fs FileSystem, path string, activeFileId uint16, oversize oversi
 
 	tombstone := make(map[string]struct{}, 1024)
 	alive := make(map[string]*kvEntry, 1024)
-
-	// trim the oldest datafile, since it's normally the active datafile.
-	fileId := orderedFileIds[0]
-	if uint16(fileId) == activeFileId {
-		orderedFileIds = orderedFileIds[1:]
+	dropped := make([]*kvEntry, 0, 16)
+	// operands are the operand records of keys from the newest to the oldest,
+	// which are not folded into any record yet.
+	operands := make(map[string][]*kvEntry)
+	// ranges are the range tombstones those have been walked through.
+	ranges := make([]*kvEntry, 0, 4)
+	covered := func(kv *kvEntry) bool {
+		if kv.flags&entryFlag_bucket != 0 {
+			return false
+		}
+		for _, r := range ranges {
+			if r.seq > kv.seq && (keyRange{start: r.key, end: r.value}).contains(kv.key) {
+				return true
+			}
+		}
+		return false
 	}
 
 	restoreFns := make([]func() error, 0, len(orderedFileIds))
 	cleanFns := make([]func() error, 0, len(orderedFileIds))
+	defer func() {
+		if err == nil {
+			// if merge success and remove all backup datafiles.
+			for _, cleanFn := range cleanFns {
+				_ = cleanFn()
+			}
+			return
+		}
+
+		// if merge failed, restore all backup datafiles.
+		for _, restoreFn := range restoreFns {
+			_ = restoreFn()
+		}
+	}()
 
 	// loop datafiles(from the newest to the oldest) to merge.
-	for _, fileId = range orderedFileIds {
+	for _, fileId := range orderedFileIds {
+		if err = ctx.Err(); err != nil {
+			return stats, nil, err
+		}
+
 		filename := dataFilename(path, uint16(fileId))
-		kvs, _, err2 := readDataFile(fs, filename, uint16(fileId))
+		kvs, _, err2 := readDataFile(fs, enc, filename, uint16(fileId))
 		if err2 != nil {
-			return errors.Wrap(err2, "readDataFile "+filename)
+			return stats, nil, errors.Wrap(err2, "readDataFile "+filename)
 		}
 
 		// backup datafile
 		restoreFn, cleanFn, err := backupFile(fs, filename)
 		if err != nil {
-			return errors.Wrap(err, "backupFile "+filename)
+			return stats, nil, errors.Wrap(err, "backupFile "+filename)
 		}
 		restoreFns = append(restoreFns, restoreFn)
 		cleanFns = append(cleanFns, cleanFn)
 
-		for _, kv := range kvs {
-			key := unsafe.String(&kv.key[0], int(kv.keySize))
+		// the hint file of merged datafile is out of date too.
+		hintFName := hintFilename(path, uint16(fileId))
+		if exists, _ := afero.Exists(fs, hintFName); exists {
+			if restoreFn, cleanFn, err = backupFile(fs, hintFName); err != nil {
+				return stats, nil, errors.Wrap(err, "backupFile "+hintFName)
+			}
+			restoreFns = append(restoreFns, restoreFn)
+			cleanFns = append(cleanFns, cleanFn)
+		}
+		stats.MergedFiles++
+		stats.ReadEntries += len(kvs)
+
+		// the newer entries are appended later, so walk from the tail.
+		for i := len(kvs) - 1; i >= 0; i-- {
+			kv := kvs[i]
+			if kv.rangeTombstone() {
+				// the range tombstone is dropped like a tombstone, but the older
+				// records it covers are ignored.
+				ranges = append(ranges, kv)
+				continue
+			}
+
+			key := mergeKey(kv)
 			if _, ignored := tombstone[key]; ignored {
 				continue
 			}
@@ -132,33 +269,86 @@ func mergeFiles(fs FileSystem, path string, activeFileId uint16, oversize oversi
 				continue
 			}
 
+			if covered(kv) {
+				// the older records of key are ignored too, and the newer operands
+				// are applied to nothing.
+				tombstone[key] = struct{}{}
+				if pending, ok := operands[key]; ok {
+					if alive[key], err = foldEntries(fold, nil, pending); err != nil {
+						return stats, nil, err
+					}
+					delete(operands, key)
+				}
+				continue
+			}
+
+			if drop != nil && drop(kv) {
+				// the older records of key are ignored too.
+				tombstone[key] = struct{}{}
+				dropped = append(dropped, kv)
+				continue
+			}
+
+			if kv.flags&entryFlag_operand != 0 {
+				operands[key] = append(operands[key], kv)
+				continue
+			}
+			if pending, ok := operands[key]; ok {
+				if kv, err = foldEntries(fold, kv, pending); err != nil {
+					return stats, nil, err
+				}
+				delete(operands, key)
+			}
+
 			if kv.tombstone() {
+				// every datafile older than the active one is merged, so no older
+				// record of key is left behind and the tombstone itself is dropped.
 				tombstone[key] = struct{}{}
+				dropped = append(dropped, kv)
+				continue
 			}
 
 			alive[key] = kv
 		}
 	}
 
-	err = writeMergeFileAndHint(fs, path, activeFileId-1, alive, oversize)
-	if err == nil {
-		// if merge success and remove all backup datafiles.
-		for _, cleanFn := range cleanFns {
-			_ = cleanFn()
+	// the operands applied to nothing.
+	for key, pending := range operands {
+		if alive[key], err = foldEntries(fold, nil, pending); err != nil {
+			return stats, nil, err
 		}
-		return nil
 	}
 
-	// if merge failed, restore all backup datafiles.
-	for _, restoreFn := range restoreFns {
-		_ = restoreFn()
+	if merged, err = writeMergeFileAndHint(ctx, fs, enc, path, activeFileId-1, generation, alive, oversize); err != nil {
+		return stats, nil, err
 	}
+	stats.AliveEntries = len(alive)
 
-	return err
+	for _, kv := range dropped {
+		merged = append(merged, &keydirFileEntry{
+			keydirMemEntry: keydirMemEntry{
+				fileId: activeFileId - 1,
+				flags:  kv.flags | entryFlag_tombstone,
+				seq:    kv.seq,
+				tstamp: kv.tsTimestamp,
+			},
+			keySize: kv.keySize,
+			key:     kv.key,
+		})
+	}
+
+	return stats, merged, nil
 }
 
 type oversizeFunc func(off uint32) bool
 
+// mergeKey returns the key of kv in merge process, the keys of buckets are
+// distinguished from the keys of DB by the flag.
+func mergeKey(kv *kvEntry) string {
+	// NOTE: the key may be empty, which is written by former versions.
+	return string(kv.flags&entryFlag_bucket) + unsafeString(kv.key)
+}
+
 // writeMergeFileAndHint writes the merged datafile and hint file.
 // The merged datafile and hint file will be named as the maxFileId, and if the merged
 // datafile is too large, it will be split into multiple datafiles. The next fileId
@@ -166,13 +356,20 @@ type oversizeFunc func(off uint32) bool
 // The aliveEntries is a map of key-value pairs that are alive or the latest version
 // of the key-value pairs.
 // oversize is a function to determine whether the datafile is too large.
+// The written keydir entries are returned.
+// If enc is not nil, both the datafile and hint file are encrypted.
+// Both the datafile and hint file are stamped with generation.
+// It gives up and cleans up the written files if ctx is done.
 //
 // TODO: what if the maxFileId is too less which cause the datafile id reverse overflow?
 // or we don't split even if the datafile is too large?
-func writeMergeFileAndHint(
-	fs FileSystem, path string, maxFileId uint16, aliveEntries map[string]*kvEntry, oversize oversizeFunc) (err error) {
+func writeMergeFileAndHint(ctx context.Context,
+	fs FileSystem, enc *encryption, path string, maxFileId uint16, generation uint64,
+	aliveEntries map[string]*kvEntry, oversize oversizeFunc,
+) (keydirs []*keydirFileEntry, err error) {
 
 	var fileIds = make([]uint16, 0, 8)
+	keydirs = make([]*keydirFileEntry, 0, len(aliveEntries))
 	// if any error occurs, we should clean up the datafile and hint file.
 	defer func() {
 		if err == nil {
@@ -185,6 +382,10 @@ func writeMergeFileAndHint(
 		}
 	}()
 
+	var (
+		dataCipher *fileCipher
+		hints      *hintWriter
+	)
 	open := func(fileId uint16) (dataFile, hintFile afero.File, closeFn func(), err error) {
 		fileIds = append(fileIds, fileId)
 
@@ -200,11 +401,18 @@ func writeMergeFileAndHint(
 		}()
 
 		dataFName := dataFilename(path, fileId)
-		if dataFile, err = fs.OpenFile(dataFName, os.O_CREATE|os.O_RDWR, 0666); err != nil {
+		if dataFile, err = fs.OpenFile(dataFName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666); err != nil {
 			return nil, nil, nil, err
 		}
 		hintFName := hintFilename(path, fileId)
-		if hintFile, err = fs.OpenFile(hintFName, os.O_CREATE|os.O_RDWR, 0666); err != nil {
+		if hintFile, err = fs.OpenFile(hintFName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if dataCipher, err = writeFileHeader(dataFile, enc, generation); err != nil {
+			return nil, nil, nil, err
+		}
+		if hints, err = newHintWriter(hintFile, enc, generation); err != nil {
 			return nil, nil, nil, err
 		}
 
@@ -216,36 +424,64 @@ func writeMergeFileAndHint(
 		return dataFile, hintFile, closeFn, nil
 	}
 
-	dataFile, hintFile, closeFn, err := open(maxFileId)
+	dataFile, _, closeFn, err := open(maxFileId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	valueOff := uint32(0)
-	entryOff := uint32(0)
+	entryOff := dataCipher.headerSize()
 	var (
 		keydir *keydirFileEntry
+		sealed *kvEntry
 		n      int
 	)
-	for _, entry := range aliveEntries {
-		if n, err = entry.write(dataFile); err != nil {
-			return errors.Wrap(err, "writeMergeFileAndHint.writeDataFile")
+	// write entries in the order of keys, so that the merged files are stable.
+	keys := make([]string, 0, len(aliveEntries))
+	for key := range aliveEntries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		if i%1024 == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		entry := aliveEntries[key]
+		if sealed, err = dataCipher.sealEntry(entry, entryOff); err != nil {
+			return nil, errors.Wrap(err, "writeMergeFileAndHint.sealEntry")
+		}
+		if n, err = sealed.write(dataFile); err != nil {
+			return nil, errors.Wrap(err, "writeMergeFileAndHint.writeDataFile")
+		}
+		valueOff = entryOff + kvEntry_fixedBytes + uint32(sealed.keySize)
+
+		var rawSize uint16
+		if rawSize, err = entry.rawValueSize(); err != nil {
+			return nil, errors.Wrap(err, "writeMergeFileAndHint.rawValueSize")
 		}
-		valueOff = entryOff + kvEntry_fixedBytes + uint32(entry.keySize)
 
 		keydir = &keydirFileEntry{
 			keydirMemEntry: keydirMemEntry{
 				fileId:      maxFileId,
-				valueSize:   entry.valueSize,
+				valueSize:   sealed.valueSize,
 				valueOffset: valueOff,
 				entryOffset: entryOff,
+				rawSize:     rawSize,
+				flags:       entry.flags,
+				seq:         entry.seq,
+				tstamp:      entry.tsTimestamp,
 			},
 			keySize: entry.keySize,
 			key:     entry.key,
 		}
-		if _, err = hintFile.Write(keydir.bytes()); err != nil {
-			return errors.Wrap(err, "writeMergeFileAndHint.writeHintFile")
+		if err = hints.write(keydir); err != nil {
+			return nil, errors.Wrap(err, "writeMergeFileAndHint.writeHintFile")
 		}
+		keydirs = append(keydirs, keydir)
 
 		// open another file if the current file is too large (>= 100MB).
 		if oversize(valueOff) {
@@ -253,12 +489,12 @@ func writeMergeFileAndHint(
 
 			maxFileId--
 			valueOff = 0
-			entryOff = 0
 
-			dataFile, hintFile, closeFn, err = open(maxFileId)
+			dataFile, _, closeFn, err = open(maxFileId)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			entryOff = dataCipher.headerSize()
 			continue
 		}
 
@@ -267,88 +503,160 @@ func writeMergeFileAndHint(
 
 	closeFn()
 
-	return nil
+	return keydirs, nil
 }
 
-// restoreKeydirIndex restore keyDir from index file. First of all, the restore process
-// will try scan all hint files and merge them into a single keyDir. But if the
-// hint files are not found, the restore process will scan all data files and
-// merge them into a single keyDir.
-func restoreKeydirIndex(fs FileSystem, snap *dbPathSnap, keyDir *keydirMemTable) error {
-	hintFileIds := make(map[uint16]struct{}, len(snap.hintFiles))
-	if len(snap.hintFiles) != 0 {
-		for _, hintFile := range snap.hintFiles {
-			fileId, err := fileIdFromFilename(hintFile)
-			if err != nil {
-				// skip invalid hint file
-				continue
-			}
-			hintFileIds[fileId] = struct{}{}
+// restoreKeydirIndex restore keyDir from index file. The restore process
+// walks all files from the oldest to the newest, so that the newer entries
+// overwrite the older ones. If the data file has a related hint file, the hint
+// file is used, otherwise the data file is scanned. The data files which names
+// could not be parsed are skipped and reported to h.
+func restoreKeydirIndex(fs FileSystem, enc *encryption, snap *dbPathSnap, keyDir keydirSetter, h *hooks) error {
+	hintFiles := make(map[uint16]string, len(snap.hintFiles))
+	dataFiles := make(map[uint16]string, len(snap.dataFiles))
+	fileIds := make([]int, 0, len(snap.dataFiles))
+
+	for _, hintFile := range snap.hintFiles {
+		fileId, err := fileIdFromFilename(hintFile)
+		if err != nil {
+			// skip invalid hint file
+			continue
+		}
+		hintFiles[fileId] = hintFile
+		fileIds = append(fileIds, int(fileId))
+	}
 
-			keydirs, err := readHintFile(fs, hintFile)
+	for _, filename := range snap.dataFiles {
+		fileId, err := fileIdFromFilename(filename)
+		if err != nil {
+			h.reportError(errors.Wrap(err, "skip data file "+filename))
+			continue
+		}
+		dataFiles[fileId] = filename
+		if _, exists := hintFiles[fileId]; !exists {
+			fileIds = append(fileIds, int(fileId))
+		}
+	}
+	sort.Ints(fileIds)
+
+	for _, fileId := range fileIds {
+		// Range data files and merge them into keyDir. if the data file has related hint file,
+		// we can skip the data file.
+		if hintFile, exists := hintFiles[uint16(fileId)]; exists {
+			keydirs, err := readHintFile(fs, enc, hintFile)
 			if err != nil {
 				return errors.Wrap(err, "read hint file failed")
 			}
 
+			// the keys in hint file are not in the order of writing, so the range
+			// tombstones are applied after the other entries.
+			var ranges []*keydirFileEntry
 			for _, keydir := range keydirs {
+				if keydir.flags&entryFlag_rangeTombstone != 0 {
+					ranges = append(ranges, keydir)
+					continue
+				}
 				keyDir.set(keydir.key, &keydir.keydirMemEntry)
 			}
+			for _, keydir := range ranges {
+				// the end of range is stored in the data file.
+				end, err := readRangeEnd(fs, enc, dataFiles[uint16(fileId)], &keydir.keydirMemEntry)
+				if err != nil {
+					return errors.Wrap(err, "read range tombstone failed")
+				}
+				keyDir.delRange(keyRange{start: keydir.key, end: end}, &keydir.keydirMemEntry)
+			}
+			continue
 		}
-		return nil
-	}
 
-	if len(snap.dataFiles) != 0 {
-		for _, filename := range snap.dataFiles {
-			fileId, err := fileIdFromFilename(filename)
-			if err != nil {
-				println("could not parse data file, ", err.Error())
-				continue
-			}
-			// Range data files and merge them into keyDir. if the data file has related hint file,
-			// we can skip the data file.
-			if _, exists := hintFileIds[fileId]; exists {
-				continue
+		// each record is indexed in order, so that the operands of keys are chained.
+		filename := dataFiles[uint16(fileId)]
+		err := scanDataFile(fs, enc, filename, uint16(fileId), 0, -1, nil, func(entry *kvEntry, keydir *keydirMemEntry) error {
+			if entry.rangeTombstone() {
+				keyDir.delRange(keyRange{start: entry.key, end: entry.value}, keydir)
+				return nil
 			}
+			keyDir.set(entry.key, keydir)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "scanDataFile "+filename)
+		}
+	}
 
-			kvs, keydirs, err := readDataFile(fs, filename, fileId)
-			if err != nil {
-				return errors.Wrap(err, "readDataFile "+filename)
-			}
+	return nil
+}
 
-			// FIXED: keydirMemEntry should be created while reading data file,
-			//  calculate from the offset is not precise and safe.
-			off := uint32(0)
-			for _, kv := range kvs {
-				keyDir.set(kv.key, keydirs[unsafe.String(&kv.key[0], len(kv.key))])
-				off += kvEntry_fixedBytes + uint32(kv.keySize) + uint32(kv.valueSize)
-			}
-		}
+// readRangeEnd reads the end of the range tombstone located by keydir.
+func readRangeEnd(fs FileSystem, enc *encryption, filename string, keydir *keydirMemEntry) ([]byte, error) {
+	var end []byte
+	err := scanDataFile(fs, enc, filename, keydir.fileId, int64(keydir.entryOffset),
+		int64(keydir.valueOffset)+int64(keydir.valueSize), nil, func(entry *kvEntry, _ *keydirMemEntry) error {
+			end = entry.value
+			return nil
+		})
 
+	return end, err
+}
+
+func readDataFile(fs FileSystem, enc *encryption, filename string, fileId uint16) ([]*kvEntry, map[string]*keydirMemEntry, error) {
+	var (
+		entries  []*kvEntry
+		keydires map[string]*keydirMemEntry
+	)
+
+	err := scanDataFile(fs, enc, filename, fileId, 0, -1, func(total int64) {
+		n := estimateEntry(total) // estimate the number of entries.
+		entries = make([]*kvEntry, 0, n)
+		keydires = make(map[string]*keydirMemEntry, n)
+	}, func(entry *kvEntry, keydir *keydirMemEntry) error {
+		entries = append(entries, entry)
+		keydires[unsafeString(entry.key)] = keydir
 		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil
+	return entries, keydires, nil
 }
 
-func readDataFile(fs FileSystem, filename string, fileId uint16) ([]*kvEntry, map[string]*keydirMemEntry, error) {
+// scanDataFile reads entries from the datafile in [off, end) one by one and
+// calls fn with the entry and its keydir. If end is negative, the datafile is read
+// until EOF. prepare is called with the size of the datafile before reading, it
+// could be nil. The encrypted entries are decrypted before calling fn, and
+// the records start after the format header and encryption header.
+func scanDataFile(
+	fs FileSystem, enc *encryption, filename string, fileId uint16, off, end int64,
+	prepare func(total int64), fn func(entry *kvEntry, keydir *keydirMemEntry) error) error {
+
 	fd, err := fs.OpenFile(filename, os.O_RDONLY, 0666)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	defer func() { _ = fd.Close() }()
 
 	// DONE: determine the size of datafile, so we can allocate a buffer to read all data
 	//       from datafile at once.
 	fi, err := fd.Stat()
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+
+	c, err := readFileHeader(fd, enc)
+	if err != nil {
+		return err
 	}
 
 	total := fi.Size()
-	cur := int64(0)
-	n := estimateEntry(total) // estimate the number of entries.
+	if end >= 0 && end < total {
+		total = end
+	}
+	if prepare != nil {
+		prepare(total)
+	}
 
-	entries := make([]*kvEntry, 0, n)
-	keydires := make(map[string]*keydirMemEntry, n)
+	cur := max(off, int64(c.headerSize()))
 	header := make([]byte, kvEntry_fixedBytes)
 
 	for cur < total {
@@ -360,85 +668,163 @@ func readDataFile(fs FileSystem, filename string, fileId uint16) ([]*kvEntry, ma
 		}
 
 		// read fixed entry header.
+		// NOTE: ReadAt may return io.EOF while reading the last entry, so only
+		// the number of read bytes is checked.
 		n, err2 := fd.ReadAt(header, cur)
-		if err != nil || n != kvEntry_fixedBytes {
-			return nil, nil, err2
+		if n != kvEntry_fixedBytes {
+			return err2
 		}
 
 		entry, err3 := decodeEntryFromHeader(header)
 		if err3 != nil {
-			return nil, nil, err3
+			return err3
 		}
 
 		// read key.
 		cur += kvEntry_fixedBytes
 		n, err2 = fd.ReadAt(entry.key, cur)
-		if err != nil || n != int(entry.keySize) {
-			return nil, nil, err2
+		if n != int(entry.keySize) {
+			return err2
 		}
 
 		// read value.
 		cur += int64(entry.keySize)
 		keydir.valueOffset = uint32(cur)
 		keydir.valueSize = entry.valueSize
+		keydir.flags = entry.flags
+		keydir.seq = entry.seq
+		keydir.tstamp = entry.tsTimestamp
 
 		n, err2 = fd.ReadAt(entry.value, cur)
-		if err != nil || n != int(entry.valueSize) {
-			return nil, nil, err2
+		if n != int(entry.valueSize) {
+			return err2
 		}
 
 		if !entry.validateChecksum() {
-			return nil, nil, ErrEntryCorrupted
+			return ErrEntryCorrupted
 		}
 
-		entries = append(entries, entry)
-		keydires[unsafe.String(&entry.key[0], int(entry.keySize))] = keydir
+		if err = c.openEntry(entry, keydir.entryOffset); err != nil {
+			return err
+		}
+
+		if keydir.rawSize, err = entry.rawValueSize(); err != nil {
+			return err
+		}
+
+		if err = fn(entry, keydir); err != nil {
+			return err
+		}
 
 		// step to next entry.
-		cur += int64(entry.valueSize)
+		cur += int64(keydir.valueSize)
 	}
 
-	return entries, keydires, nil
+	return nil
 }
 
-func readHintFile(fs FileSystem, filename string) ([]*keydirFileEntry, error) {
-	fd, err := fs.OpenFile(filename, os.O_RDONLY, 0666)
+func readHintFile(fs FileSystem, enc *encryption, filename string) ([]*keydirFileEntry, error) {
+	keydirFileEntries := make([]*keydirFileEntry, 0, 1024)
+	err := scanHintFile(fs, enc, filename, func(keydir *keydirFileEntry, _ uint32) error {
+		keydirFileEntries = append(keydirFileEntries, keydir)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	keydirFileEntries := make([]*keydirFileEntry, 0, 1024)
-	pos := int64(0)
+	return keydirFileEntries, nil
+}
+
+// scanHintFile reads keydir entries from the hint file one by one and calls fn
+// with the keydir and its offset in hint file. The encrypted keys are decrypted
+// before calling fn.
+func scanHintFile(fs FileSystem, enc *encryption, filename string, fn func(keydir *keydirFileEntry, off uint32) error) error {
+	fd, err := fs.OpenFile(filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fd.Close() }()
+
+	c, err := readFileHeader(fd, enc)
+	if err != nil {
+		return err
+	}
+
+	pos := int64(c.headerSize())
 	header := make([]byte, keydirFile_fixedSize)
 	fi, err := fd.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	for pos < fi.Size() {
+		off := uint32(pos)
+
 		// read fixed keydir header.
 		n, err2 := fd.ReadAt(header, pos)
-		if err != nil || n != keydirFile_fixedSize {
-			return nil, err2
+		if n != keydirFile_fixedSize {
+			return err2
 		}
 
 		keydir, err3 := decodeKeydirFileEntry(header)
 		if err3 != nil {
-			return nil, err3
+			return err3
 		}
 
 		// read key.
 		pos += keydirFile_fixedSize
 		n, err2 = fd.ReadAt(keydir.key, pos)
-		if err != nil || n != int(keydir.keySize) {
-			return nil, err2
+		if n != int(keydir.keySize) {
+			return err2
 		}
 
-		keydirFileEntries = append(keydirFileEntries, keydir)
-
 		// step to next keydir.
 		pos += int64(keydir.keySize)
+
+		if keydir.key, err = c.open(keydir.key, off, sealPartKey, recordAAD(keydir.tstamp, keydir.seq, keydir.flags)); err != nil {
+			return err
+		}
+		keydir.keySize = uint16(len(keydir.key))
+
+		if err = fn(keydir, off); err != nil {
+			return err
+		}
 	}
 
-	return keydirFileEntries, nil
+	return nil
+}
+
+// hintWriter appends keydir entries into a hint file, the keys are encrypted
+// if the encryption is enabled.
+type hintWriter struct {
+	w      io.Writer
+	cipher *fileCipher
+	off    uint32
+}
+
+// newHintWriter writes the format header with the generation of its data file
+// into the empty hint file, and the encryption header if the encryption is
+// enabled.
+func newHintWriter(w io.Writer, enc *encryption, generation uint64) (*hintWriter, error) {
+	c, err := writeFileHeader(w, enc, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hintWriter{w: w, cipher: c, off: c.headerSize()}, nil
+}
+
+func (hw *hintWriter) write(keydir *keydirFileEntry) (err error) {
+	hint := *keydir
+	if hint.key, err = hw.cipher.seal(keydir.key, hw.off, sealPartKey,
+		recordAAD(keydir.tstamp, keydir.seq, keydir.flags)); err != nil {
+		return err
+	}
+	hint.keySize = uint16(len(hint.key))
+
+	n, err := hw.w.Write(hint.bytes())
+	hw.off += uint32(n)
+
+	return err
 }
@@ -1,8 +1,11 @@
 package esl
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -20,7 +23,7 @@ func randomKVEntries(n int) map[string]*kvEntry {
 		key := []byte(fmt.Sprintf("key-%d", i))
 		value := []byte(fmt.Sprintf("value-%d", i))
 		ent := &kvEntry{
-			tsTimestamp: uint32(i),
+			tsTimestamp: uint64(i),
 			keySize:     uint16(len(key)),
 			valueSize:   uint16(len(value)),
 			key:         key,
@@ -36,7 +39,7 @@ func Test_mergeFiles(t *testing.T) {
 	path := "/tmp/esl"
 	actualFileId := uint16(3)
 
-	// 100 entries cost about 25 * 100 = 2.5 KB, avoid merging process produces
+	// 100 entries cost about 37 * 100 = 3.7 KB, avoid merging process produces
 	// more than one file, we set the oversize to 1 MB.
 	oversize := func(off uint32) bool {
 		return off > 1024*1024
@@ -55,8 +58,12 @@ func Test_mergeFiles(t *testing.T) {
 		}
 	}
 
-	err := mergeFiles(fs, path, actualFileId, oversize)
+	stats, merged, err := mergeFiles(context.Background(), fs, nil, path, actualFileId, 1, oversize, nil, nil)
 	assert.NoError(t, err)
+	assert.Len(t, merged, 100)
+	assert.Equal(t, 3, stats.MergedFiles)
+	assert.Equal(t, 300, stats.ReadEntries)
+	assert.Equal(t, 100, stats.AliveEntries)
 
 	// expected 2 data files (0000000002.esld, 0000000003.esld) after merge, and a
 	// hint file (0000000002.hint) for 0000000002.esld.
@@ -79,6 +86,42 @@ func Test_mergeFiles(t *testing.T) {
 	assert.Equal(t, 1, len(snap.hintFiles))
 }
 
+func Test_mergeFiles_tombstone(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/tmp/esl"
+	oversize := func(off uint32) bool {
+		return off > 1024*1024
+	}
+
+	// 0000000000.esld puts key-1 and key-2, 0000000001.esld deletes key-1, and
+	// 0000000002.esld is the active file.
+	for _, ent := range []*kvEntry{newEntry([]byte("key-1"), []byte("value")), newEntry([]byte("key-2"), []byte("value"))} {
+		_, err := writeEntryIntoFile(fs, 0, "/tmp/esl/0000000000.esld", ent)
+		require.NoError(t, err)
+	}
+	_, err := writeEntryIntoFile(fs, 1, "/tmp/esl/0000000001.esld", newTombstone([]byte("key-1")))
+	require.NoError(t, err)
+	_, err = writeEntryIntoFile(fs, 2, "/tmp/esl/0000000002.esld", newEntry([]byte("key-3"), []byte("value")))
+	require.NoError(t, err)
+
+	stats, merged, err := mergeFiles(context.Background(), fs, nil, path, 2, 1, oversize, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.MergedFiles)
+	assert.Equal(t, 1, stats.AliveEntries)
+	require.Len(t, merged, 2)
+	for _, keydir := range merged {
+		// the tombstone entry is returned to remove key-1 from the keydir.
+		assert.Equal(t, string(keydir.key) == "key-1", keydir.tombstone())
+	}
+
+	// no older file contains key-1, so the tombstone is not written.
+	kvs, _, err := readDataFile(fs, nil, "/tmp/esl/0000000001.esld", 1)
+	require.NoError(t, err)
+	require.Len(t, kvs, 1)
+	assert.Equal(t, []byte("key-2"), kvs[0].key)
+	assert.False(t, kvs[0].tombstone())
+}
+
 func Test_writeMergeFileAndHint(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	path := "/tmp/esl"
@@ -86,14 +129,15 @@ func Test_writeMergeFileAndHint(t *testing.T) {
 
 	entries := randomKVEntries(1000)
 	oversize := func(off uint32) bool {
-		// 16 KB
-		return off >= 16*1024
+		// 24 KB
+		return off >= 24*1024
 	}
 
-	err := writeMergeFileAndHint(fs, path, maxFileId, entries, oversize)
+	keydirs, err := writeMergeFileAndHint(context.Background(), fs, nil, path, maxFileId, 1, entries, oversize)
 	assert.NoError(t, err)
+	assert.Len(t, keydirs, len(entries))
 
-	// 1000 entries cost about 25 * 1000 = 25 KB,
+	// 1000 entries cost about 37 * 1000 = 37 KB,
 	// so we should have 2 data files. (0000000002.esld, 0000000003.esld)
 	// and 2 hint file (0000000002.hint, 0000000003.hint)
 
@@ -132,6 +176,12 @@ func writeEntryIntoFile(fs FileSystem, fileId uint16, filename string, entry *kv
 		return nil, err
 	}
 	pos := fi.Size()
+	if pos == 0 {
+		if _, err = file.Write(formatHeader(0)); err != nil {
+			return nil, err
+		}
+		pos = formatHeaderSize
+	}
 
 	_, err = entry.write(file)
 	keydir = &keydirMemEntry{
@@ -151,6 +201,16 @@ func writeHintIntoFile(fs FileSystem, filename string, keydir *keydirFileEntry)
 	}
 	defer file.Close()
 
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		if _, err = file.Write(formatHeader(0)); err != nil {
+			return err
+		}
+	}
+
 	_, err = file.Write(keydir.bytes())
 	return err
 }
@@ -194,14 +254,15 @@ func Test_restoreKeydirIndex_withHintFile(t *testing.T) {
 		},
 		lastDataFileId: 2,
 	}
-	err = restoreKeydirIndex(fs, snap, keydirIndex)
+	err = restoreKeydirIndex(fs, nil, snap, keydirIndex, nil)
 	assert.NoError(t, err)
 
 	// we should have 10 entries in keydirIndex and keydirIndex should have
 	// the same entries with randomEntries.
 	assert.Equal(t, 10, keydirIndex.len())
 	for key, ent := range randomEntries {
-		clue := keydirIndex.get([]byte(key))
+		clue, err := keydirIndex.get([]byte(key))
+		assert.NoError(t, err)
 		assert.NotNil(t, clue)
 		assert.NotEmpty(t, clue.fileId)
 		assert.NotEmpty(t, clue.valueSize)
@@ -242,14 +303,15 @@ func Test_restoreKeydirIndex_withoutHintFile(t *testing.T) {
 		lastDataFileId: 2,
 	}
 
-	err = restoreKeydirIndex(fs, snap, keydirIndex)
+	err = restoreKeydirIndex(fs, nil, snap, keydirIndex, nil)
 	assert.NoError(t, err)
 
 	// we should have 10 entries in keydirIndex and keydirIndex should have
 	// the same entries with randomEntries.
 	assert.Equal(t, 10, keydirIndex.len())
 	for key, ent := range randomEntries {
-		clue := keydirIndex.get([]byte(key))
+		clue, err := keydirIndex.get([]byte(key))
+		assert.NoError(t, err)
 		assert.NotNil(t, clue)
 		assert.NotEmpty(t, clue.fileId)
 		assert.NotEmpty(t, clue.valueSize)
@@ -262,6 +324,51 @@ func Test_restoreKeydirIndex_withoutHintFile(t *testing.T) {
 	}
 }
 
+func Test_restoreKeydirIndex_rangeTombstone(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	keydirIndex := newKeyDir()
+
+	entries := []*kvEntry{
+		newEntry([]byte("a/1"), []byte("value")),
+		newEntry([]byte("b/1"), []byte("value")),
+		newRangeTombstone(prefixRange([]byte("a/"))),
+		newEntry([]byte("a/3"), []byte("value")),
+	}
+	keydirs := make([]*keydirFileEntry, 0, len(entries))
+	for i, ent := range entries {
+		ent.seq = uint64(i + 1)
+		keydir, err := writeEntryIntoFile(fs, 1, "/tmp/esl/0000000001.esld", ent)
+		require.NoError(t, err)
+		keydir.flags = ent.flags
+		keydir.seq = ent.seq
+		keydirs = append(keydirs, &keydirFileEntry{keydirMemEntry: *keydir, keySize: ent.keySize, key: ent.key})
+	}
+	// the hint file is sorted by keys, so the range tombstone of "a/" is read
+	// before the older "a/1".
+	sort.Slice(keydirs, func(i, j int) bool {
+		return bytes.Compare(keydirs[i].key, keydirs[j].key) < 0
+	})
+	for _, keydir := range keydirs {
+		require.NoError(t, writeHintIntoFile(fs, "/tmp/esl/0000000001.hint", keydir))
+	}
+
+	snap := &dbPathSnap{
+		path:           "/tmp/esl",
+		dataFiles:      []string{"/tmp/esl/0000000001.esld"},
+		hintFiles:      []string{"/tmp/esl/0000000001.hint"},
+		lastDataFileId: 1,
+	}
+	require.NoError(t, restoreKeydirIndex(fs, nil, snap, keydirIndex, nil))
+
+	assert.Equal(t, 2, keydirIndex.len())
+	ent, _ := keydirIndex.get([]byte("a/1"))
+	assert.Nil(t, ent)
+	ent, _ = keydirIndex.get([]byte("a/3"))
+	assert.NotNil(t, ent)
+	ent, _ = keydirIndex.get([]byte("b/1"))
+	assert.NotNil(t, ent)
+}
+
 func Test_readDataFile(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	filename := "/tmp/esl/0000000001.esld"
@@ -277,7 +384,7 @@ func Test_readDataFile(t *testing.T) {
 		expectedKeydirs[string(ent.key)] = keydir
 	}
 
-	gotKVs, gotKeydirs, err := readDataFile(fs, filename, fileId)
+	gotKVs, gotKeydirs, err := readDataFile(fs, nil, filename, fileId)
 	assert.NoError(t, err)
 	assert.Equal(t, 10, len(gotKVs))
 	assert.Equal(t, 10, len(gotKeydirs))
@@ -345,6 +452,46 @@ func Test_DB_autoCompact(t *testing.T) {
 	snap, err := takeDBPathSnap(fs, "/tmp/esl")
 	require.NoError(t, err)
 	require.NotNil(t, snap)
-	assert.Equal(t, 3, len(snap.dataFiles))
-	assert.Equal(t, 2, len(snap.hintFiles))
+	assert.Equal(t, 2, len(snap.dataFiles))
+	assert.Equal(t, 1, len(snap.hintFiles))
+}
+
+func Test_mergeFiles_cancelled(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open(
+		"/tmp/esl/",
+		WithFileSystem(fs),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	kvEntries := randomKVEntries(20)
+	for _, kv := range kvEntries {
+		require.NoError(t, db.Put(kv.key, kv.value))
+	}
+	before, err := takeDBPathSnap(fs, "/tmp/esl/")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, db.MergeContext(ctx), context.Canceled)
+
+	// the data files are left untouched.
+	after, err := takeDBPathSnap(fs, "/tmp/esl/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, before.dataFiles, after.dataFiles)
+	assert.Empty(t, after.hintFiles)
+	for _, kv := range kvEntries {
+		value, err := db.Get(kv.key)
+		require.NoError(t, err)
+		assert.Equal(t, kv.value, value)
+	}
+
+	// merge works after the cancelled one.
+	require.NoError(t, db.MergeContext(context.Background()))
+	after, err = takeDBPathSnap(fs, "/tmp/esl/")
+	require.NoError(t, err)
+	assert.NotEmpty(t, after.hintFiles)
 }
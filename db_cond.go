@@ -0,0 +1,141 @@
+package esl
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// errConditionFailed is returned by DB.writeIf if the condition is not satisfied.
+var errConditionFailed = errors.New("condition failed")
+
+// absent reports whether the keydir entry means the key does not exist.
+func absent(clue *keydirMemEntry) bool {
+	return clue == nil || clue.tombstone()
+}
+
+// keyAbsent returns the condition that key does not exist.
+func (db *DB) keyAbsent(key []byte) func() bool {
+	return func() bool {
+		cur, err := db.keyDir.get(key)
+		return err == nil && absent(cur)
+	}
+}
+
+// keyUnchanged returns the condition that the latest entry of key is still the
+// entry of clue, it's evaluated against the keydir without reading data files.
+// The entries are told by their sequence numbers rather than locations, since
+// merge moves the entries, and a new entry may take the location of old one.
+func (db *DB) keyUnchanged(key []byte, clue *keydirMemEntry) func() bool {
+	return func() bool {
+		cur, err := db.keyDir.get(key)
+		if err != nil {
+			return false
+		}
+		if absent(cur) || absent(clue) {
+			return absent(cur) && absent(clue)
+		}
+
+		return cur.seq == clue.seq
+	}
+}
+
+// writeIfEquals writes e if the current value of key equals expected. The value
+// is read without holding the write lock, and the write is retried if the entry
+// of key has been changed since reading.
+func (db *DB) writeIfEquals(ctx context.Context, key, expected []byte, e *kvEntry) (bool, error) {
+	for {
+		// spin to wait for compaction finish
+		if err := waitWhile(ctx, &db.inCompaction); err != nil {
+			return false, err
+		}
+
+		clue, err := db.keyDir.get(key)
+		if err != nil {
+			return false, errors.Wrap(err, "lookup keydir failed")
+		}
+		if absent(clue) {
+			return false, nil
+		}
+
+		cur, err := db.readClue(key, clue, true)
+		if err != nil {
+			if db.inCompaction.Load() {
+				// the data file may be merged while reading.
+				continue
+			}
+			return false, err
+		}
+		if !bytes.Equal(cur.value, expected) {
+			return false, nil
+		}
+
+		err = db.writeIf(ctx, e, PriorityNormal, db.keyUnchanged(key, clue))
+		if errors.Is(err, errConditionFailed) {
+			continue
+		}
+
+		return err == nil, err
+	}
+}
+
+// CompareAndSwap sets the value of key to value only if its current value equals
+// expected, it's atomic with other writes. swapped is false if the key does not
+// exist or its value is not expected.
+func (db *DB) CompareAndSwap(key, expected, value []byte) (swapped bool, err error) {
+	if db.readOnly.Load() {
+		return false, ErrReadOnly
+	}
+	if err = db.opt.validate(key, value); err != nil {
+		return false, err
+	}
+
+	entry := newEntry(key, value)
+	defer releaseEntry(entry)
+
+	if err = db.compressEntry(entry); err != nil {
+		return false, err
+	}
+
+	return db.writeIfEquals(context.Background(), key, expected, entry)
+}
+
+// PutIfAbsent sets the value of key only if the key does not exist, it's atomic
+// with other writes. put is false if the key exists.
+func (db *DB) PutIfAbsent(key, value []byte) (put bool, err error) {
+	if db.readOnly.Load() {
+		return false, ErrReadOnly
+	}
+	if err = db.opt.validate(key, value); err != nil {
+		return false, err
+	}
+
+	entry := newEntry(key, value)
+	defer releaseEntry(entry)
+
+	if err = db.compressEntry(entry); err != nil {
+		return false, err
+	}
+
+	err = db.writeIf(context.Background(), entry, PriorityNormal, db.keyAbsent(key))
+	if errors.Is(err, errConditionFailed) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// DeleteIfEquals removes the key only if its current value equals expected, it's
+// atomic with other writes. deleted is false if the key does not exist or its
+// value is not expected.
+func (db *DB) DeleteIfEquals(key, expected []byte) (deleted bool, err error) {
+	if db.readOnly.Load() {
+		return false, ErrReadOnly
+	}
+
+	entry := newTombstone(key)
+	defer releaseEntry(entry)
+
+	return db.writeIfEquals(context.Background(), key, expected, entry)
+}
@@ -0,0 +1,162 @@
+package esl
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DB_conditionalWrites(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := []byte("lock")
+
+	put, err := db.PutIfAbsent(key, []byte("owner-1"))
+	require.NoError(t, err)
+	assert.True(t, put)
+	put, err = db.PutIfAbsent(key, []byte("owner-2"))
+	require.NoError(t, err)
+	assert.False(t, put)
+
+	swapped, err := db.CompareAndSwap(key, []byte("owner-2"), []byte("owner-3"))
+	require.NoError(t, err)
+	assert.False(t, swapped)
+	swapped, err = db.CompareAndSwap(key, []byte("owner-1"), []byte("owner-3"))
+	require.NoError(t, err)
+	assert.True(t, swapped)
+
+	deleted, err := db.DeleteIfEquals(key, []byte("owner-1"))
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	deleted, err = db.DeleteIfEquals(key, []byte("owner-3"))
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = db.Get(key)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// the key does not exist.
+	swapped, err = db.CompareAndSwap(key, []byte("owner-3"), []byte("owner-4"))
+	require.NoError(t, err)
+	assert.False(t, swapped)
+	deleted, err = db.DeleteIfEquals(key, []byte("owner-3"))
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	put, err = db.PutIfAbsent(key, []byte("owner-4"))
+	require.NoError(t, err)
+	assert.True(t, put)
+}
+
+func Test_DB_keyUnchanged(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := []byte("key")
+	require.NoError(t, db.Put(key, []byte("value")))
+	clue, err := db.keyDir.get(key)
+	require.NoError(t, err)
+
+	// the entry moved by merge is unchanged.
+	moved := *clue
+	moved.fileId, moved.entryOffset = moved.fileId+1, 0
+	assert.True(t, db.keyUnchanged(key, &moved)())
+
+	// the new entry at the location of old one is changed.
+	old := *clue
+	old.seq--
+	assert.False(t, db.keyUnchanged(key, &old)())
+
+	require.NoError(t, db.Delete(key))
+	assert.False(t, db.keyUnchanged(key, clue)())
+	assert.True(t, db.keyUnchanged(key, nil)())
+}
+
+func Test_DB_conditionalWrites_concurrency(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithAsyncWrite(16)}} {
+		options = append(options, WithFileSystem(afero.NewMemMapFs()), WithMaxFileBytes(4096))
+		db, err := Open("/tmp/esl", options...)
+		require.NoError(t, err)
+
+		// only one of the concurrent PutIfAbsent succeeds.
+		var winners atomic.Int32
+		wg := sync.WaitGroup{}
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				put, err := db.PutIfAbsent([]byte("lock"), []byte(strconv.Itoa(g)))
+				assert.NoError(t, err)
+				if put {
+					winners.Add(1)
+				}
+			}(g)
+		}
+		wg.Wait()
+		assert.EqualValues(t, 1, winners.Load())
+
+		// increase the counter by CompareAndSwap, no increment is lost.
+		counter := []byte("counter")
+		require.NoError(t, db.Put(counter, []byte("0")))
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					for {
+						cur, err := db.Get(counter)
+						if !assert.NoError(t, err) {
+							return
+						}
+						n, _ := strconv.Atoi(string(cur))
+						swapped, err := db.CompareAndSwap(counter, cur, []byte(strconv.Itoa(n+1)))
+						if !assert.NoError(t, err) {
+							return
+						}
+						if swapped {
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := db.Get(counter)
+		require.NoError(t, err)
+		assert.Equal(t, "400", string(value))
+		require.NoError(t, db.Close())
+	}
+}
+
+func Test_writer_conditionInBatch(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()), WithAsyncWrite(16))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the condition sees the former requests of the same batch.
+	key := []byte("key")
+	reqs := make([]*writeRequest, 2)
+	for i := range reqs {
+		reqs[i] = &writeRequest{
+			ctx:   context.Background(),
+			entry: newEntry(key, []byte(strconv.Itoa(i))),
+			cond:  db.keyAbsent(key),
+			done:  make(chan error, 1),
+		}
+	}
+	db.writer.write(reqs)
+	assert.NoError(t, <-reqs[0].done)
+	assert.ErrorIs(t, <-reqs[1].done, errConditionFailed)
+
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0"), value)
+}
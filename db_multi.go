@@ -0,0 +1,171 @@
+package esl
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// multiGetMaxGap is the max gap between two values those are read by one
+	// ReadAt call in MultiGet.
+	multiGetMaxGap = 512 // 512B
+	// multiGetMaxSpan limits the size of one ReadAt call in MultiGet.
+	multiGetMaxSpan = 1 << 20 // 1MB
+)
+
+// multiGetRead is a value to read in MultiGet.
+type multiGetRead struct {
+	idx  int
+	key  []byte
+	clue *keydirMemEntry
+}
+
+// MultiGet gets the values of keys, values[i] and errs[i] are the result of keys[i],
+// errs[i] is ErrKeyNotFound if the key does not exist.
+//
+// The values in the same data file are read in the order of offset, and the
+// adjacent values are read by one ReadAt call, so that it's much faster than
+// calling Get for each key.
+func (db *DB) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+
+	// spin to wait for compaction finish, it never fails without deadline.
+	_ = waitWhile(context.Background(), &db.inCompaction)
+
+	files := make(map[uint16][]multiGetRead, 4)
+	for i, key := range keys {
+		clue, err := db.keyDir.get(key)
+		if err != nil {
+			errs[i] = errors.Wrap(err, "lookup keydir failed")
+			continue
+		}
+		if absent(clue) {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		if clue.operand() {
+			if entry, err := db.readOperands(key, clue); err != nil {
+				errs[i] = err
+			} else {
+				values[i] = entry.value
+			}
+			continue
+		}
+		if db.valueCache != nil {
+			if value, ok := db.valueCache.get(key, clue); ok {
+				values[i] = value
+				continue
+			}
+		}
+
+		files[clue.fileId] = append(files[clue.fileId], multiGetRead{idx: i, key: key, clue: clue})
+	}
+
+	for _, reads := range files {
+		sort.Slice(reads, func(i, j int) bool {
+			return reads[i].clue.valueOffset < reads[j].clue.valueOffset
+		})
+		if err := db.multiGetFile(reads, values); err != nil {
+			for _, read := range reads {
+				if values[read.idx] == nil {
+					errs[read.idx] = err
+				}
+			}
+		}
+	}
+
+	return values, errs
+}
+
+// multiGetFile reads the values of the same data file, reads are sorted by offset.
+func (db *DB) multiGetFile(reads []multiGetRead, values [][]byte) error {
+	r, c, release, err := db.openReader(reads[0].clue)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for start := 0; start < len(reads); {
+		// merge the adjacent values into one span.
+		spanOff := reads[start].clue.valueOffset
+		spanEnd := spanOff + uint32(reads[start].clue.valueSize)
+		end := start + 1
+		for ; end < len(reads); end++ {
+			clue := reads[end].clue
+			valueEnd := clue.valueOffset + uint32(clue.valueSize)
+			if clue.valueOffset > spanEnd+multiGetMaxGap || valueEnd-spanOff > multiGetMaxSpan {
+				break
+			}
+			spanEnd = max(spanEnd, valueEnd)
+		}
+
+		span := make([]byte, spanEnd-spanOff)
+		if n, err := r.ReadAt(span, int64(spanOff)); n != len(span) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return errors.Wrap(err, "read from dataFile failed")
+		}
+
+		for _, read := range reads[start:end] {
+			off := read.clue.valueOffset - spanOff
+			stored := span[off : off+uint32(read.clue.valueSize) : off+uint32(read.clue.valueSize)]
+			value, err := c.open(stored, read.clue.entryOffset, sealPartValue,
+				recordAAD(read.clue.tstamp, read.clue.seq, read.clue.flags))
+			if err == nil {
+				value, err = decompress(read.clue.codec(), value, read.clue.rawSize)
+			}
+			if err != nil {
+				return errors.Wrap(err, "read entry failed")
+			}
+
+			values[read.idx] = value
+			if db.valueCache != nil {
+				db.valueCache.add(read.key, read.clue, value)
+			}
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// MultiPut puts the key-value pairs, keys[i] is set to values[i]. The entries are
+// written in order by one batch, so it's much faster than calling Put for each
+// pair. If the async writer is enabled, the entries are queued into the normal
+// lane together, see WithAsyncWrite.
+//
+// NOTE: it's not atomic, if it fails, the pairs before the failure may have been
+// written.
+func (db *DB) MultiPut(keys, values [][]byte) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if len(keys) != len(values) {
+		return errors.New("the number of keys and values mismatch")
+	}
+
+	entries := make([]*kvEntry, 0, len(keys))
+	defer func() {
+		for _, entry := range entries {
+			releaseEntry(entry)
+		}
+	}()
+	for i, key := range keys {
+		if err := db.opt.validate(key, values[i]); err != nil {
+			return err
+		}
+
+		entry := newEntry(key, values[i])
+		entries = append(entries, entry)
+		if err := db.compressEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	return db.writeBatch(context.Background(), entries, PriorityNormal)
+}
@@ -0,0 +1,100 @@
+package esl
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DB_MultiPut_MultiGet(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open("/tmp/esl",
+		WithFileSystem(fs),
+		WithMaxFileBytes(512),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithCompression(CodecSnappy),
+		WithEncryption(testKeyRing(1)),
+		WithValueCache(1<<20),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	keys := make([][]byte, 0, 100)
+	values := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte("key-"+strconv.Itoa(i)))
+		values = append(values, []byte("value-"+strconv.Itoa(i)))
+	}
+	keys = append(keys, []byte("large"))
+	values = append(values, compressibleValue(1))
+	require.NoError(t, db.MultiPut(keys, values))
+	assert.Greater(t, db.activeFileId, initDataFileId)
+	assertKeys(t, db, 0, 100)
+
+	require.NoError(t, db.Delete([]byte("key-1")))
+	keys = append(keys, []byte("key-1"), []byte("absent"), []byte("key-50"))
+	for i := 0; i < 2; i++ {
+		got, errs := db.MultiGet(keys)
+		require.Len(t, got, len(keys))
+		require.Len(t, errs, len(keys))
+		for j := range keys[:101] {
+			if j == 1 {
+				assert.ErrorIs(t, errs[j], ErrKeyNotFound)
+				continue
+			}
+			require.NoError(t, errs[j], string(keys[j]))
+			assert.Equal(t, values[j], got[j], string(keys[j]))
+		}
+		assert.ErrorIs(t, errs[101], ErrKeyNotFound)
+		assert.ErrorIs(t, errs[102], ErrKeyNotFound)
+		assert.NoError(t, errs[103])
+		assert.Equal(t, "value-50", string(got[103]))
+	}
+	// the second MultiGet is served by cache.
+	assert.GreaterOrEqual(t, db.CacheStats().Hits, uint64(100))
+
+	assert.Error(t, db.MultiPut(keys, values))
+	assert.ErrorIs(t, db.MultiPut([][]byte{make([]byte, maxKeySize+1)}, [][]byte{nil}), ErrKeyOrValueTooLong)
+}
+
+func Test_DB_MultiGet_values_not_aliased(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.MultiPut([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")}))
+	values, errs := db.MultiGet([][]byte{[]byte("a"), []byte("b")})
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	_ = append(values[0], 'x')
+	assert.Equal(t, "2", string(values[1]))
+}
+
+func Test_DB_MultiPut_asyncWrite(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open("/tmp/esl",
+		WithFileSystem(fs),
+		WithMaxFileBytes(512),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithAsyncWrite(16),
+	)
+	require.NoError(t, err)
+
+	// the batch is larger than the queue of writer.
+	keys := make([][]byte, 0, 100)
+	values := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte("key-"+strconv.Itoa(i)))
+		values = append(values, []byte("value-"+strconv.Itoa(i)))
+	}
+	require.NoError(t, db.MultiPut(keys, values))
+	assert.Greater(t, db.activeFileId, initDataFileId)
+	assertKeys(t, db, 0, 100)
+
+	require.NoError(t, db.Close())
+	assert.ErrorIs(t, db.MultiPut(keys, values), ErrClosed)
+}
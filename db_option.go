@@ -11,6 +11,8 @@ const (
 	maxValueSize = uint16(1) << 15 // 64K
 
 	maxDataFileSize = uint32(100 * 1024 * 1024) // 100MB
+
+	compressThreshold = uint16(128) // 128B
 )
 
 type options struct {
@@ -32,19 +34,107 @@ type options struct {
 
 	// The file system to access. Os package implements the default file system.
 	fs FileSystem
+
+	// The lifecycle callbacks, see hooks for more details.
+	hooks hooks
+
+	// readOnly indicates the DB rejects all writing operations, such as replica.
+	readOnly bool
+
+	// The codec to compress values, nil means no compression.
+	codec Codec
+	// The minimum number of bytes of a value to be compressed. The default value is 128B.
+	compressThreshold uint16
+
+	// The provider of keys to encrypt files, nil means no encryption.
+	keyProvider KeyProvider
+	// The algorithm to encrypt new files. The default value is EncryptionAES256GCM.
+	encryptionAlgorithm EncryptionAlgorithm
+
+	// The mode to index keys. The default value is IndexModeMemory.
+	indexMode IndexMode
+
+	// The number of keydir shards, keys are hashed to shards and each shard has its
+	// own lock. The default value is 1, which means the keydir is not sharded.
+	keydirShards int
+
+	// The capacity of each write lane of the async writer, the async writer is
+	// disabled if it's 0. The default value is 0.
+	writeQueueSize int
+	// syncWrites indicates the active data file is synced after each write, or
+	// each batch of writes if the async writer is enabled.
+	syncWrites bool
+
+	// mmapReads indicates the immutable data files are mapped into memory to
+	// serve Get, see WithMmapReads.
+	mmapReads bool
+
+	// The capacity of value cache in bytes, the value cache is disabled if it's 0.
+	// The default value is 0.
+	valueCacheBytes int64
+
+	// The merge operators by id, CounterOperator is always registered.
+	mergeOperators map[uint8]MergeOperator
 }
 
 func defaultOptions() *options {
 	return &options{
-		maxFileBytes:     maxDataFileSize,
-		maxKeyBytes:      maxKeySize,
-		maxValueBytes:    maxValueSize,
-		compactThreshold: 10,
-		compactInterval:  time.Minute,
-		fs:               afero.NewOsFs(),
+		maxFileBytes:      maxDataFileSize,
+		maxKeyBytes:       maxKeySize,
+		maxValueBytes:     maxValueSize,
+		compactThreshold:  10,
+		compactInterval:   time.Minute,
+		fs:                afero.NewOsFs(),
+		compressThreshold: compressThreshold,
+
+		encryptionAlgorithm: EncryptionAES256GCM,
+		keydirShards:        1,
+
+		mergeOperators: map[uint8]MergeOperator{
+			counterOperatorId: CounterOperator,
+		},
 	}
 }
 
+// encryption returns nil if the encryption is disabled.
+func (o *options) encryption() *encryption {
+	if o.keyProvider == nil {
+		return nil
+	}
+
+	return &encryption{
+		provider:  o.keyProvider,
+		algorithm: o.encryptionAlgorithm,
+	}
+}
+
+// validate checks the key and value to write, the key must not be empty, and
+// neither of them could exceed the limit.
+func (o *options) validate(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > int(o.maxKeyBytes) {
+		return &KeyTooLargeError{Size: len(key), Limit: int(o.maxKeyBytes)}
+	}
+	if len(value) > int(o.maxValueBytes) {
+		return &ValueTooLargeError{Size: len(value), Limit: int(o.maxValueBytes)}
+	}
+
+	return nil
+}
+
+// maxBucketKeyBytes returns the maximum number of bytes for a key of bucket, it's
+// less than maxKeyBytes since the id of bucket is prefixed to the stored key.
+func (o *options) maxBucketKeyBytes() int {
+	return int(o.maxKeyBytes) - bucketIdSize
+}
+
+// maxRecordBytes returns the size of the largest record which could be written.
+func (o *options) maxRecordBytes() uint32 {
+	return kvEntry_fixedBytes + uint32(o.maxKeyBytes) + uint32(o.maxValueBytes)
+}
+
 type Option interface {
 	apply(*options)
 }
@@ -106,3 +196,157 @@ func WithFileSystem(fs FileSystem) Option {
 		o.fs = fs
 	})
 }
+
+// WithOnArchive set the callback which would be called after the active data file
+// has been archived, oldFileId is the archived file id and newFileId is the new
+// active file id.
+// NOTE: the callback is called while holding the write lock, so it should return
+// as soon as possible, for example, upload the archived file in another goroutine.
+func WithOnArchive(fn func(oldFileId, newFileId uint16)) Option {
+	return newFuncOption(func(o *options) {
+		o.hooks.onArchive = fn
+	})
+}
+
+// WithOnMergeStart set the callback which would be called before merge process starts.
+func WithOnMergeStart(fn func()) Option {
+	return newFuncOption(func(o *options) {
+		o.hooks.onMergeStart = fn
+	})
+}
+
+// WithOnMergeDone set the callback which would be called after merge process
+// finished, err is not nil if the merge process failed.
+func WithOnMergeDone(fn func(stats MergeStats, err error)) Option {
+	return newFuncOption(func(o *options) {
+		o.hooks.onMergeDone = fn
+	})
+}
+
+// WithOnRecover set the callback which would be called after the DB has been
+// restored from the path while opening.
+func WithOnRecover(fn func(report RecoverReport)) Option {
+	return newFuncOption(func(o *options) {
+		o.hooks.onRecover = fn
+	})
+}
+
+// WithOnError set the callback which would be called with the errors those could
+// not be returned to the caller, for example, the errors of replication and other
+// background routines. The errors are dropped if it's not set.
+func WithOnError(fn func(err error)) Option {
+	return newFuncOption(func(o *options) {
+		o.hooks.onError = fn
+	})
+}
+
+// WithReadOnly open the DB in read-only mode, Put and Delete would return ErrReadOnly.
+func WithReadOnly() Option {
+	return newFuncOption(func(o *options) {
+		o.readOnly = true
+	})
+}
+
+// WithCompression set the codec to compress values, such as CodecSnappy and CodecZstd.
+// The custom codec should be registered by RegisterCodec before opening the DB.
+// Values are decompressed transparently while reading, and records written without
+// compression are still readable.
+func WithCompression(codec Codec) Option {
+	return newFuncOption(func(o *options) {
+		o.codec = codec
+	})
+}
+
+// WithCompressionThreshold set the minimum number of bytes of a value to be compressed.
+func WithCompressionThreshold(threshold uint16) Option {
+	return newFuncOption(func(o *options) {
+		o.compressThreshold = threshold
+	})
+}
+
+// WithEncryption encrypts the keys and values in data files and hint files by
+// the keys from provider. New files are encrypted by the current key, so the keys
+// could be rotated by changing the current key, and the merge process re-encrypts
+// all immutable files by the current key.
+func WithEncryption(provider KeyProvider) Option {
+	return newFuncOption(func(o *options) {
+		o.keyProvider = provider
+	})
+}
+
+// WithEncryptionAlgorithm set the algorithm to encrypt new files. Files encrypted by
+// other algorithms are still readable.
+func WithEncryptionAlgorithm(algorithm EncryptionAlgorithm) Option {
+	return newFuncOption(func(o *options) {
+		o.encryptionAlgorithm = algorithm
+	})
+}
+
+// WithIndexMode set the mode to index keys, see IndexMode for more details.
+func WithIndexMode(mode IndexMode) Option {
+	return newFuncOption(func(o *options) {
+		o.indexMode = mode
+	})
+}
+
+// WithKeydirShards set the number of keydir shards to reduce the lock contention
+// of concurrent Get and Put. It works with IndexModeMemory and IndexModeCompact,
+// and it's ignored by IndexModeHint.
+func WithKeydirShards(n int) Option {
+	return newFuncOption(func(o *options) {
+		o.keydirShards = n
+	})
+}
+
+// WithAsyncWrite enables the async writer, the writes from many callers are queued
+// and written in sequence by a dedicated goroutine, which coalesces the queued
+// writes into one Write call (and one fsync if WithSyncWrites is set). The callers
+// still wait until their writes are done. queueSize is the capacity of each write
+// lane, see WritePriority.
+func WithAsyncWrite(queueSize int) Option {
+	return newFuncOption(func(o *options) {
+		o.writeQueueSize = queueSize
+	})
+}
+
+// WithSyncWrites syncs the active data file after each write, so that the written
+// entries survive a machine crash. It's much slower without WithAsyncWrite.
+func WithSyncWrites() Option {
+	return newFuncOption(func(o *options) {
+		o.syncWrites = true
+	})
+}
+
+// WithMmapReads maps the immutable data files into memory to serve Get, and
+// GetView could borrow the value from the mapping without copying. It only works
+// with the os file system, the data files of other file systems are still read
+// by ReadAt.
+func WithMmapReads() Option {
+	return newFuncOption(func(o *options) {
+		o.mmapReads = true
+	})
+}
+
+// WithValueCache enables a LRU cache of values in front of data files, the cache
+// is bounded by capacity bytes. It's useful if the reads are skewed to hot keys.
+// The stats of cache could be got by DB.CacheStats.
+func WithValueCache(capacity int64) Option {
+	return newFuncOption(func(o *options) {
+		o.valueCacheBytes = capacity
+	})
+}
+
+// WithMergeOperator registers the merge operator, so that its operands could be
+// written by DB.PutOperand and folded while reading. The operator must be registered
+// each time the DB is opened if any of its operands exist. It panics if the id of
+// operator is invalid.
+func WithMergeOperator(op MergeOperator) Option {
+	id := op.ID()
+	if id == 0 || id == counterOperatorId {
+		panic("esl: invalid merge operator id")
+	}
+
+	return newFuncOption(func(o *options) {
+		o.mergeOperators[id] = op
+	})
+}
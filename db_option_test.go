@@ -72,3 +72,101 @@ func Test_WithFileSystem(t *testing.T) {
 	WithFileSystem(afero.NewMemMapFs()).apply(opt)
 	assert.NotNil(t, opt.fs)
 }
+
+func Test_WithHooks(t *testing.T) {
+	opt := defaultOptions()
+	assert.Nil(t, opt.hooks.onArchive)
+	assert.Nil(t, opt.hooks.onMergeStart)
+	assert.Nil(t, opt.hooks.onMergeDone)
+	assert.Nil(t, opt.hooks.onRecover)
+	assert.Nil(t, opt.hooks.onError)
+
+	WithOnArchive(func(oldFileId, newFileId uint16) {}).apply(opt)
+	WithOnMergeStart(func() {}).apply(opt)
+	WithOnMergeDone(func(stats MergeStats, err error) {}).apply(opt)
+	WithOnRecover(func(report RecoverReport) {}).apply(opt)
+	WithOnError(func(err error) {}).apply(opt)
+
+	assert.NotNil(t, opt.hooks.onArchive)
+	assert.NotNil(t, opt.hooks.onMergeStart)
+	assert.NotNil(t, opt.hooks.onMergeDone)
+	assert.NotNil(t, opt.hooks.onRecover)
+	assert.NotNil(t, opt.hooks.onError)
+}
+
+func Test_WithReadOnly(t *testing.T) {
+	opt := defaultOptions()
+	assert.False(t, opt.readOnly)
+
+	WithReadOnly().apply(opt)
+	assert.True(t, opt.readOnly)
+}
+
+func Test_WithCompression(t *testing.T) {
+	opt := defaultOptions()
+	assert.Nil(t, opt.codec)
+	assert.Equal(t, compressThreshold, opt.compressThreshold)
+
+	WithCompression(CodecZstd).apply(opt)
+	WithCompressionThreshold(16).apply(opt)
+	assert.Equal(t, CodecZstd, opt.codec)
+	assert.Equal(t, uint16(16), opt.compressThreshold)
+}
+
+func Test_WithEncryption(t *testing.T) {
+	opt := defaultOptions()
+	assert.Nil(t, opt.encryption())
+	assert.Equal(t, EncryptionAES256GCM, opt.encryptionAlgorithm)
+
+	provider := NewKeyRing(1, map[uint32][]byte{1: make([]byte, 32)})
+	WithEncryption(provider).apply(opt)
+	WithEncryptionAlgorithm(EncryptionChaCha20Poly1305).apply(opt)
+
+	enc := opt.encryption()
+	assert.NotNil(t, enc)
+	assert.Equal(t, provider, enc.provider)
+	assert.Equal(t, EncryptionChaCha20Poly1305, enc.algorithm)
+}
+
+func Test_WithIndexMode(t *testing.T) {
+	opt := defaultOptions()
+	assert.Equal(t, IndexModeMemory, opt.indexMode)
+
+	WithIndexMode(IndexModeHint).apply(opt)
+	assert.Equal(t, IndexModeHint, opt.indexMode)
+}
+
+func Test_WithKeydirShards(t *testing.T) {
+	opt := defaultOptions()
+	assert.Equal(t, 1, opt.keydirShards)
+
+	WithKeydirShards(16).apply(opt)
+	assert.Equal(t, 16, opt.keydirShards)
+}
+
+func Test_WithAsyncWrite(t *testing.T) {
+	opt := defaultOptions()
+	assert.Zero(t, opt.writeQueueSize)
+	assert.False(t, opt.syncWrites)
+
+	WithAsyncWrite(64).apply(opt)
+	WithSyncWrites().apply(opt)
+	assert.Equal(t, 64, opt.writeQueueSize)
+	assert.True(t, opt.syncWrites)
+}
+
+func Test_WithMmapReads(t *testing.T) {
+	opt := defaultOptions()
+	assert.False(t, opt.mmapReads)
+
+	WithMmapReads().apply(opt)
+	assert.True(t, opt.mmapReads)
+}
+
+func Test_WithValueCache(t *testing.T) {
+	opt := defaultOptions()
+	assert.Zero(t, opt.valueCacheBytes)
+
+	WithValueCache(1 << 20).apply(opt)
+	assert.Equal(t, int64(1<<20), opt.valueCacheBytes)
+}
@@ -0,0 +1,92 @@
+package esl
+
+import (
+	"bytes"
+	"context"
+)
+
+// keyRange is the range [start, end) of keys, end is empty if the range has no
+// upper bound.
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+// prefixRange returns the range of keys with prefix.
+func prefixRange(prefix []byte) keyRange {
+	r := keyRange{start: prefix}
+	// the end is the least key greater than all keys with prefix, the trailing
+	// 0xFF bytes could not be increased.
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			r.end = append([]byte(nil), prefix[:i+1]...)
+			r.end[i]++
+			break
+		}
+	}
+
+	return r
+}
+
+func (r keyRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.start) >= 0 && (len(r.end) == 0 || bytes.Compare(key, r.end) < 0)
+}
+
+// DeleteRange deletes the keys in [start, end), end is empty if the range has
+// no upper bound. A single range tombstone is written rather than a tombstone
+// of each key, and the keys are removed from the keydir at once. The keys of
+// buckets are not deleted.
+//
+// ErrInvalidRange is returned if both start and end are empty, deleting all
+// keys must be explicit, e.g. DeleteRange([]byte{0}, nil) deletes all keys but
+// the empty one. ErrRangeDeleteUnsupported is returned in IndexModeHint, since
+// the keys of hint files could not be removed from the keydir.
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.deleteRange(context.Background(), keyRange{start: start, end: end})
+}
+
+// DeleteRangeContext is the same as DeleteRange, but it gives up waiting if ctx
+// is done, see PutContext.
+func (db *DB) DeleteRangeContext(ctx context.Context, start, end []byte) error {
+	return db.deleteRange(ctx, keyRange{start: start, end: end})
+}
+
+// DeletePrefix deletes the keys with prefix, see DeleteRange. ErrInvalidRange
+// is returned if prefix is empty, and ErrRangeDeleteUnsupported is returned in
+// IndexModeHint.
+func (db *DB) DeletePrefix(prefix []byte) error {
+	return db.deleteRange(context.Background(), prefixRange(prefix))
+}
+
+// DeletePrefixContext is the same as DeletePrefix, but it gives up waiting if
+// ctx is done, see PutContext.
+func (db *DB) DeletePrefixContext(ctx context.Context, prefix []byte) error {
+	return db.deleteRange(ctx, prefixRange(prefix))
+}
+
+func (db *DB) deleteRange(ctx context.Context, r keyRange) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	// the keys of hint files could not be removed from memory.
+	if db.opt.indexMode == IndexModeHint {
+		return ErrRangeDeleteUnsupported
+	}
+	// the empty range without upper bound covers all keys.
+	if len(r.start) == 0 && len(r.end) == 0 {
+		return ErrInvalidRange
+	}
+	if len(r.end) > 0 && bytes.Compare(r.start, r.end) >= 0 {
+		return ErrInvalidRange
+	}
+	for _, key := range [][]byte{r.start, r.end} {
+		if len(key) > int(db.opt.maxKeyBytes) {
+			return &KeyTooLargeError{Size: len(key), Limit: int(db.opt.maxKeyBytes)}
+		}
+	}
+
+	entry := newRangeTombstone(r)
+	defer releaseEntry(entry)
+
+	return db.write(ctx, entry, PriorityNormal)
+}
@@ -0,0 +1,184 @@
+package esl
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_prefixRange(t *testing.T) {
+	cases := []struct {
+		prefix string
+		end    []byte
+	}{
+		{prefix: "user:", end: []byte("user;")},
+		{prefix: "a\xff\xff", end: []byte("b")},
+		{prefix: "\xff\xff", end: nil},
+		{prefix: "", end: nil},
+	}
+	for _, c := range cases {
+		r := prefixRange([]byte(c.prefix))
+		assert.Equal(t, []byte(c.prefix), r.start)
+		assert.Equal(t, c.end, r.end, c.prefix)
+	}
+
+	r := prefixRange([]byte("user:"))
+	assert.True(t, r.contains([]byte("user:")))
+	assert.True(t, r.contains([]byte("user:\xff")))
+	assert.False(t, r.contains([]byte("user;")))
+	assert.False(t, r.contains([]byte("use")))
+	assert.True(t, prefixRange(nil).contains([]byte("any")))
+}
+
+func Test_DB_DeleteRange(t *testing.T) {
+	modes := map[string][]Option{
+		"memory":  nil,
+		"compact": {WithIndexMode(IndexModeCompact)},
+		"shards":  {WithKeydirShards(4)},
+	}
+	for name, options := range modes {
+		fs := afero.NewMemMapFs()
+		open := func() *DB {
+			options := append([]Option{
+				WithFileSystem(fs),
+				WithMaxFileBytes(256),
+				WithCompactThreshold(1000), // avoid auto merge
+			}, options...)
+			db, err := Open("/tmp/esl", options...)
+			require.NoError(t, err)
+			return db
+		}
+		assertLive := func(db *DB, want map[string]string) {
+			assert.Equal(t, len(want), dbLen(t, db), name)
+			assert.Len(t, db.ListKeys(), len(want), name)
+			for _, prefix := range []string{"a/", "b/", "c/"} {
+				for i := 0; i < 10; i++ {
+					key := prefix + strconv.Itoa(i)
+					value, err := db.Get([]byte(key))
+					if v, ok := want[key]; ok {
+						require.NoError(t, err, name, key)
+						assert.Equal(t, v, string(value))
+						continue
+					}
+					assert.ErrorIs(t, err, ErrKeyNotFound, name, key)
+				}
+			}
+			value, err := db.Get([]byte("b/counter"))
+			if v, ok := want["b/counter"]; ok {
+				require.NoError(t, err, name)
+				assert.Equal(t, v, string(value))
+			} else {
+				assert.ErrorIs(t, err, ErrKeyNotFound, name)
+			}
+		}
+
+		db := open()
+		want := make(map[string]string, 30)
+		for _, prefix := range []string{"a/", "b/", "c/"} {
+			for i := 0; i < 10; i++ {
+				key := prefix + strconv.Itoa(i)
+				require.NoError(t, db.Put([]byte(key), []byte("value")))
+				want[key] = "value"
+			}
+		}
+		_, err := db.Increment([]byte("b/counter"), 1)
+		require.NoError(t, err)
+
+		require.NoError(t, db.DeletePrefix([]byte("b/")))
+		require.NoError(t, db.DeleteRange([]byte("a/3"), []byte("a/6")))
+		for _, key := range []string{"a/3", "a/4", "a/5", "b/0", "b/1", "b/2", "b/3", "b/4", "b/5", "b/6", "b/7", "b/8", "b/9"} {
+			delete(want, key)
+		}
+		// the keys written after the range tombstone are kept.
+		require.NoError(t, db.Put([]byte("b/1"), []byte("again")))
+		_, err = db.Increment([]byte("b/counter"), 2)
+		require.NoError(t, err)
+		want["b/1"] = "again"
+		want["b/counter"] = string(encodeCounter(2))
+		assertLive(db, want)
+
+		has, err := db.Has([]byte("b/2"))
+		require.NoError(t, err)
+		assert.False(t, has)
+		require.NoError(t, db.Close())
+
+		// the range tombstones are applied while restoring.
+		db = open()
+		assertLive(db, want)
+
+		// the range tombstones and the records they cover are dropped by merge.
+		db.activeLock.Lock()
+		require.NoError(t, db.archive())
+		db.activeLock.Unlock()
+		require.NoError(t, db.merge())
+		assertLive(db, want)
+		snap, err := takeDBPathSnap(fs, "/tmp/esl")
+		require.NoError(t, err)
+		for _, filename := range snap.dataFiles {
+			if filename == dataFilename("/tmp/esl", db.activeFileId) {
+				continue
+			}
+			kvs, _, err := readDataFile(fs, nil, filename, 0)
+			require.NoError(t, err)
+			for _, kv := range kvs {
+				assert.False(t, kv.rangeTombstone(), name)
+				assert.NotEqual(t, "b/2", string(kv.key), name)
+			}
+		}
+		require.NoError(t, db.Close())
+
+		db = open()
+		assertLive(db, want)
+		require.NoError(t, db.Close())
+	}
+}
+
+func Test_DB_DeleteRange_invalid(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.ErrorIs(t, db.DeleteRange([]byte("b"), []byte("a")), ErrInvalidRange)
+	assert.ErrorIs(t, db.DeleteRange([]byte("a"), []byte("a")), ErrInvalidRange)
+	assert.ErrorIs(t, db.DeleteRange(make([]byte, maxKeySize+1), nil), ErrKeyOrValueTooLong)
+	// deleting all keys must be explicit.
+	assert.ErrorIs(t, db.DeleteRange(nil, nil), ErrInvalidRange)
+	assert.ErrorIs(t, db.DeletePrefix(nil), ErrInvalidRange)
+
+	// the keys of buckets are not deleted.
+	bucket, err := db.Bucket("bucket")
+	require.NoError(t, err)
+	require.NoError(t, bucket.Put([]byte("key"), []byte("value")))
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	require.NoError(t, db.DeleteRange([]byte{0}, nil))
+	assert.Equal(t, 0, dbLen(t, db))
+	value, err := bucket.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	hint, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()), WithIndexMode(IndexModeHint))
+	require.NoError(t, err)
+	defer hint.Close()
+	assert.ErrorIs(t, hint.DeletePrefix([]byte("a")), ErrRangeDeleteUnsupported)
+}
+
+func Test_DB_DeleteRange_watch(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, []byte("user:"))
+	require.NoError(t, err)
+
+	require.NoError(t, db.DeletePrefix([]byte("user:")))
+	events := receiveEvents(t, ch, 1)
+	assert.Equal(t, ChangeOpDeleteRange, events[0].Op)
+	assert.Equal(t, []byte("user:"), events[0].Key)
+	assert.Equal(t, []byte("user;"), events[0].Value)
+}
@@ -2,6 +2,7 @@ package esl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"math/rand"
 	"strconv"
@@ -69,13 +70,14 @@ func (su *dbTestSuite) Test_DB_get() {
 	err := su.db.Put(key, value)
 	su.NoError(err)
 
-	v1, err1 := su.db.get(key, true)
+	v1, err1 := su.db.get(context.Background(), key, true)
 	su.NoError(err1)
 	su.Equal(value, v1.value)
 
-	v2, err2 := su.db.get(key, false)
+	v2, err2 := su.db.get(context.Background(), key, false)
 	su.NoError(err2)
-	clue := su.db.keyDir.get(key)
+	clue, err3 := su.db.keyDir.get(key)
+	su.NoError(err3)
 	su.NotNil(clue)
 	su.Equal(value, v2.value)
 	su.Equal(v2.valueSize, clue.valueSize)
@@ -257,7 +259,7 @@ func Test_DB_Sync(t *testing.T) {
 	dataFileInfo, err := dataFile.Stat()
 	require.NoError(t, err)
 	require.NotZero(t, dataFileInfo.Size())
-	assert.Equal(t, int64(kvEntry_fixedBytes)+12+5, dataFileInfo.Size())
+	assert.Equal(t, int64(formatHeaderSize+kvEntry_fixedBytes)+12+5, dataFileInfo.Size())
 }
 
 func Test_DB_Close(t *testing.T) {
@@ -281,7 +283,7 @@ func Test_DB_Close(t *testing.T) {
 	dataFileInfo, err := dataFile.Stat()
 	require.NoError(t, err)
 	require.NotZero(t, dataFileInfo.Size())
-	assert.Equal(t, int64(kvEntry_fixedBytes)+13+5, dataFileInfo.Size())
+	assert.Equal(t, int64(formatHeaderSize+kvEntry_fixedBytes)+13+5, dataFileInfo.Size())
 }
 
 func Test_DB_Merge(t *testing.T) {
@@ -294,7 +296,7 @@ func Test_DB_Merge(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	// generate about 4 files, we need more than 400B data, so we need more than 4 * (100/25) = 16 entries
+	// generate about 4 files, we need more than 400B data, so we need more than 4 * (100/37) = 11 entries
 	// create 10 entry first.
 	kvEntries := randomKVEntries(10)
 	for _, kv := range kvEntries {
@@ -324,9 +326,9 @@ func Test_DB_Merge(t *testing.T) {
 	snap, err := takeDBPathSnap(fs, "/tmp/esl/")
 	require.NoError(t, err)
 	require.NotNil(t, snap)
-	assert.Equal(t, 5, len(snap.dataFiles))
+	assert.Equal(t, 9, len(snap.dataFiles))
 	assert.Equal(t, 0, len(snap.hintFiles))
-	assert.Equal(t, uint16(5), snap.lastDataFileId)
+	assert.Equal(t, uint16(9), snap.lastDataFileId)
 
 	// trigger merge
 	err = db.Merge()
@@ -342,12 +344,12 @@ func Test_DB_Merge(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, snap)
 
-	// expected 2 data files, 1 hint file
+	// expected 2 merged data files with their hint files, and the active data file.
 	assert.Equal(t, 3, len(snap.dataFiles))
 	assert.Equal(t, 2, len(snap.hintFiles))
-	assert.ElementsMatch(t, []string{"/tmp/esl/0000000005.esld", "/tmp/esl/0000000004.esld", "/tmp/esl/0000000003.esld"}, snap.dataFiles)
-	assert.ElementsMatch(t, []string{"/tmp/esl/0000000004.hint", "/tmp/esl/0000000003.hint"}, snap.hintFiles)
-	assert.Equal(t, uint16(5), snap.lastDataFileId)
+	assert.ElementsMatch(t, []string{"/tmp/esl/0000000009.esld", "/tmp/esl/0000000008.esld", "/tmp/esl/0000000007.esld"}, snap.dataFiles)
+	assert.ElementsMatch(t, []string{"/tmp/esl/0000000008.hint", "/tmp/esl/0000000007.hint"}, snap.hintFiles)
+	assert.Equal(t, uint16(9), snap.lastDataFileId)
 	assert.EqualValues(t, 6, len(db.ListKeys()))
 }
 
@@ -408,3 +410,400 @@ func Test_DB_filesystem(t *testing.T) {
 		})
 	}
 }
+
+func Test_DB_context(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open(
+		"/tmp/esl/",
+		WithFileSystem(fs),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, db.PutContext(context.Background(), []byte("key"), []byte("value")))
+	value, err := db.GetContext(context.Background(), []byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	// a done context gives up waiting for archiving or compaction.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	db.inArchived.Store(true)
+	assert.ErrorIs(t, db.PutContext(ctx, []byte("key2"), []byte("value2")), context.DeadlineExceeded)
+	assert.ErrorIs(t, db.DeleteContext(ctx, []byte("key")), context.DeadlineExceeded)
+	db.inArchived.Store(false)
+
+	db.inCompaction.Store(true)
+	_, err = db.GetContext(ctx, []byte("key"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	db.inCompaction.Store(false)
+
+	// the cancelled writes leave nothing in the data file.
+	require.NoError(t, db.Close())
+	db, err = Open("/tmp/esl/", WithFileSystem(fs), WithCompactThreshold(1000))
+	require.NoError(t, err)
+	value, err = db.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	_, err = db.Get([]byte("key2"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, db.Close())
+}
+
+func Test_DB_validate(t *testing.T) {
+	db, err := Open("/tmp/esl/", WithFileSystem(afero.NewMemMapFs()), WithMaxKeyBytes(8), WithMaxValueBytes(16))
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.ErrorIs(t, db.Put(nil, []byte("value")), ErrEmptyKey)
+	assert.ErrorIs(t, db.Put([]byte{}, []byte("value")), ErrEmptyKey)
+	_, err = db.PutIfAbsent(nil, []byte("value"))
+	assert.ErrorIs(t, err, ErrEmptyKey)
+
+	err = db.Put(make([]byte, 9), []byte("value"))
+	var keyErr *KeyTooLargeError
+	require.ErrorAs(t, err, &keyErr)
+	assert.Equal(t, KeyTooLargeError{Size: 9, Limit: 8}, *keyErr)
+	assert.ErrorIs(t, err, ErrKeyOrValueTooLong)
+
+	_, err = db.CompareAndSwap([]byte("key"), nil, make([]byte, 17))
+	var valueErr *ValueTooLargeError
+	require.ErrorAs(t, err, &valueErr)
+	assert.Equal(t, ValueTooLargeError{Size: 17, Limit: 16}, *valueErr)
+	assert.ErrorIs(t, err, ErrKeyOrValueTooLong)
+}
+
+func Test_DB_emptyKeyOnDisk(t *testing.T) {
+	for _, mode := range []IndexMode{IndexModeMemory, IndexModeCompact, IndexModeHint} {
+		fs := afero.NewMemMapFs()
+		open := func() *DB {
+			db, err := Open("/tmp/esl/",
+				WithFileSystem(fs),
+				WithMaxFileBytes(100),
+				WithCompactThreshold(1000), // avoid auto merge
+				WithIndexMode(mode),
+			)
+			require.NoError(t, err)
+			return db
+		}
+
+		// the empty key may be written by former versions.
+		db := open()
+		entry := newEntry([]byte{}, []byte("empty"))
+		require.NoError(t, db.write(context.Background(), entry, PriorityNormal))
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("value")))
+		}
+		require.NoError(t, db.Close())
+
+		db = open()
+		value, err := db.Get([]byte{})
+		require.NoError(t, err, mode)
+		assert.Equal(t, []byte("empty"), value)
+
+		require.NoError(t, db.merge())
+		value, err = db.Get([]byte{})
+		require.NoError(t, err, mode)
+		assert.Equal(t, []byte("empty"), value)
+
+		// the empty key could still be deleted.
+		require.NoError(t, db.Delete([]byte{}))
+		_, err = db.Get([]byte{})
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		require.NoError(t, db.Close())
+
+		db = open()
+		_, err = db.Get([]byte{})
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		require.NoError(t, db.Close())
+	}
+}
+
+func Test_DB_emptyValue(t *testing.T) {
+	for _, mode := range []IndexMode{IndexModeMemory, IndexModeCompact, IndexModeHint} {
+		fs := afero.NewMemMapFs()
+		open := func() *DB {
+			db, err := Open("/tmp/esl/",
+				WithFileSystem(fs),
+				WithMaxFileBytes(100),
+				WithCompactThreshold(1000), // avoid auto merge
+				WithIndexMode(mode),
+			)
+			require.NoError(t, err)
+			return db
+		}
+
+		db := open()
+		key := []byte("empty")
+		require.NoError(t, db.Put(key, []byte{}))
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("value")))
+		}
+		require.NoError(t, db.Delete([]byte("0")))
+
+		// the empty value is a value rather than a tombstone.
+		value, err := db.Get(key)
+		require.NoError(t, err, mode)
+		assert.Empty(t, value)
+		assert.Contains(t, db.ListKeys(), Key(key))
+		put, err := db.PutIfAbsent(key, []byte("value"))
+		require.NoError(t, err)
+		assert.False(t, put)
+
+		require.NoError(t, db.merge())
+		value, err = db.Get(key)
+		require.NoError(t, err, mode)
+		assert.Empty(t, value)
+		_, err = db.Get([]byte("0"))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		require.NoError(t, db.Close())
+
+		db = open()
+		value, err = db.Get(key)
+		require.NoError(t, err, mode)
+		assert.Empty(t, value)
+		_, err = db.Get([]byte("0"))
+		assert.ErrorIs(t, err, ErrKeyNotFound, mode)
+		assert.Len(t, db.ListKeys(), 10)
+		require.NoError(t, db.Close())
+	}
+}
+
+func Test_DB_Delete(t *testing.T) {
+	for _, mode := range []IndexMode{IndexModeMemory, IndexModeCompact, IndexModeHint} {
+		fs := afero.NewMemMapFs()
+		open := func() *DB {
+			db, err := Open("/tmp/esl/",
+				WithFileSystem(fs),
+				WithMaxFileBytes(256),
+				WithCompactThreshold(1000), // avoid auto merge
+				WithIndexMode(mode),
+			)
+			require.NoError(t, err)
+			return db
+		}
+
+		db := open()
+		for i := 0; i < 20; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("value")))
+		}
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Delete([]byte(strconv.Itoa(i))))
+		}
+		if mode != IndexModeHint {
+			// the deleted keys are removed from the keydir.
+			assert.Equal(t, 10, db.keyDir.len(), mode)
+		}
+		assert.Len(t, db.ListKeys(), 10)
+		seq := db.seq
+		require.NoError(t, db.Close())
+
+		// delete then reopen.
+		db = open()
+		for i := 0; i < 20; i++ {
+			_, err := db.Get([]byte(strconv.Itoa(i)))
+			if i < 10 {
+				assert.ErrorIs(t, err, ErrKeyNotFound, mode)
+			} else {
+				assert.NoError(t, err, mode)
+			}
+		}
+		if mode != IndexModeHint {
+			assert.Equal(t, 10, db.keyDir.len(), mode)
+		}
+		// the sequence numbers of tombstones are not reused.
+		assert.Equal(t, seq, db.seq, mode)
+
+		// delete then merge, the key written again after deleted is kept.
+		require.NoError(t, db.Put([]byte("0"), []byte("again")))
+		require.NoError(t, db.Delete([]byte("10")))
+		require.NoError(t, db.merge())
+		value, err := db.Get([]byte("0"))
+		require.NoError(t, err, mode)
+		assert.Equal(t, []byte("again"), value)
+		_, err = db.Get([]byte("10"))
+		assert.ErrorIs(t, err, ErrKeyNotFound, mode)
+		assert.Len(t, db.ListKeys(), 10)
+		require.NoError(t, db.Close())
+
+		db = open()
+		value, err = db.Get([]byte("0"))
+		require.NoError(t, err, mode)
+		assert.Equal(t, []byte("again"), value)
+		_, err = db.Get([]byte("10"))
+		assert.ErrorIs(t, err, ErrKeyNotFound, mode)
+		assert.Len(t, db.ListKeys(), 10)
+		require.NoError(t, db.Close())
+	}
+}
+
+func dbLen(t *testing.T, db *DB) int {
+	n, err := db.Len()
+	require.NoError(t, err)
+
+	return n
+}
+
+func Test_DB_LenHas(t *testing.T) {
+	modes := map[string][]Option{
+		"memory":  nil,
+		"compact": {WithIndexMode(IndexModeCompact)},
+		"hint":    {WithIndexMode(IndexModeHint)},
+		"shards":  {WithKeydirShards(4)},
+	}
+	for name, options := range modes {
+		fs := afero.NewMemMapFs()
+		open := func() *DB {
+			options := append([]Option{
+				WithFileSystem(fs),
+				WithMaxFileBytes(256),
+				WithCompactThreshold(1000), // avoid auto merge
+			}, options...)
+			db, err := Open("/tmp/esl/", options...)
+			require.NoError(t, err)
+			return db
+		}
+		assertLen := func(db *DB, want int) {
+			n, err := db.Len()
+			if name == "hint" {
+				assert.ErrorIs(t, err, ErrLenUnsupported)
+				return
+			}
+			require.NoError(t, err, name)
+			assert.Equal(t, want, n, name)
+		}
+
+		db := open()
+		assertLen(db, 0)
+		for i := 0; i < 20; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("value")))
+		}
+		// overwrite and delete.
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("again")))
+		}
+		for i := 0; i < 5; i++ {
+			require.NoError(t, db.Delete([]byte(strconv.Itoa(i))))
+		}
+		require.NoError(t, db.Delete([]byte("absent")))
+		assertLen(db, 15)
+
+		has, err := db.Has([]byte("0"))
+		require.NoError(t, err)
+		assert.False(t, has, name)
+		has, err = db.Has([]byte("5"))
+		require.NoError(t, err)
+		assert.True(t, has, name)
+		require.NoError(t, db.Close())
+
+		db = open()
+		assertLen(db, 15)
+		require.NoError(t, db.merge())
+		assertLen(db, 15)
+		has, err = db.Has([]byte("19"))
+		require.NoError(t, err)
+		assert.True(t, has, name)
+
+		// the keys of immutable data files are overwritten, deleted and put again.
+		require.NoError(t, db.Put([]byte("5"), []byte("again")))
+		require.NoError(t, db.Delete([]byte("6")))
+		require.NoError(t, db.Put([]byte("0"), []byte("again")))
+		assertLen(db, 15)
+		require.NoError(t, db.Close())
+
+		db = open()
+		assertLen(db, 15)
+		require.NoError(t, db.Close())
+	}
+}
+
+func Test_DB_GetWithMeta(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func() *DB {
+		db, err := Open(
+			"/tmp/esl/",
+			WithFileSystem(fs),
+			WithMaxFileBytes(100),
+			WithCompactThreshold(1000), // avoid auto merge
+		)
+		require.NoError(t, err)
+		return db
+	}
+
+	db := open()
+	require.NoError(t, db.Put([]byte("key"), []byte("value-1")))
+	require.NoError(t, db.Put([]byte("other"), []byte("value")))
+	require.NoError(t, db.Put([]byte("key"), []byte("value-2")))
+
+	value, meta, err := db.GetWithMeta([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value-2"), value)
+	assert.Equal(t, uint64(3), meta.Seq)
+	assert.Equal(t, uint32(kvEntry_fixedBytes+len("key")+len("value-2")), meta.Size)
+	assert.WithinDuration(t, time.Now(), meta.Timestamp, 2*time.Second)
+
+	_, _, err = db.GetWithMeta([]byte("absent"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, db.Delete([]byte("other")))
+	_, _, err = db.GetWithMeta([]byte("other"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// the sequence numbers are kept by the merge process, and continue after reopening.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("value")))
+	}
+	require.NoError(t, db.merge())
+	_, meta2, err := db.GetWithMeta([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, meta.Seq, meta2.Seq)
+	require.NoError(t, db.Close())
+
+	db = open()
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("key"), []byte("value-3")))
+	_, meta, err = db.GetWithMeta([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(15), meta.Seq)
+}
+
+func Test_DB_ForEachContext(t *testing.T) {
+	db, err := Open(
+		"/tmp/esl/",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i))))
+	}
+	require.NoError(t, db.Delete([]byte("key-0")))
+
+	visited := make(map[string]string, 10)
+	err = db.ForEach(func(key, value []byte) bool {
+		visited[string(key)] = string(value)
+		return true
+	})
+	require.NoError(t, err)
+	assert.Len(t, visited, 9)
+	assert.Equal(t, "value-1", visited["key-1"])
+
+	keys, err := db.ListKeysContext(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, keys, 9)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err = db.ForEachContext(ctx, func(key, value []byte) bool {
+		count++
+		cancel()
+		return true
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, count)
+
+	_, err = db.ListKeysContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,313 @@
+package esl
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EncryptionAlgorithm is the AEAD algorithm to encrypt records.
+type EncryptionAlgorithm uint8
+
+const (
+	// EncryptionAES256GCM encrypts records by AES-GCM, the key must be 16, 24
+	// or 32 bytes.
+	EncryptionAES256GCM EncryptionAlgorithm = iota + 1
+	// EncryptionChaCha20Poly1305 encrypts records by ChaCha20-Poly1305, the key
+	// must be 32 bytes. It's faster than AES-GCM on the CPU without AES instructions.
+	EncryptionChaCha20Poly1305
+)
+
+// KeyProvider provides the keys to encrypt and decrypt files. Each file records
+// the id of key which encrypts it, so that the keys could be rotated: new files
+// are encrypted by the current key, and the old files are still decrypted by
+// their own keys until they are rewritten by merge process.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new files.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key by id to decrypt existing files.
+	Key(id uint32) ([]byte, error)
+}
+
+type keyRing struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewKeyRing creates a KeyProvider holding the keys in memory, keys[current]
+// is used to encrypt new files.
+func NewKeyRing(current uint32, keys map[uint32][]byte) KeyProvider {
+	return &keyRing{current: current, keys: keys}
+}
+
+func (r *keyRing) CurrentKey() (uint32, []byte, error) {
+	key, err := r.Key(r.current)
+	return r.current, key, err
+}
+
+func (r *keyRing) Key(id uint32) ([]byte, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrEncryptionKeyNotFound, "key id %d", id)
+	}
+
+	return key, nil
+}
+
+// Encrypted data files and hint files have an encryption header right after
+// the format header:
+//
+// | magic(6) | version(1) | algorithm(1) | key_id(4) | nonce(12) |
+//
+// The key and value of each record are sealed separately, the nonce of them is
+// derived from the file nonce and the offset of record, so that the value could
+// be read and opened alone. The timestamp, sequence number and flags of record
+// are authenticated as the additional data, see recordAAD. Tombstones are kept
+// empty.
+const (
+	fileHeaderMagic   = "ESLENC"
+	fileHeaderVersion = 1
+	fileHeaderSize    = 24
+
+	sealPartKey   byte = 0
+	sealPartValue byte = 1
+)
+
+// encryption creates and loads the cipher of files.
+type encryption struct {
+	provider  KeyProvider
+	algorithm EncryptionAlgorithm
+}
+
+func newAEAD(algorithm EncryptionAlgorithm, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case EncryptionAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case EncryptionChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+
+	return nil, errors.Errorf("unknown encryption algorithm: %d", algorithm)
+}
+
+// newFileCipher creates a cipher with the current key and a random nonce.
+func (enc *encryption) newFileCipher() (*fileCipher, error) {
+	keyId, key, err := enc.provider.CurrentKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "get current key")
+	}
+
+	aead, err := newAEAD(enc.algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileCipher{algorithm: enc.algorithm, keyId: keyId, aead: aead}
+	if _, err = io.ReadFull(rand.Reader, c.nonce[:]); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+
+	return c, nil
+}
+
+// loadFileCipher loads the cipher from the file header.
+func (enc *encryption) loadFileCipher(header []byte) (*fileCipher, error) {
+	if header[6] != fileHeaderVersion {
+		return nil, errors.Errorf("unknown encryption header version: %d", header[6])
+	}
+
+	c := &fileCipher{
+		algorithm: EncryptionAlgorithm(header[7]),
+		keyId:     binary.BigEndian.Uint32(header[8:]),
+	}
+	copy(c.nonce[:], header[12:])
+
+	key, err := enc.provider.Key(c.keyId)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead, err = newAEAD(c.algorithm, key); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readFileHeader validates the format header of the file and reads the
+// encryption header, the cipher is nil if the file is not encrypted.
+func readFileHeader(fd io.ReaderAt, enc *encryption) (*fileCipher, error) {
+	if _, err := readFormatHeader(fd); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, fileHeaderSize)
+	n, err := fd.ReadAt(header, formatHeaderSize)
+	if n != fileHeaderSize {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		// the file is too small to have a header.
+		return nil, nil
+	}
+	if string(header[:len(fileHeaderMagic)]) != fileHeaderMagic {
+		return nil, nil
+	}
+
+	if enc == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+
+	return enc.loadFileCipher(header)
+}
+
+// writeFileHeader writes the format header with generation into the empty file,
+// and the encryption header if the encryption is enabled, the cipher is nil if
+// it's disabled.
+func writeFileHeader(w io.Writer, enc *encryption, generation uint64) (*fileCipher, error) {
+	if _, err := w.Write(formatHeader(generation)); err != nil {
+		return nil, errors.Wrap(err, "write format header")
+	}
+	if enc == nil {
+		return nil, nil
+	}
+
+	c, err := enc.newFileCipher()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(c.header()); err != nil {
+		return nil, errors.Wrap(err, "write encryption header")
+	}
+
+	return c, nil
+}
+
+// fileCipher seals and opens records of a file. A nil fileCipher means the file
+// is not encrypted, so all methods are nil-safe.
+type fileCipher struct {
+	algorithm EncryptionAlgorithm
+	keyId     uint32
+	nonce     [12]byte
+	aead      cipher.AEAD
+}
+
+func (c *fileCipher) header() []byte {
+	header := make([]byte, fileHeaderSize)
+	copy(header, fileHeaderMagic)
+	header[6] = fileHeaderVersion
+	header[7] = byte(c.algorithm)
+	binary.BigEndian.PutUint32(header[8:], c.keyId)
+	copy(header[12:], c.nonce[:])
+
+	return header
+}
+
+// headerSize returns the offset of the first record in file.
+func (c *fileCipher) headerSize() uint32 {
+	if c == nil {
+		return formatHeaderSize
+	}
+
+	return formatHeaderSize + fileHeaderSize
+}
+
+// nonceAt derives the nonce of the part of record at off.
+func (c *fileCipher) nonceAt(off uint32, part byte) []byte {
+	nonce := c.nonce
+	var suffix [5]byte
+	binary.BigEndian.PutUint32(suffix[:], off)
+	suffix[4] = part
+	for i := range suffix {
+		nonce[len(nonce)-len(suffix)+i] ^= suffix[i]
+	}
+
+	return nonce[:c.aead.NonceSize()]
+}
+
+// recordAAD returns the additional data of the record with the header fields,
+// so that the header is authenticated along with the sealed key and value. The
+// sizes are not included, since they are authenticated by the sealed data.
+func recordAAD(tstamp, seq uint64, flags uint8) []byte {
+	aad := make([]byte, 17)
+	binary.BigEndian.PutUint64(aad, tstamp)
+	binary.BigEndian.PutUint64(aad[8:], seq)
+	aad[16] = flags
+
+	return aad
+}
+
+func (c *fileCipher) seal(data []byte, off uint32, part byte, aad []byte) ([]byte, error) {
+	if c == nil || len(data) == 0 {
+		return data, nil
+	}
+	if limit := 0xFFFF - c.aead.Overhead(); len(data) > limit {
+		if part == sealPartKey {
+			return nil, &KeyTooLargeError{Size: len(data), Limit: limit}
+		}
+		return nil, &ValueTooLargeError{Size: len(data), Limit: limit}
+	}
+
+	return c.aead.Seal(nil, c.nonceAt(off, part), data, aad), nil
+}
+
+func (c *fileCipher) open(data []byte, off uint32, part byte, aad []byte) ([]byte, error) {
+	if c == nil || len(data) == 0 {
+		return data, nil
+	}
+
+	plain, err := c.aead.Open(nil, c.nonceAt(off, part), data, aad)
+	if err != nil {
+		return nil, errors.Wrap(ErrDecryptionFailed, err.Error())
+	}
+
+	return plain, nil
+}
+
+// sealEntry returns the encrypted entry to be written at off.
+func (c *fileCipher) sealEntry(e *kvEntry, off uint32) (*kvEntry, error) {
+	if c == nil {
+		return e, nil
+	}
+
+	sealed := *e
+	aad := recordAAD(e.tsTimestamp, e.seq, e.flags)
+	var err error
+	if sealed.key, err = c.seal(e.key, off, sealPartKey, aad); err != nil {
+		return nil, err
+	}
+	if sealed.value, err = c.seal(e.value, off, sealPartValue, aad); err != nil {
+		return nil, err
+	}
+	sealed.keySize = uint16(len(sealed.key))
+	sealed.valueSize = uint16(len(sealed.value))
+
+	return &sealed, nil
+}
+
+// openEntry decrypts the entry read at off in place.
+func (c *fileCipher) openEntry(e *kvEntry, off uint32) (err error) {
+	if c == nil {
+		return nil
+	}
+
+	aad := recordAAD(e.tsTimestamp, e.seq, e.flags)
+	if e.key, err = c.open(e.key, off, sealPartKey, aad); err != nil {
+		return err
+	}
+	if e.value, err = c.open(e.value, off, sealPartValue, aad); err != nil {
+		return err
+	}
+	e.keySize = uint16(len(e.key))
+	e.valueSize = uint16(len(e.value))
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package esl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyRing(current uint32) KeyProvider {
+	return NewKeyRing(current, map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+		2: bytes.Repeat([]byte{2}, 32),
+	})
+}
+
+func Test_fileCipher(t *testing.T) {
+	for _, algorithm := range []EncryptionAlgorithm{EncryptionAES256GCM, EncryptionChaCha20Poly1305} {
+		enc := &encryption{provider: testKeyRing(1), algorithm: algorithm}
+		c, err := enc.newFileCipher()
+		require.NoError(t, err)
+
+		// the cipher could be loaded from header.
+		loaded, err := enc.loadFileCipher(c.header())
+		require.NoError(t, err)
+		assert.Equal(t, c.nonce, loaded.nonce)
+		assert.Equal(t, uint32(1), loaded.keyId)
+
+		entry := &kvEntry{key: []byte("key"), value: []byte("value"), keySize: 3, valueSize: 5}
+		sealed, err := c.sealEntry(entry, 100)
+		require.NoError(t, err)
+		assert.NotEqual(t, entry.value, sealed.value)
+		assert.Equal(t, uint16(5+c.aead.Overhead()), sealed.valueSize)
+
+		// the value could be opened alone.
+		value, err := loaded.open(sealed.value, 100, sealPartValue, recordAAD(0, 0, 0))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("value"), value)
+
+		// the record could not be moved to another offset.
+		_, err = loaded.open(sealed.value, 200, sealPartValue, recordAAD(0, 0, 0))
+		assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+		// the header of record is authenticated.
+		_, err = loaded.open(sealed.value, 100, sealPartValue, recordAAD(0, 0, entryFlag_tombstone))
+		assert.ErrorIs(t, err, ErrDecryptionFailed)
+		_, err = loaded.open(sealed.value, 100, sealPartValue, recordAAD(0, 1, 0))
+		assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+		require.NoError(t, loaded.openEntry(sealed, 100))
+		assert.Equal(t, []byte("key"), sealed.key)
+		assert.Equal(t, uint16(3), sealed.keySize)
+
+		// tombstone is kept empty.
+		tombstone, err := c.sealEntry(newTombstone([]byte("key")), 100)
+		require.NoError(t, err)
+		assert.True(t, tombstone.tombstone())
+
+		// the sealed value must fit in the record.
+		_, err = c.sealEntry(newEntry([]byte("key"), make([]byte, 0xFFFF)), 100)
+		var valueErr *ValueTooLargeError
+		require.ErrorAs(t, err, &valueErr)
+		assert.Equal(t, 0xFFFF-c.aead.Overhead(), valueErr.Limit)
+		assert.ErrorIs(t, err, ErrKeyOrValueTooLong)
+	}
+}
+
+func Test_readFileHeader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	enc := &encryption{provider: testKeyRing(1), algorithm: EncryptionAES256GCM}
+
+	plain, err := fs.Create("/tmp/plain")
+	require.NoError(t, err)
+	defer plain.Close()
+	c, err := readFileHeader(plain, enc)
+	require.NoError(t, err)
+	assert.Nil(t, c)
+
+	encrypted, err := fs.Create("/tmp/encrypted")
+	require.NoError(t, err)
+	defer encrypted.Close()
+	_, err = writeFileHeader(encrypted, enc, 0)
+	require.NoError(t, err)
+
+	c, err = readFileHeader(encrypted, enc)
+	require.NoError(t, err)
+	assert.NotNil(t, c)
+
+	_, err = readFileHeader(encrypted, nil)
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired)
+
+	enc.provider = NewKeyRing(3, nil)
+	_, err = readFileHeader(encrypted, enc)
+	assert.ErrorIs(t, err, ErrEncryptionKeyNotFound)
+}
+
+// assertNoPlaintext asserts no data file or hint file contains s.
+func assertNoPlaintext(t *testing.T, fs afero.Fs, path string, s string) {
+	snap, err := takeDBPathSnap(fs, path)
+	require.NoError(t, err)
+
+	for _, filename := range append(snap.dataFiles, snap.hintFiles...) {
+		data, err := afero.ReadFile(fs, filename)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), s, filename)
+	}
+}
+
+func Test_DB_encryption(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func(options ...Option) (*DB, error) {
+		options = append(options,
+			WithFileSystem(fs),
+			WithMaxFileBytes(256),
+			WithCompactThreshold(1000), // avoid auto merge
+		)
+		return Open("/tmp/esl", options...)
+	}
+
+	db, err := open(WithEncryption(testKeyRing(1)), WithCompression(CodecSnappy))
+	require.NoError(t, err)
+	putKeys(t, db, 0, 20)
+	require.NoError(t, db.Put([]byte("large"), compressibleValue(1)))
+	require.NoError(t, db.Delete([]byte("key-0")))
+	assertKeys(t, db, 1, 20)
+	assertNoPlaintext(t, fs, "/tmp/esl", "key-1")
+	assertNoPlaintext(t, fs, "/tmp/esl", "value-1")
+
+	// watch replays from the beginning of encrypted files.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.WatchFrom(ctx, nil, Position{FileId: initDataFileId})
+	require.NoError(t, err)
+	select {
+	case ev := <-ch:
+		assert.Equal(t, "key-0", string(ev.Key))
+		assert.Equal(t, "value-0", string(ev.Value))
+		assert.Equal(t, uint32(formatHeaderSize+fileHeaderSize), ev.Position.Offset)
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event received")
+	}
+	require.NoError(t, db.Close())
+
+	// the encrypted files could not be opened without keys.
+	_, err = open()
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired)
+
+	// rotate the key, merge re-encrypts the immutable files by the new key.
+	db, err = open(WithEncryption(testKeyRing(2)), WithEncryptionAlgorithm(EncryptionChaCha20Poly1305))
+	require.NoError(t, err)
+	putKeys(t, db, 20, 30)
+	require.NoError(t, db.merge())
+	assertKeys(t, db, 1, 30)
+	assertNoPlaintext(t, fs, "/tmp/esl", "key-1")
+
+	snap, err := takeDBPathSnap(fs, "/tmp/esl")
+	require.NoError(t, err)
+	require.NotEmpty(t, snap.hintFiles)
+	for _, filename := range append(snap.dataFiles, snap.hintFiles...) {
+		fileId, err := fileIdFromFilename(filename)
+		require.NoError(t, err)
+		if fileId == db.activeFileId {
+			continue
+		}
+
+		fd, err := fs.Open(filename)
+		require.NoError(t, err)
+		c, err := readFileHeader(fd, db.opt.encryption())
+		_ = fd.Close()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(2), c.keyId, filename)
+		assert.Equal(t, EncryptionChaCha20Poly1305, c.algorithm, filename)
+	}
+	require.NoError(t, db.Close())
+
+	// reopen from hint files.
+	db, err = open(WithEncryption(testKeyRing(2)))
+	require.NoError(t, err)
+	defer db.Close()
+	assertKeys(t, db, 1, 30)
+	value, err := db.Get([]byte("large"))
+	require.NoError(t, err)
+	assert.Equal(t, compressibleValue(1), value)
+	_, err = db.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func Test_DB_encryption_tamperedHeader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func() (*DB, error) {
+		return Open("/tmp/esl", WithFileSystem(fs), WithEncryption(testKeyRing(1)))
+	}
+
+	db, err := open()
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	filename := dataFilename("/tmp/esl", db.activeFileId)
+	require.NoError(t, db.Close())
+
+	// mark the record as tombstone, and fix the checksum as an attacker could.
+	data, err := afero.ReadFile(fs, filename)
+	require.NoError(t, err)
+	record := data[formatHeaderSize+fileHeaderSize:]
+	record[kvEntry_flagsOff] |= entryFlag_tombstone
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	require.NoError(t, afero.WriteFile(fs, filename, data, 0644))
+
+	_, err = open()
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+}
+
+func Test_Replication_encryption(t *testing.T) {
+	primary, err := Open(
+		"/tmp/esl-primary",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(256),
+		WithEncryption(testKeyRing(1)),
+	)
+	require.NoError(t, err)
+	defer primary.Close()
+
+	ln := startPrimary(t, primary)
+	defer ln.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, primary.Put([]byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i))))
+	}
+
+	replica, err := OpenReplica("/tmp/esl-replica", ln.Addr().String(),
+		WithFileSystem(afero.NewMemMapFs()), WithEncryption(testKeyRing(2)))
+	require.NoError(t, err)
+	defer replica.Close()
+
+	waitReplicaHead(t, primary, replica)
+	assertKeys(t, replica, 0, 20)
+}
@@ -1,15 +1,73 @@
 package esl
 
 import (
+	"fmt"
+
 	"github.com/pkg/errors"
 )
 
 var (
 	ErrKeyOrValueTooLong  = errors.New("key or value is oversize")
+	ErrEmptyKey           = errors.New("key is empty")
 	ErrKeyNotFound        = errors.New("key not found")
 	ErrInvalidEntryHeader = errors.New("invalid entry header")
 	ErrEntryCorrupted     = errors.New("entry corrupted")
 
 	ErrInvalidKeydirData     = errors.New("invalid keydir data")
 	ErrInvalidKeydirFileData = errors.New("invalid keydir file data")
+
+	ErrUnknownCodec = errors.New("unknown codec")
+
+	ErrIncompatibleFormat = errors.New("file is written in an incompatible format")
+
+	ErrEncryptionKeyRequired = errors.New("file is encrypted, key provider is required")
+	ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+	ErrDecryptionFailed      = errors.New("decryption failed")
+
+	ErrReadOnly                = errors.New("db is read-only")
+	ErrClosed                  = errors.New("db is closed")
+	ErrReplicationPositionLost = errors.New("replication position lost")
+	ErrPositionLost            = errors.New("position lost, the data file has been rewritten by merge")
+	ErrLenUnsupported          = errors.New("counting keys is not supported by the index mode")
+
+	ErrBucketNotFound     = errors.New("bucket not found")
+	ErrInvalidBucketName  = errors.New("invalid bucket name")
+	ErrTooManyBuckets     = errors.New("too many buckets")
+	ErrBucketsUnsupported = errors.New("buckets are not supported by the index mode")
+
+	ErrMergeOperatorNotFound = errors.New("merge operator not found")
+	ErrOperandsUnsupported   = errors.New("operands are not supported by the index mode")
+
+	ErrInvalidRange           = errors.New("invalid key range")
+	ErrRangeDeleteUnsupported = errors.New("range deletes are not supported by the index mode")
 )
+
+// KeyTooLargeError is returned if the key is larger than the limit, see
+// WithMaxKeyBytes. It matches ErrKeyOrValueTooLong by errors.Is.
+type KeyTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *KeyTooLargeError) Error() string {
+	return fmt.Sprintf("key size %d exceeds the limit %d", e.Size, e.Limit)
+}
+
+func (e *KeyTooLargeError) Is(target error) bool {
+	return target == ErrKeyOrValueTooLong
+}
+
+// ValueTooLargeError is returned if the value is larger than the limit, see
+// WithMaxValueBytes. It matches ErrKeyOrValueTooLong by errors.Is.
+type ValueTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value size %d exceeds the limit %d", e.Size, e.Limit)
+}
+
+func (e *ValueTooLargeError) Is(target error) bool {
+	return target == ErrKeyOrValueTooLong
+}
@@ -0,0 +1,90 @@
+package esl
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Data files and hint files start with a format header, the encryption header
+// follows it if the file is encrypted:
+//
+// | magic(4) | version(1) | reserved(3) | generation(8) |
+//
+// The version is bumped whenever the layout of records or hint entries changes,
+// files written by another version are refused with ErrIncompatibleFormat rather
+// than being read as corrupted. Version 1 is the layout without format header,
+// which has a 4 bytes timestamp in seconds and no sequence number, it could be
+// converted by Migrate.
+//
+// The generation increases with each merge process, and the merged files are
+// written with the new generation, so that a file rewritten by merge could be
+// told from the file it replaces even if they have the same id.
+const (
+	formatMagic      = "ESLF"
+	formatVersion    = 2
+	formatHeaderSize = 16
+)
+
+func formatHeader(generation uint64) []byte {
+	header := make([]byte, formatHeaderSize)
+	copy(header, formatMagic)
+	header[4] = formatVersion
+	binary.BigEndian.PutUint64(header[8:], generation)
+
+	return header
+}
+
+// readFormatHeader validates the format header of the file and returns its
+// generation, an empty file is valid and has no generation.
+func readFormatHeader(r io.ReaderAt) (uint64, error) {
+	header := make([]byte, formatHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	eof := err == io.EOF || err == io.ErrUnexpectedEOF
+	if n == 0 && (err == nil || eof) {
+		return 0, nil
+	}
+	if n != formatHeaderSize {
+		if err != nil && !eof {
+			return 0, err
+		}
+		return 0, errors.Wrap(ErrIncompatibleFormat, "format header is truncated")
+	}
+	if string(header[:len(formatMagic)]) != formatMagic {
+		return 0, errors.Wrap(ErrIncompatibleFormat, "format header is missing, see Migrate")
+	}
+	if header[4] != formatVersion {
+		return 0, errors.Wrapf(ErrIncompatibleFormat, "format version is %d, but %d is supported",
+			header[4], formatVersion)
+	}
+
+	return binary.BigEndian.Uint64(header[8:]), nil
+}
+
+// readFileGeneration returns the generation of the data file or hint file.
+func readFileGeneration(fs FileSystem, filename string) (uint64, error) {
+	fd, err := fs.OpenFile(filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = fd.Close() }()
+
+	return readFormatHeader(fd)
+}
+
+// lastGeneration validates the format of data files, and returns the greatest
+// generation of them.
+func lastGeneration(fs FileSystem, snap *dbPathSnap) (uint64, error) {
+	var generation uint64
+	for _, filename := range snap.dataFiles {
+		g, err := readFileGeneration(fs, filename)
+		if err != nil {
+			return 0, errors.Wrap(err, filename)
+		}
+		generation = max(generation, g)
+	}
+
+	return generation, nil
+}
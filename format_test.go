@@ -0,0 +1,83 @@
+package esl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readFormatHeader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	empty, err := fs.Create("/tmp/empty")
+	require.NoError(t, err)
+	defer empty.Close()
+	generation, err := readFormatHeader(empty)
+	require.NoError(t, err)
+	assert.Zero(t, generation)
+
+	require.NoError(t, afero.WriteFile(fs, "/tmp/file", formatHeader(7), 0644))
+	generation, err = readFileGeneration(fs, "/tmp/file")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), generation)
+
+	header := formatHeader(7)
+	header[4] = formatVersion + 1
+	require.NoError(t, afero.WriteFile(fs, "/tmp/newer", header, 0644))
+	_, err = readFileGeneration(fs, "/tmp/newer")
+	assert.ErrorIs(t, err, ErrIncompatibleFormat)
+
+	require.NoError(t, afero.WriteFile(fs, "/tmp/truncated", header[:8], 0644))
+	_, err = readFileGeneration(fs, "/tmp/truncated")
+	assert.ErrorIs(t, err, ErrIncompatibleFormat)
+}
+
+func Test_Open_incompatibleFormat(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	// the data file written by the former version starts with a record.
+	entry := newEntry([]byte("key"), []byte("value"))
+	require.NoError(t, afero.WriteFile(fs, dataFilename("/tmp/esl", initDataFileId), entry.encode(nil), 0644))
+
+	_, err := Open("/tmp/esl", WithFileSystem(fs))
+	assert.ErrorIs(t, err, ErrIncompatibleFormat)
+}
+
+func Test_DB_generation(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func() *DB {
+		db, err := Open("/tmp/esl", WithFileSystem(fs), WithMaxFileBytes(128), WithCompactThreshold(1000))
+		require.NoError(t, err)
+		return db
+	}
+
+	db := open()
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"key-1", "key-2", "key-3"} {
+			require.NoError(t, db.Put([]byte(key), []byte("value")))
+		}
+	}
+	require.Greater(t, db.activeFileId, uint16(2))
+	assert.Zero(t, db.generation)
+
+	// the merged files are stamped with a new generation, but the active data
+	// file keeps its own.
+	require.NoError(t, db.MergeContext(context.Background()))
+	assert.Equal(t, uint64(1), db.generation)
+	assert.Zero(t, db.activeGeneration)
+	generation, err := readFileGeneration(fs, dataFilename("/tmp/esl", db.activeFileId-1))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), generation)
+	generation, err = readFileGeneration(fs, hintFilename("/tmp/esl", db.activeFileId-1))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), generation)
+	require.NoError(t, db.Close())
+
+	db = open()
+	defer db.Close()
+	assert.Equal(t, uint64(1), db.generation)
+	assert.Zero(t, db.activeGeneration)
+}
@@ -10,3 +10,10 @@ import (
 //
 // It's useful for testing, since it can be replaced by a mock file system.
 type FileSystem = afero.Fs
+
+// isOsFs reports whether fs is the os file system, the os files support
+// concurrent ReadAt (pread) on the same handle, but afero.MemMapFs does not.
+func isOsFs(fs FileSystem) bool {
+	_, ok := fs.(*afero.OsFs)
+	return ok
+}
@@ -1,10 +1,13 @@
 package esl
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -89,8 +92,13 @@ func takeDBPathSnap(fs FileSystem, path string) (snap *dbPathSnap, err error) {
 		// This case is abnormal, because hint file must be existed with data file.
 		// But we still handle it. And notice snap.dataFileId should bigger than the
 		// latest hintFileId, so we add 1 to it.
-		snap.lastDataFileId, err = lastFileIdFromFilenames(snap.hintFiles)
-		snap.lastDataFileId++
+		lastHintFileId, err := lastFileIdFromFilenames(snap.hintFiles)
+		if err != nil {
+			return nil, errors.Wrap(err, "takeDBPathSnap parse hint file id")
+		}
+		if lastHintFileId+1 > snap.lastDataFileId {
+			snap.lastDataFileId = lastHintFileId + 1
+		}
 	}
 
 	return snap, nil
@@ -161,3 +169,22 @@ func backupFile(fs FileSystem, filename string) (restoreFn func() error, cleanFn
 func unsafeString(s []byte) string {
 	return *(*string)(unsafe.Pointer(&s))
 }
+
+// unsafeBytes convert string to []byte without copy, the returned slice must
+// not be modified.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// waitWhile spins until flag is false, it returns ctx.Err() if ctx is done before.
+func waitWhile(ctx context.Context, flag *atomic.Bool) error {
+	for flag.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package esl
+
+import (
+	"time"
+)
+
+// MergeStats describes the result of a merge process.
+type MergeStats struct {
+	// MergedFiles is the number of immutable data files those were merged.
+	MergedFiles int
+	// ReadEntries is the number of entries those were read from merged files.
+	ReadEntries int
+	// AliveEntries is the number of entries those were written into merged files.
+	AliveEntries int
+	// Duration is the time cost of the merge process.
+	Duration time.Duration
+}
+
+// RecoverReport describes how the DB was restored while opening.
+type RecoverReport struct {
+	// DataFiles is the number of data files found in the DB path.
+	DataFiles int
+	// HintFiles is the number of hint files found in the DB path.
+	HintFiles int
+	// Keys is the number of keys restored into keydir.
+	Keys int
+	// ActiveFileId is the id of the active data file after recovery.
+	ActiveFileId uint16
+	// ActiveFileOffset is the size of the active data file after recovery.
+	ActiveFileOffset uint32
+	// Duration is the time cost of the recovery process.
+	Duration time.Duration
+}
+
+// hooks holds the lifecycle callbacks registered by developer. All callbacks are
+// called synchronously, so they MUST NOT block for long time, and MUST NOT
+// call DB methods, otherwise the DB may be deadlocked.
+type hooks struct {
+	onArchive    func(oldFileId, newFileId uint16)
+	onMergeStart func()
+	onMergeDone  func(stats MergeStats, err error)
+	onRecover    func(report RecoverReport)
+	onError      func(err error)
+}
+
+func (h *hooks) archive(oldFileId, newFileId uint16) {
+	if h == nil || h.onArchive == nil {
+		return
+	}
+
+	h.onArchive(oldFileId, newFileId)
+}
+
+func (h *hooks) mergeStart() {
+	if h == nil || h.onMergeStart == nil {
+		return
+	}
+
+	h.onMergeStart()
+}
+
+func (h *hooks) mergeDone(stats MergeStats, err error) {
+	if h == nil || h.onMergeDone == nil {
+		return
+	}
+
+	h.onMergeDone(stats, err)
+}
+
+func (h *hooks) recover(report RecoverReport) {
+	if h == nil || h.onRecover == nil {
+		return
+	}
+
+	h.onRecover(report)
+}
+
+// reportError reports the error which could not be returned to the caller, such
+// as the errors of background routines.
+func (h *hooks) reportError(err error) {
+	if h == nil || h.onError == nil {
+		return
+	}
+
+	h.onError(err)
+}
@@ -0,0 +1,168 @@
+package esl
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hooks_nil(t *testing.T) {
+	var h *hooks
+	assert.NotPanics(t, func() {
+		h.archive(1, 2)
+		h.mergeStart()
+		h.mergeDone(MergeStats{}, nil)
+		h.recover(RecoverReport{})
+		h.reportError(nil)
+	})
+
+	h = &hooks{}
+	assert.NotPanics(t, func() {
+		h.archive(1, 2)
+		h.mergeStart()
+		h.mergeDone(MergeStats{}, nil)
+		h.recover(RecoverReport{})
+		h.reportError(nil)
+	})
+}
+
+func Test_DB_hooks(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	var (
+		mu       sync.Mutex
+		archived [][2]uint16
+		started  int
+		done     []MergeStats
+		reports  []RecoverReport
+	)
+
+	opts := []Option{
+		WithFileSystem(fs),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithOnArchive(func(oldFileId, newFileId uint16) {
+			mu.Lock()
+			defer mu.Unlock()
+			archived = append(archived, [2]uint16{oldFileId, newFileId})
+		}),
+		WithOnMergeStart(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			started++
+		}),
+		WithOnMergeDone(func(stats MergeStats, err error) {
+			assert.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, stats)
+		}),
+		WithOnRecover(func(report RecoverReport) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, report)
+		}),
+	}
+
+	db, err := Open("/tmp/esl", opts...)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, 0, reports[0].DataFiles)
+	assert.Equal(t, 0, reports[0].Keys)
+	assert.Equal(t, initDataFileId, reports[0].ActiveFileId)
+
+	// each entry costs about 25 bytes, 16 entries would be archived several times.
+	for _, kv := range randomKVEntries(16) {
+		err = db.Put(kv.key, kv.value)
+		require.NoError(t, err)
+	}
+
+	mu.Lock()
+	nArchived := len(archived)
+	require.NotZero(t, nArchived)
+	for idx, pair := range archived {
+		assert.Equal(t, uint16(idx+1), pair[0])
+		assert.Equal(t, uint16(idx+2), pair[1])
+	}
+	mu.Unlock()
+
+	err = db.Merge()
+	require.NoError(t, err)
+
+	// we need to wait compact goroutine finish
+	time.Sleep(100 * time.Millisecond)
+	for db.inCompaction.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	assert.Equal(t, 1, started)
+	require.Len(t, done, 1)
+	assert.Equal(t, nArchived, done[0].MergedFiles)
+	assert.NotZero(t, done[0].ReadEntries)
+	assert.Equal(t, done[0].ReadEntries, done[0].AliveEntries)
+	mu.Unlock()
+
+	require.NoError(t, db.Close())
+
+	// reopen to trigger recover hook.
+	db, err = Open("/tmp/esl", opts...)
+	require.NoError(t, err)
+	defer db.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, reports, 2)
+	assert.NotZero(t, reports[1].Keys)
+	assert.NotZero(t, reports[1].DataFiles)
+	assert.NotZero(t, reports[1].HintFiles)
+}
+
+// hintFailingFs fails to create any hint file.
+type hintFailingFs struct {
+	afero.Fs
+}
+
+func (fs hintFailingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if strings.HasSuffix(name, hintFileExt+".tmp") {
+		return nil, errors.New("hint file is not writable")
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func Test_DB_hooks_onError_archive(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(hintFailingFs{afero.NewMemMapFs()}),
+		WithIndexMode(IndexModeHint),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithOnError(func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		}),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the keys are still indexed in memory if the hint file fails.
+	putKeys(t, db, 0, 10)
+	assertKeys(t, db, 0, 10)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, errs)
+	assert.Contains(t, errs[0].Error(), "index archived data file")
+}
@@ -7,27 +7,57 @@ import (
 	"github.com/pkg/errors"
 )
 
+// The layout of hint entries is versioned by formatVersion too.
 const (
-	keydirMem_Size       = 12
+	keydirMem_Size       = 31
 	keydirFile_fixedSize = keydirMem_Size + 2
 )
 
 // keydirMemEntry is a single keydir entry in an ESL hash index structure.
 type keydirMemEntry struct {
 	fileId      uint16
-	valueSize   uint16
+	valueSize   uint16 // the size of value stored in file.
 	entryOffset uint32
 	valueOffset uint32 // uint32 is enough (about 4GB for a single file)
+	rawSize     uint16 // the size of value before compression.
+	flags       uint8  // the flags of entry, see kvEntry.flags.
+	seq         uint64 // the sequence number of entry.
+	tstamp      uint64 // the timestamp of entry in nanoseconds.
 }
 
 func (e keydirMemEntry) bytes() []byte {
 	data := make([]byte, keydirMem_Size)
+	e.encodeTo(data)
+
+	return data
+}
+
+// encodeTo encodes the entry into data, data must have keydirMem_Size bytes at least.
+func (e keydirMemEntry) encodeTo(data []byte) {
 	binary.BigEndian.PutUint16(data, e.fileId)
 	binary.BigEndian.PutUint16(data[2:], e.valueSize)
 	binary.BigEndian.PutUint32(data[4:], e.entryOffset)
 	binary.BigEndian.PutUint32(data[8:], e.valueOffset)
+	binary.BigEndian.PutUint16(data[12:], e.rawSize)
+	data[14] = e.flags
+	binary.BigEndian.PutUint64(data[15:], e.seq)
+	binary.BigEndian.PutUint64(data[23:], e.tstamp)
+}
 
-	return data
+// codec returns the codec id which compresses the value.
+func (e keydirMemEntry) codec() uint8 {
+	return e.flags & entryFlag_codecMask
+}
+
+// tombstone reports whether the entry locates a tombstone, which means the key
+// has been deleted.
+func (e keydirMemEntry) tombstone() bool {
+	return e.flags&entryFlag_tombstone != 0
+}
+
+// operand reports whether the entry locates an operand record.
+func (e keydirMemEntry) operand() bool {
+	return e.flags&entryFlag_operand != 0
 }
 
 func decodeKeydirEntry(data []byte) (*keydirMemEntry, error) {
@@ -40,6 +70,10 @@ func decodeKeydirEntry(data []byte) (*keydirMemEntry, error) {
 		valueSize:   binary.BigEndian.Uint16(data[2:]),
 		entryOffset: binary.BigEndian.Uint32(data[4:]),
 		valueOffset: binary.BigEndian.Uint32(data[8:]),
+		rawSize:     binary.BigEndian.Uint16(data[12:]),
+		flags:       data[14],
+		seq:         binary.BigEndian.Uint64(data[15:]),
+		tstamp:      binary.BigEndian.Uint64(data[23:]),
 	}
 
 	return keydir, nil
@@ -49,6 +83,72 @@ func (e keydirMemEntry) size() int {
 	return keydirMem_Size
 }
 
+// IndexMode decides where the keys are indexed.
+type IndexMode uint8
+
+const (
+	// IndexModeMemory keeps all keys in memory, it's the default mode.
+	IndexModeMemory IndexMode = iota
+	// IndexModeHint keeps only the keys of active data file in memory. The keys of
+	// immutable data files are kept in hint files in the order of keys, and only
+	// a bloom filter and a sparse block index of each hint file are kept in memory.
+	// It's suitable for a huge number of keys, but Get may read an index block
+	// from disk before reading the value.
+	IndexModeHint
+	// IndexModeCompact keeps all keys in memory like IndexModeMemory, but the keys
+	// and entries are stored inline in large slabs and indexed by an open addressing
+	// hash table. It costs much less memory per key and puts far less pressure on GC.
+	IndexModeCompact
+)
+
+// keydir indexes the location of the latest entry of each key.
+type keydir interface {
+	// get returns nil if the key is not found.
+	get(key []byte) (*keydirMemEntry, error)
+	set(key []byte, ent *keydirMemEntry)
+	// del removes the key, ent is the tombstone which deletes it.
+	del(key []byte, ent *keydirMemEntry)
+	// delRange removes the keys in r those are written before ent, ent is the
+	// range tombstone which deletes them.
+	delRange(r keyRange, ent *keydirMemEntry)
+	// len returns the number of indexed entries.
+	len() int
+	// rangeKeys calls fn with each key and its latest entry until fn returns false.
+	rangeKeys(fn func(key []byte, ent *keydirMemEntry) bool) error
+	// maxSeq returns the greatest sequence number of indexed entries.
+	maxSeq() (uint64, error)
+
+	// archived is called after the active data file fileId is archived.
+	archived(fileId uint16) error
+	// merged is called after the data files older than activeFileId are merged,
+	// keydirs are the entries of merged files.
+	merged(activeFileId uint16, keydirs []*keydirFileEntry) error
+}
+
+// keydirSetter is the part of keydir to restore entries.
+type keydirSetter interface {
+	set(key []byte, ent *keydirMemEntry)
+	delRange(r keyRange, ent *keydirMemEntry)
+}
+
+// indexKey indexes the entry of key in kd, the key is removed from kd if the
+// entry is a tombstone.
+func indexKey(kd keydir, key []byte, ent *keydirMemEntry) {
+	if ent.tombstone() {
+		kd.del(key, ent)
+		return
+	}
+
+	kd.set(key, ent)
+}
+
+var (
+	_ keydir = (*keydirMemTable)(nil)
+	_ keydir = (*keydirHintTable)(nil)
+	_ keydir = (*keydirArenaTable)(nil)
+	_ keydir = (*keydirShards)(nil)
+)
+
 // keydirMemTable is a map of keydir entries, the key is generic type T.
 type keydirMemTable struct {
 	lock    sync.RWMutex
@@ -69,16 +169,16 @@ func (kd *keydirMemTable) len() int {
 	return len(kd.indexes)
 }
 
-func (kd *keydirMemTable) get(key []byte) *keydirMemEntry {
+func (kd *keydirMemTable) get(key []byte) (*keydirMemEntry, error) {
 	kd.lock.RLock()
 	defer kd.lock.RUnlock()
 
 	ent, ok := kd.indexes[unsafeString(key)]
 	if ok {
-		return ent
+		return ent, nil
 	}
 
-	return nil
+	return nil, nil
 }
 
 func (kd *keydirMemTable) set(key []byte, ent *keydirMemEntry) {
@@ -88,12 +188,87 @@ func (kd *keydirMemTable) set(key []byte, ent *keydirMemEntry) {
 	kd.indexes[unsafeString(key)] = ent
 }
 
-// func (kd *keydirMemTable) del(key []byte) {
-// 	kd.lock.Lock()
-// 	defer kd.lock.Unlock()
-//
-// 	delete(kd.indexes, string(key))
-// }
+func (kd *keydirMemTable) del(key []byte, _ *keydirMemEntry) {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	delete(kd.indexes, unsafeString(key))
+}
+
+// delRange collects the covered keys while holding the read lock, so that the
+// lookups are not blocked by the scan, and then removes them while holding the
+// write lock. The keys written after ent in between are kept.
+func (kd *keydirMemTable) delRange(r keyRange, ent *keydirMemEntry) {
+	kd.lock.RLock()
+	keys := make([]string, 0, 16)
+	for key, cur := range kd.indexes {
+		if cur.seq < ent.seq && r.contains(unsafeBytes(key)) {
+			keys = append(keys, key)
+		}
+	}
+	kd.lock.RUnlock()
+
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	for _, key := range keys {
+		if cur, ok := kd.indexes[key]; ok && cur.seq < ent.seq {
+			delete(kd.indexes, key)
+		}
+	}
+}
+
+func (kd *keydirMemTable) rangeKeys(fn func(key []byte, ent *keydirMemEntry) bool) error {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	for key, ent := range kd.indexes {
+		if !fn([]byte(key), ent) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (kd *keydirMemTable) maxSeq() (uint64, error) {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	var seq uint64
+	for _, ent := range kd.indexes {
+		seq = max(seq, ent.seq)
+	}
+
+	return seq, nil
+}
+
+func (kd *keydirMemTable) archived(uint16) error {
+	return nil
+}
+
+// merged updates the keys located in merged files, the keys those are written
+// after merge started have greater sequence numbers, and the keys those are
+// deleted after merge started are not indexed, they should not be overwritten.
+// The tombstone entries remove the keys which are dropped by the merge process.
+func (kd *keydirMemTable) merged(_ uint16, keydirs []*keydirFileEntry) error {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	for _, keydir := range keydirs {
+		cur, ok := kd.indexes[unsafeString(keydir.key)]
+		if !ok || cur.seq > keydir.seq {
+			continue
+		}
+		if keydir.tombstone() {
+			delete(kd.indexes, unsafeString(keydir.key))
+			continue
+		}
+		kd.indexes[unsafeString(keydir.key)] = &keydir.keydirMemEntry
+	}
+
+	return nil
+}
 
 type keydirFileEntry struct {
 	keydirMemEntry
@@ -0,0 +1,307 @@
+package esl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+)
+
+const (
+	// arenaSlabShift decides the size of slabs, records never cross slabs.
+	arenaSlabShift = 20
+	arenaSlabBytes = 1 << arenaSlabShift // 1MB
+
+	// arenaRecordFixedSize is the size of keydirMemEntry and key size.
+	arenaRecordFixedSize = keydirMem_Size + 2
+
+	arenaInitSlots = 1024
+	arenaRefBits   = 48
+	arenaRefMask   = 1<<arenaRefBits - 1
+)
+
+// keydirArenaTable stores the keys and entries inline in large byte slabs, each
+// record is encoded as:
+//
+// | keydirMemEntry(keydirMem_Size, 31) | key_sz(2) | key |
+//
+// The records are indexed by an open addressing hash table with linear probing,
+// each slot is an uint64: the high 16 bits are the tag of hash, and the low 48
+// bits are the reference (location+1) of the record in slabs, 0 means empty.
+//
+// A key costs about 8 bytes of slot and arenaRecordFixedSize (33) bytes of record
+// besides the key itself, and there are only a few pointers for GC to scan.
+type keydirArenaTable struct {
+	lock sync.RWMutex
+	seed maphash.Seed
+
+	slots []uint64
+	count int
+	slabs [][]byte
+	// garbage is the size of removed records in slabs.
+	garbage int
+}
+
+func newKeydirArenaTable() *keydirArenaTable {
+	return &keydirArenaTable{
+		seed:  maphash.MakeSeed(),
+		slots: make([]uint64, arenaInitSlots),
+	}
+}
+
+func (kd *keydirArenaTable) hash(key []byte) uint64 {
+	return maphash.Bytes(kd.seed, key)
+}
+
+// record returns the record referenced by ref.
+func (kd *keydirArenaTable) record(ref uint64) []byte {
+	loc := ref - 1
+	slab := kd.slabs[loc>>arenaSlabShift]
+	off := loc & (arenaSlabBytes - 1)
+	keySize := binary.BigEndian.Uint16(slab[off+keydirMem_Size:])
+
+	return slab[off : off+arenaRecordFixedSize+uint64(keySize)]
+}
+
+// find returns the index of slot which holds the key, or the empty slot where
+// the key should be inserted.
+func (kd *keydirArenaTable) find(key []byte, h uint64) (int, bool) {
+	mask := uint64(len(kd.slots) - 1)
+	tag := h >> arenaRefBits
+
+	for i := h & mask; ; i = (i + 1) & mask {
+		slot := kd.slots[i]
+		if slot == 0 {
+			return int(i), false
+		}
+		if slot>>arenaRefBits == tag &&
+			bytes.Equal(kd.record(slot & arenaRefMask)[arenaRecordFixedSize:], key) {
+			return int(i), true
+		}
+	}
+}
+
+// alloc appends a record of key into slabs, and returns the reference of it.
+func (kd *keydirArenaTable) alloc(key []byte, ent *keydirMemEntry) uint64 {
+	size := arenaRecordFixedSize + len(key)
+	n := len(kd.slabs)
+	if n == 0 || len(kd.slabs[n-1])+size > arenaSlabBytes {
+		kd.slabs = append(kd.slabs, make([]byte, 0, arenaSlabBytes))
+		n++
+	}
+
+	slab := kd.slabs[n-1]
+	off := len(slab)
+	slab = slab[:off+size]
+	ent.encodeTo(slab[off:])
+	binary.BigEndian.PutUint16(slab[off+keydirMem_Size:], uint16(len(key)))
+	copy(slab[off+arenaRecordFixedSize:], key)
+	kd.slabs[n-1] = slab
+
+	return uint64(n-1)<<arenaSlabShift | uint64(off) + 1
+}
+
+// grow doubles the slots and rehashes all records.
+func (kd *keydirArenaTable) grow() {
+	old := kd.slots
+	kd.slots = make([]uint64, len(old)*2)
+	for _, slot := range old {
+		if slot == 0 {
+			continue
+		}
+		key := kd.record(slot & arenaRefMask)[arenaRecordFixedSize:]
+		i, _ := kd.find(key, kd.hash(key))
+		kd.slots[i] = slot
+	}
+}
+
+func (kd *keydirArenaTable) len() int {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	return kd.count
+}
+
+func (kd *keydirArenaTable) get(key []byte) (*keydirMemEntry, error) {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	i, ok := kd.find(key, kd.hash(key))
+	if !ok {
+		return nil, nil
+	}
+
+	return decodeKeydirEntry(kd.record(kd.slots[i] & arenaRefMask)[:keydirMem_Size])
+}
+
+func (kd *keydirArenaTable) set(key []byte, ent *keydirMemEntry) {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	h := kd.hash(key)
+	i, ok := kd.find(key, h)
+	if ok {
+		// overwrite the entry in place.
+		ent.encodeTo(kd.record(kd.slots[i] & arenaRefMask))
+		return
+	}
+
+	kd.slots[i] = h&^arenaRefMask | kd.alloc(key, ent)
+	kd.count++
+	// keep the load factor under 0.75 to keep probing short.
+	if kd.count*4 >= len(kd.slots)*3 {
+		kd.grow()
+	}
+}
+
+func (kd *keydirArenaTable) del(key []byte, _ *keydirMemEntry) {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	if i, ok := kd.find(key, kd.hash(key)); ok {
+		kd.remove(i)
+	}
+}
+
+// delRange collects the covered keys while holding the read lock, and then
+// removes them while holding the write lock, see keydirMemTable.delRange.
+func (kd *keydirArenaTable) delRange(r keyRange, ent *keydirMemEntry) {
+	kd.lock.RLock()
+	// the records are shifted while removing, so collect the keys first.
+	var keys [][]byte
+	for _, slot := range kd.slots {
+		if slot == 0 {
+			continue
+		}
+		record := kd.record(slot & arenaRefMask)
+		key := record[arenaRecordFixedSize:]
+		cur, err := decodeKeydirEntry(record[:keydirMem_Size])
+		if err == nil && cur.seq < ent.seq && r.contains(key) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+	kd.lock.RUnlock()
+
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	for _, key := range keys {
+		i, ok := kd.find(key, kd.hash(key))
+		if !ok {
+			continue
+		}
+		cur, err := decodeKeydirEntry(kd.record(kd.slots[i] & arenaRefMask)[:keydirMem_Size])
+		if err == nil && cur.seq < ent.seq {
+			kd.remove(i)
+		}
+	}
+}
+
+// remove empties the slot i, and shifts the following records of the probe
+// sequence backward, so that lookups never stop at the emptied slot early and
+// no deleted marker is needed. The slabs are compacted if most of the space is
+// taken by removed records.
+func (kd *keydirArenaTable) remove(i int) {
+	kd.garbage += len(kd.record(kd.slots[i] & arenaRefMask))
+
+	mask := len(kd.slots) - 1
+	for j := (i + 1) & mask; kd.slots[j] != 0; j = (j + 1) & mask {
+		key := kd.record(kd.slots[j] & arenaRefMask)[arenaRecordFixedSize:]
+		home := int(kd.hash(key) & uint64(mask))
+		// the record stays if its home slot is cyclically in (i, j].
+		if (i < j && i < home && home <= j) || (i > j && (i < home || home <= j)) {
+			continue
+		}
+		kd.slots[i] = kd.slots[j]
+		i = j
+	}
+	kd.slots[i] = 0
+	kd.count--
+
+	used := 0
+	for _, slab := range kd.slabs {
+		used += len(slab)
+	}
+	if kd.garbage >= arenaSlabBytes && kd.garbage*2 >= used {
+		kd.compact()
+	}
+}
+
+// compact copies the live records into new slabs to reclaim the space of the
+// removed records.
+func (kd *keydirArenaTable) compact() {
+	old := &keydirArenaTable{slabs: kd.slabs}
+	kd.slabs = nil
+	for i, slot := range kd.slots {
+		if slot == 0 {
+			continue
+		}
+		record := old.record(slot & arenaRefMask)
+		ent, _ := decodeKeydirEntry(record[:keydirMem_Size])
+		kd.slots[i] = slot&^arenaRefMask | kd.alloc(record[arenaRecordFixedSize:], ent)
+	}
+	kd.garbage = 0
+}
+
+func (kd *keydirArenaTable) rangeKeys(fn func(key []byte, ent *keydirMemEntry) bool) error {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	for _, slot := range kd.slots {
+		if slot == 0 {
+			continue
+		}
+		record := kd.record(slot & arenaRefMask)
+		ent, err := decodeKeydirEntry(record[:keydirMem_Size])
+		if err != nil {
+			return err
+		}
+		if !fn(append([]byte(nil), record[arenaRecordFixedSize:]...), ent) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (kd *keydirArenaTable) maxSeq() (uint64, error) {
+	var seq uint64
+	err := kd.rangeKeys(func(_ []byte, ent *keydirMemEntry) bool {
+		seq = max(seq, ent.seq)
+		return true
+	})
+
+	return seq, err
+}
+
+func (kd *keydirArenaTable) archived(uint16) error {
+	return nil
+}
+
+// merged is the same as keydirMemTable.merged.
+func (kd *keydirArenaTable) merged(_ uint16, keydirs []*keydirFileEntry) error {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	for _, keydir := range keydirs {
+		i, ok := kd.find(keydir.key, kd.hash(keydir.key))
+		if !ok {
+			continue
+		}
+		record := kd.record(kd.slots[i] & arenaRefMask)
+		cur, err := decodeKeydirEntry(record[:keydirMem_Size])
+		if err != nil {
+			return err
+		}
+		if cur.seq > keydir.seq {
+			continue
+		}
+		if keydir.tombstone() {
+			kd.remove(i)
+			continue
+		}
+		keydir.keydirMemEntry.encodeTo(record)
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package esl
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_keydirArenaTable(t *testing.T) {
+	kd := newKeydirArenaTable()
+
+	// enough keys to grow slots and allocate several slabs.
+	n := 100000
+	key := func(i int) []byte {
+		return []byte("key-" + strconv.Itoa(i) + "-" + string(make([]byte, i%32)))
+	}
+	for i := 0; i < n; i++ {
+		kd.set(key(i), &keydirMemEntry{fileId: 1, valueSize: uint16(i), entryOffset: uint32(i), valueOffset: uint32(i + 1)})
+	}
+	assert.Equal(t, n, kd.len())
+	assert.Greater(t, len(kd.slabs), 1)
+
+	// overwrite in place.
+	for i := 0; i < n; i += 2 {
+		kd.set(key(i), &keydirMemEntry{fileId: 2, valueSize: uint16(i), entryOffset: uint32(i), valueOffset: uint32(i + 1)})
+	}
+	assert.Equal(t, n, kd.len())
+
+	for i := 0; i < n; i++ {
+		ent, err := kd.get(key(i))
+		require.NoError(t, err)
+		require.NotNil(t, ent, i)
+		assert.Equal(t, uint16(2-i%2), ent.fileId)
+		assert.Equal(t, uint32(i), ent.entryOffset)
+	}
+	ent, err := kd.get([]byte("absent"))
+	assert.NoError(t, err)
+	assert.Nil(t, ent)
+
+	count := 0
+	require.NoError(t, kd.rangeKeys(func(key []byte, ent *keydirMemEntry) bool {
+		count++
+		return true
+	}))
+	assert.Equal(t, n, count)
+}
+
+func Test_keydirArenaTable_merged(t *testing.T) {
+	kd := newKeydirArenaTable()
+	kd.set([]byte("old"), &keydirMemEntry{fileId: 1, valueSize: 1, seq: 1})
+	kd.set([]byte("new"), &keydirMemEntry{fileId: 3, valueSize: 1, seq: 5})
+
+	require.NoError(t, kd.merged(3, []*keydirFileEntry{
+		{keydirMemEntry: keydirMemEntry{fileId: 2, valueSize: 2, seq: 1}, keySize: 3, key: []byte("old")},
+		{keydirMemEntry: keydirMemEntry{fileId: 2, valueSize: 2, seq: 2}, keySize: 3, key: []byte("new")},
+		{keydirMemEntry: keydirMemEntry{fileId: 2, valueSize: 2, seq: 3}, keySize: 5, key: []byte("other")},
+		{keydirMemEntry: keydirMemEntry{fileId: 2, flags: entryFlag_tombstone, seq: 5}, keySize: 3, key: []byte("new")},
+	}))
+
+	ent, _ := kd.get([]byte("old"))
+	assert.Equal(t, uint16(2), ent.fileId)
+	// the tombstone removes the key.
+	ent, _ = kd.get([]byte("new"))
+	assert.Nil(t, ent)
+	// the key is deleted after merge started.
+	ent, _ = kd.get([]byte("other"))
+	assert.Nil(t, ent)
+	assert.Equal(t, 1, kd.len())
+
+	seq, err := kd.maxSeq()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+}
+
+func Test_keydirArenaTable_del(t *testing.T) {
+	kd := newKeydirArenaTable()
+
+	// the records are large enough to compact slabs several times.
+	n := 50000
+	key := func(i int) []byte {
+		return []byte("key-" + strconv.Itoa(i) + "-" + string(make([]byte, 32)))
+	}
+	for i := 0; i < n; i++ {
+		kd.set(key(i), &keydirMemEntry{fileId: 1, entryOffset: uint32(i)})
+	}
+	slabs := len(kd.slabs)
+
+	// remove the keys in the middle of probe sequences, the others are still
+	// reachable.
+	for i := 0; i < n; i++ {
+		if i%5 != 0 {
+			kd.del(key(i), &keydirMemEntry{fileId: 2, flags: entryFlag_tombstone})
+		}
+	}
+	kd.del([]byte("absent"), &keydirMemEntry{fileId: 2, flags: entryFlag_tombstone})
+	assert.Equal(t, n/5, kd.len())
+	assert.Less(t, len(kd.slabs), slabs)
+
+	for i := 0; i < n; i++ {
+		ent, err := kd.get(key(i))
+		require.NoError(t, err)
+		if i%5 != 0 {
+			assert.Nil(t, ent, i)
+			continue
+		}
+		require.NotNil(t, ent, i)
+		assert.Equal(t, uint32(i), ent.entryOffset)
+	}
+
+	count := 0
+	require.NoError(t, kd.rangeKeys(func(key []byte, ent *keydirMemEntry) bool {
+		count++
+		return true
+	}))
+	assert.Equal(t, n/5, count)
+}
+
+func Test_DB_IndexModeCompact(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func() *DB {
+		db, err := Open("/tmp/esl",
+			WithFileSystem(fs),
+			WithMaxFileBytes(256),
+			WithCompactThreshold(1000), // avoid auto merge
+			WithIndexMode(IndexModeCompact),
+		)
+		require.NoError(t, err)
+		return db
+	}
+
+	db := open()
+	putKeys(t, db, 0, 50)
+	putKeys(t, db, 0, 10)
+	assertKeys(t, db, 0, 50)
+	assert.Len(t, db.ListKeys(), 50)
+	require.NoError(t, db.merge())
+	assertKeys(t, db, 0, 50)
+	require.NoError(t, db.Close())
+
+	db = open()
+	defer db.Close()
+	assertKeys(t, db, 0, 50)
+}
+
+const benchmarkKeydirKeys = 10_000_000
+
+func benchmarkKeydirKey(i int) []byte {
+	return []byte("benchmark-key-" + strconv.Itoa(i))
+}
+
+// fillKeydir sets benchmarkKeydirKeys keys into the keydir, and returns a function
+// to report the heap bytes per key and the duration of a full GC, since extra
+// metrics are cleared by b.ResetTimer.
+func fillKeydir(b *testing.B, newKeydir func() keydir) (keydir, func()) {
+	b.Helper()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	kd := newKeydir()
+	for i := 0; i < benchmarkKeydirKeys; i++ {
+		kd.set(benchmarkKeydirKey(i), &keydirMemEntry{fileId: 1, valueSize: 10, entryOffset: uint32(i)})
+	}
+
+	start := time.Now()
+	runtime.GC()
+	gcCost := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return kd, func() {
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchmarkKeydirKeys, "heap-bytes/key")
+		b.ReportMetric(float64(gcCost.Microseconds()), "gc-us")
+	}
+}
+
+var benchmarkKeydirs = []struct {
+	name      string
+	newKeydir func() keydir
+}{
+	{name: "memtable", newKeydir: func() keydir { return newKeyDir() }},
+	{name: "arena", newKeydir: func() keydir { return newKeydirArenaTable() }},
+}
+
+// Benchmark_keydir_Get compares the keydirs with 10M keys.
+// go test -run=^$ -bench=Benchmark_keydir -benchmem -benchtime=1000000x
+func Benchmark_keydir_Get(b *testing.B) {
+	for _, bb := range benchmarkKeydirs {
+		b.Run(bb.name, func(b *testing.B) {
+			kd, report := fillKeydir(b, bb.newKeydir)
+			keys := make([][]byte, 1024)
+			for i := range keys {
+				keys[i] = benchmarkKeydirKey(i * 9973 % benchmarkKeydirKeys)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ent, _ := kd.get(keys[i%len(keys)]); ent == nil {
+					b.Fatal("key not found")
+				}
+			}
+			b.StopTimer()
+			report()
+		})
+	}
+}
+
+func Benchmark_keydir_Set(b *testing.B) {
+	for _, bb := range benchmarkKeydirs {
+		b.Run(bb.name, func(b *testing.B) {
+			kd, report := fillKeydir(b, bb.newKeydir)
+			ent := &keydirMemEntry{fileId: 2, valueSize: 10}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				kd.set(benchmarkKeydirKey(i%(2*benchmarkKeydirKeys)), ent)
+			}
+			b.StopTimer()
+			report()
+		})
+	}
+}
@@ -0,0 +1,521 @@
+package esl
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// hintIndexBlockBytes is the size of index blocks of hint files, only the first
+// key of each block is kept in memory.
+const hintIndexBlockBytes = 4 << 10 // 4KB
+
+type hintBlock struct {
+	firstKey []byte
+	offset   uint32
+	size     uint32
+}
+
+// hintIndex is the in-memory index of a hint file which keys are sorted. The
+// hint file is split into blocks, so that a lookup reads one block at most.
+type hintIndex struct {
+	fileId   uint16
+	filename string
+	cipher   *fileCipher
+	bloom    *bloomFilter
+	blocks   []hintBlock
+	count    int
+	// maxSeq is the greatest sequence number of entries in hint file.
+	maxSeq uint64
+}
+
+var errHintUnsorted = errors.New("hint file is not sorted")
+
+// loadHintIndex builds the index of hint file, errHintUnsorted is returned if
+// the keys in hint file are not sorted.
+func loadHintIndex(fs FileSystem, enc *encryption, filename string, fileId uint16) (*hintIndex, error) {
+	fd, err := fs.OpenFile(filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	c, err := readFileHeader(fd, enc)
+	_ = fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &hintIndex{
+		fileId:   fileId,
+		filename: filename,
+		cipher:   c,
+		// each entry costs keydirFile_fixedSize bytes at least.
+		bloom:  newBloomFilter(int(fi.Size()) / keydirFile_fixedSize),
+		blocks: make([]hintBlock, 0, fi.Size()/hintIndexBlockBytes+1),
+	}
+
+	var prev []byte
+	err = scanHintFile(fs, enc, filename, func(keydir *keydirFileEntry, off uint32) error {
+		if idx.count > 0 && bytes.Compare(prev, keydir.key) >= 0 {
+			return errHintUnsorted
+		}
+		prev = keydir.key
+
+		if n := len(idx.blocks); n == 0 || off-idx.blocks[n-1].offset >= hintIndexBlockBytes {
+			idx.blocks = append(idx.blocks, hintBlock{firstKey: keydir.key, offset: off})
+		}
+		idx.bloom.add(keydir.key)
+		idx.count++
+		idx.maxSeq = max(idx.maxSeq, keydir.seq)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the block ends at the beginning of next block.
+	for i := range idx.blocks {
+		end := uint32(fi.Size())
+		if i+1 < len(idx.blocks) {
+			end = idx.blocks[i+1].offset
+		}
+		idx.blocks[i].size = end - idx.blocks[i].offset
+	}
+
+	return idx, nil
+}
+
+// lookup returns nil if the key is not in the hint file.
+func (idx *hintIndex) lookup(fs FileSystem, key []byte) (*keydirMemEntry, error) {
+	if !idx.bloom.mayContain(key) {
+		return nil, nil
+	}
+
+	// find the last block which first key is not greater than key.
+	i := sort.Search(len(idx.blocks), func(i int) bool {
+		return bytes.Compare(idx.blocks[i].firstKey, key) > 0
+	}) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	block := idx.blocks[i]
+
+	fd, err := fs.OpenFile(idx.filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fd.Close() }()
+
+	buf := make([]byte, block.size)
+	if n, err := fd.ReadAt(buf, int64(block.offset)); n != len(buf) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "read hint block failed")
+	}
+
+	for pos := 0; pos < len(buf); {
+		if len(buf)-pos < keydirFile_fixedSize {
+			return nil, ErrInvalidKeydirFileData
+		}
+		keydir, err := decodeKeydirFileEntry(buf[pos : pos+keydirFile_fixedSize])
+		if err != nil {
+			return nil, err
+		}
+
+		end := pos + keydirFile_fixedSize + int(keydir.keySize)
+		if end > len(buf) {
+			return nil, ErrInvalidKeydirFileData
+		}
+		k, err := idx.cipher.open(buf[pos+keydirFile_fixedSize:end], block.offset+uint32(pos), sealPartKey,
+			recordAAD(keydir.tstamp, keydir.seq, keydir.flags))
+		if err != nil {
+			return nil, err
+		}
+
+		switch bytes.Compare(k, key) {
+		case 0:
+			return &keydir.keydirMemEntry, nil
+		case 1:
+			// keys are sorted, so the key is not in the block.
+			return nil, nil
+		}
+		pos = end
+	}
+
+	return nil, nil
+}
+
+// writeHintFile writes the keydirs into the hint file of fileId in the order of
+// keys, only the last one of the same key is kept. The hint file is stamped with
+// generation which should be the generation of its data file. The hint file is
+// replaced atomically.
+func writeHintFile(fs FileSystem, enc *encryption, path string, fileId uint16, generation uint64,
+	keydirs []*keydirFileEntry) (err error) {
+	sort.SliceStable(keydirs, func(i, j int) bool {
+		return bytes.Compare(keydirs[i].key, keydirs[j].key) < 0
+	})
+
+	filename := hintFilename(path, fileId)
+	tmpFilename := filename + ".tmp"
+	fd, err := fs.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fd.Close()
+			_ = fs.Remove(tmpFilename)
+		}
+	}()
+
+	bw := bufio.NewWriter(fd)
+	hw, err := newHintWriter(bw, enc, generation)
+	if err != nil {
+		return err
+	}
+	for i, keydir := range keydirs {
+		if i+1 < len(keydirs) && bytes.Equal(keydirs[i+1].key, keydir.key) {
+			continue
+		}
+		if err = hw.write(keydir); err != nil {
+			return err
+		}
+	}
+
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+
+	return fs.Rename(tmpFilename, filename)
+}
+
+// keydirHintTable keeps the keys of immutable data files in the sorted hint files
+// rather than memory, only a bloom filter and the first key of each block of hint
+// files are kept in memory. The keys of the active data file are kept in memory
+// until it's archived.
+//
+// It costs much less memory than keydirMemTable, but a lookup of the key of
+// immutable data files reads an index block from disk.
+type keydirHintTable struct {
+	fs   FileSystem
+	enc  *encryption
+	path string
+
+	lock sync.RWMutex
+	// active holds the entries those are not in hint files, normally they are
+	// located in the active data file.
+	active map[string]*keydirMemEntry
+	// files are sorted by file id in descending order, so that the newer
+	// entries are found first.
+	files []*hintIndex
+}
+
+// openKeydirHintTable indexes the hint files of immutable data files, the hint
+// files are created or rewritten in the order of keys if necessary.
+func openKeydirHintTable(
+	fs FileSystem, enc *encryption, path string, snap *dbPathSnap, activeFileId uint16) (*keydirHintTable, error) {
+
+	kd := &keydirHintTable{
+		fs:     fs,
+		enc:    enc,
+		path:   path,
+		active: make(map[string]*keydirMemEntry, 1024),
+	}
+
+	hintFiles := make(map[uint16]bool, len(snap.hintFiles))
+	for _, filename := range snap.hintFiles {
+		if fileId, err := fileIdFromFilename(filename); err == nil {
+			hintFiles[fileId] = true
+		}
+	}
+
+	fileIds := make([]int, 0, len(snap.dataFiles))
+	for _, filename := range snap.dataFiles {
+		fileId, err := fileIdFromFilename(filename)
+		if err != nil {
+			continue
+		}
+		fileIds = append(fileIds, int(fileId))
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(fileIds)))
+
+	for _, fileId := range fileIds {
+		if uint16(fileId) == activeFileId {
+			filename := dataFilename(path, activeFileId)
+			kvs, keydirs, err := readDataFile(fs, enc, filename, activeFileId)
+			if err != nil {
+				return nil, errors.Wrap(err, "readDataFile "+filename)
+			}
+			for _, kv := range kvs {
+				kd.active[string(kv.key)] = keydirs[unsafeString(kv.key)]
+			}
+			continue
+		}
+
+		idx, err := kd.indexFile(uint16(fileId), hintFiles[uint16(fileId)])
+		if err != nil {
+			return nil, errors.Wrapf(err, "index data file %d", fileId)
+		}
+		kd.files = append(kd.files, idx)
+	}
+
+	return kd, nil
+}
+
+// indexFile loads the index of the hint file, if the hint file does not exist
+// or is not sorted, it's rebuilt from the hint file or data file.
+func (kd *keydirHintTable) indexFile(fileId uint16, hasHint bool) (*hintIndex, error) {
+	filename := hintFilename(kd.path, fileId)
+
+	var keydirs []*keydirFileEntry
+	if hasHint {
+		idx, err := loadHintIndex(kd.fs, kd.enc, filename, fileId)
+		if !errors.Is(err, errHintUnsorted) {
+			return idx, err
+		}
+		if keydirs, err = readHintFile(kd.fs, kd.enc, filename); err != nil {
+			return nil, err
+		}
+	} else {
+		_, entries, err := readDataFile(kd.fs, kd.enc, dataFilename(kd.path, fileId), fileId)
+		if err != nil {
+			return nil, err
+		}
+		keydirs = make([]*keydirFileEntry, 0, len(entries))
+		for key, ent := range entries {
+			keydirs = append(keydirs, &keydirFileEntry{
+				keydirMemEntry: *ent,
+				keySize:        uint16(len(key)),
+				key:            []byte(key),
+			})
+		}
+	}
+
+	if err := kd.writeHintFile(fileId, keydirs); err != nil {
+		return nil, err
+	}
+
+	return loadHintIndex(kd.fs, kd.enc, filename, fileId)
+}
+
+// writeHintFile writes the hint file of the data file fileId, see writeHintFile.
+func (kd *keydirHintTable) writeHintFile(fileId uint16, keydirs []*keydirFileEntry) error {
+	generation, err := readFileGeneration(kd.fs, dataFilename(kd.path, fileId))
+	if err != nil {
+		return err
+	}
+
+	return writeHintFile(kd.fs, kd.enc, kd.path, fileId, generation, keydirs)
+}
+
+func (kd *keydirHintTable) get(key []byte) (*keydirMemEntry, error) {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	if ent, ok := kd.active[unsafeString(key)]; ok {
+		return ent, nil
+	}
+
+	for _, idx := range kd.files {
+		ent, err := idx.lookup(kd.fs, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup hint file %d", idx.fileId)
+		}
+		if ent != nil {
+			return ent, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (kd *keydirHintTable) set(key []byte, ent *keydirMemEntry) {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	kd.active[unsafeString(key)] = ent
+}
+
+// del keeps the tombstone in memory rather than removing the key, since the
+// older entries of key in hint files are shadowed by it. The tombstone is
+// written into the hint file when the active data file is archived.
+func (kd *keydirHintTable) del(key []byte, ent *keydirMemEntry) {
+	kd.set(key, ent)
+}
+
+// delRange replaces the keys in memory with tombstones, but the keys in hint
+// files could not be removed, that's why range deletes are not supported by
+// IndexModeHint. It's called only if the range tombstones are replicated from
+// the primary in another index mode.
+func (kd *keydirHintTable) delRange(r keyRange, ent *keydirMemEntry) {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	tombstone := *ent
+	tombstone.flags &^= entryFlag_rangeTombstone
+	for key, cur := range kd.active {
+		if cur.seq < ent.seq && r.contains(unsafeBytes(key)) {
+			kd.active[key] = &tombstone
+		}
+	}
+	kd.active[string(r.start)] = ent
+}
+
+// len returns the number of entries in memory and hint files, the same key
+// in different hint files is counted repeatedly.
+func (kd *keydirHintTable) len() int {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	n := len(kd.active)
+	for _, idx := range kd.files {
+		n += idx.count
+	}
+
+	return n
+}
+
+func (kd *keydirHintTable) rangeKeys(fn func(key []byte, ent *keydirMemEntry) bool) error {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	seen := make(map[string]struct{}, len(kd.active))
+	for key, ent := range kd.active {
+		seen[key] = struct{}{}
+		if !fn([]byte(key), ent) {
+			return nil
+		}
+	}
+
+	stopped := errors.New("range stopped")
+	for _, idx := range kd.files {
+		err := scanHintFile(kd.fs, kd.enc, idx.filename, func(keydir *keydirFileEntry, _ uint32) error {
+			if _, ok := seen[string(keydir.key)]; ok {
+				return nil
+			}
+			seen[string(keydir.key)] = struct{}{}
+
+			if !fn(keydir.key, &keydir.keydirMemEntry) {
+				return stopped
+			}
+			return nil
+		})
+		if errors.Is(err, stopped) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "scan hint file %d", idx.fileId)
+		}
+	}
+
+	return nil
+}
+
+func (kd *keydirHintTable) maxSeq() (uint64, error) {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	var seq uint64
+	for _, ent := range kd.active {
+		seq = max(seq, ent.seq)
+	}
+	for _, idx := range kd.files {
+		seq = max(seq, idx.maxSeq)
+	}
+
+	return seq, nil
+}
+
+// archived writes the entries of the archived data file into its hint file, and
+// removes them from memory.
+func (kd *keydirHintTable) archived(fileId uint16) error {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	keydirs := make([]*keydirFileEntry, 0, len(kd.active))
+	for key, ent := range kd.active {
+		if ent.fileId != fileId {
+			continue
+		}
+		keydirs = append(keydirs, &keydirFileEntry{
+			keydirMemEntry: *ent,
+			keySize:        uint16(len(key)),
+			key:            []byte(key),
+		})
+	}
+	if len(keydirs) == 0 {
+		return nil
+	}
+
+	if err := kd.writeHintFile(fileId, keydirs); err != nil {
+		return err
+	}
+	idx, err := loadHintIndex(kd.fs, kd.enc, hintFilename(kd.path, fileId), fileId)
+	if err != nil {
+		return err
+	}
+
+	kd.files = append([]*hintIndex{idx}, kd.files...)
+	for _, keydir := range keydirs {
+		delete(kd.active, unsafeString(keydir.key))
+	}
+
+	return nil
+}
+
+// merged replaces the indexes of merged data files with the indexes of hint
+// files written by merge process.
+func (kd *keydirHintTable) merged(activeFileId uint16, keydirs []*keydirFileEntry) error {
+	fileIds := make(map[uint16]struct{}, 4)
+	for _, keydir := range keydirs {
+		fileIds[keydir.fileId] = struct{}{}
+	}
+
+	indexes := make([]*hintIndex, 0, len(fileIds))
+	for fileId := range fileIds {
+		idx, err := kd.indexFile(fileId, true)
+		if err != nil {
+			return errors.Wrapf(err, "index merged file %d", fileId)
+		}
+		indexes = append(indexes, idx)
+	}
+
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	for _, idx := range kd.files {
+		if idx.fileId >= activeFileId {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].fileId > indexes[j].fileId
+	})
+	kd.files = indexes
+
+	// the entries in merged files are indexed by hint files now.
+	for key, ent := range kd.active {
+		if ent.fileId < activeFileId {
+			delete(kd.active, key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package esl
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hintIndex_lookup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll("/tmp/esl", 0777))
+
+	keydirs := make([]*keydirFileEntry, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		key := []byte("key-" + strconv.Itoa(i))
+		keydirs = append(keydirs, &keydirFileEntry{
+			keydirMemEntry: keydirMemEntry{fileId: 1, valueSize: 10, entryOffset: uint32(i), valueOffset: uint32(i + 1)},
+			keySize:        uint16(len(key)),
+			key:            key,
+		})
+	}
+	// the older entry of the same key is overwritten.
+	keydirs = append([]*keydirFileEntry{{
+		keydirMemEntry: keydirMemEntry{fileId: 1, valueSize: 1},
+		keySize:        5,
+		key:            []byte("key-1"),
+	}}, keydirs...)
+	require.NoError(t, writeHintFile(fs, nil, "/tmp/esl", 1, 0, keydirs))
+
+	idx, err := loadHintIndex(fs, nil, hintFilename("/tmp/esl", 1), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, idx.count)
+	assert.Greater(t, len(idx.blocks), 1)
+
+	for i := 0; i < 1000; i++ {
+		ent, err := idx.lookup(fs, []byte("key-"+strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.NotNil(t, ent, i)
+		assert.Equal(t, uint32(i), ent.entryOffset)
+		assert.Equal(t, uint16(10), ent.valueSize)
+	}
+
+	for _, key := range []string{"a", "key-", "key-1000", "zzz"} {
+		ent, err := idx.lookup(fs, []byte(key))
+		require.NoError(t, err)
+		assert.Nil(t, ent, key)
+	}
+}
+
+func Test_loadHintIndex_unsorted(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	filename := hintFilename("/tmp/esl", 1)
+	for _, key := range []string{"b", "a"} {
+		require.NoError(t, writeHintIntoFile(fs, filename, &keydirFileEntry{
+			keydirMemEntry: keydirMemEntry{fileId: 1, valueSize: 1},
+			keySize:        1,
+			key:            []byte(key),
+		}))
+	}
+
+	_, err := loadHintIndex(fs, nil, filename, 1)
+	assert.ErrorIs(t, err, errHintUnsorted)
+}
+
+func Test_DB_IndexModeHint(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func(options ...Option) *DB {
+		options = append(options,
+			WithFileSystem(fs),
+			WithMaxFileBytes(256),
+			WithCompactThreshold(1000), // avoid auto merge
+			WithIndexMode(IndexModeHint),
+		)
+		db, err := Open("/tmp/esl", options...)
+		require.NoError(t, err)
+		return db
+	}
+
+	db := open()
+	putKeys(t, db, 0, 50)
+	putKeys(t, db, 0, 10)
+	require.NoError(t, db.Delete([]byte("key-0")))
+	assertKeys(t, db, 1, 50)
+	_, err := db.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	kd := db.keyDir.(*keydirHintTable)
+	assert.NotEmpty(t, kd.files)
+	assert.Less(t, len(kd.active), 50)
+	for _, ent := range kd.active {
+		assert.Equal(t, db.activeFileId, ent.fileId)
+	}
+
+	keys := make([]string, 0, 49)
+	for _, key := range db.ListKeys() {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	assert.Len(t, keys, 49)
+	assert.Equal(t, "key-1", keys[0])
+	require.NoError(t, db.Close())
+
+	// the archived files are indexed by their hint files.
+	db = open()
+	assertKeys(t, db, 1, 50)
+	assert.Equal(t, uint64(61), db.seq)
+	_, err = db.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, db.merge())
+	assertKeys(t, db, 1, 50)
+	_, err = db.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	putKeys(t, db, 50, 60)
+	require.NoError(t, db.Close())
+
+	// the hint files of data files are rebuilt if they are missing.
+	snap, err := takeDBPathSnap(fs, "/tmp/esl")
+	require.NoError(t, err)
+	for _, filename := range snap.hintFiles {
+		require.NoError(t, fs.Remove(filename))
+	}
+	db = open()
+	defer db.Close()
+	assertKeys(t, db, 1, 60)
+	snap, err = takeDBPathSnap(fs, "/tmp/esl")
+	require.NoError(t, err)
+	assert.Len(t, snap.hintFiles, len(snap.dataFiles)-1)
+}
+
+func Test_DB_IndexModeHint_encryption(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func() *DB {
+		db, err := Open("/tmp/esl",
+			WithFileSystem(fs),
+			WithMaxFileBytes(256),
+			WithCompactThreshold(1000), // avoid auto merge
+			WithIndexMode(IndexModeHint),
+			WithEncryption(testKeyRing(1)),
+		)
+		require.NoError(t, err)
+		return db
+	}
+
+	db := open()
+	putKeys(t, db, 0, 30)
+	assertKeys(t, db, 0, 30)
+	assertNoPlaintext(t, fs, "/tmp/esl", "key-1")
+	require.NoError(t, db.Close())
+
+	db = open()
+	defer db.Close()
+	assertKeys(t, db, 0, 30)
+	require.NoError(t, db.merge())
+	assertKeys(t, db, 0, 30)
+}
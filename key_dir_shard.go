@@ -0,0 +1,110 @@
+package esl
+
+import (
+	"hash/maphash"
+)
+
+// keydirShards hashes keys to shards, each shard is an independent keydir with
+// its own lock, so that the readers and writers of different keys rarely contend
+// for the same lock.
+type keydirShards struct {
+	seed   maphash.Seed
+	shards []keydir
+}
+
+func newKeydirShards(n int, newShard func() keydir) *keydirShards {
+	kd := &keydirShards{
+		seed:   maphash.MakeSeed(),
+		shards: make([]keydir, n),
+	}
+	for i := range kd.shards {
+		kd.shards[i] = newShard()
+	}
+
+	return kd
+}
+
+func (kd *keydirShards) shardIndex(key []byte) int {
+	return int(maphash.Bytes(kd.seed, key) % uint64(len(kd.shards)))
+}
+
+func (kd *keydirShards) get(key []byte) (*keydirMemEntry, error) {
+	return kd.shards[kd.shardIndex(key)].get(key)
+}
+
+func (kd *keydirShards) set(key []byte, ent *keydirMemEntry) {
+	kd.shards[kd.shardIndex(key)].set(key, ent)
+}
+
+func (kd *keydirShards) del(key []byte, ent *keydirMemEntry) {
+	kd.shards[kd.shardIndex(key)].del(key, ent)
+}
+
+func (kd *keydirShards) delRange(r keyRange, ent *keydirMemEntry) {
+	for _, shard := range kd.shards {
+		shard.delRange(r, ent)
+	}
+}
+
+func (kd *keydirShards) len() int {
+	n := 0
+	for _, shard := range kd.shards {
+		n += shard.len()
+	}
+
+	return n
+}
+
+func (kd *keydirShards) rangeKeys(fn func(key []byte, ent *keydirMemEntry) bool) error {
+	stopped := false
+	for _, shard := range kd.shards {
+		err := shard.rangeKeys(func(key []byte, ent *keydirMemEntry) bool {
+			stopped = !fn(key, ent)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (kd *keydirShards) maxSeq() (uint64, error) {
+	var seq uint64
+	for _, shard := range kd.shards {
+		n, err := shard.maxSeq()
+		if err != nil {
+			return 0, err
+		}
+		seq = max(seq, n)
+	}
+
+	return seq, nil
+}
+
+func (kd *keydirShards) archived(fileId uint16) error {
+	for _, shard := range kd.shards {
+		if err := shard.archived(fileId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (kd *keydirShards) merged(activeFileId uint16, keydirs []*keydirFileEntry) error {
+	partitions := make([][]*keydirFileEntry, len(kd.shards))
+	for _, keydir := range keydirs {
+		i := kd.shardIndex(keydir.key)
+		partitions[i] = append(partitions[i], keydir)
+	}
+
+	for i, shard := range kd.shards {
+		if err := shard.merged(activeFileId, partitions[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package esl
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_keydirShards(t *testing.T) {
+	kd := newKeydirShards(8, func() keydir { return newKeyDir() })
+	for i := 0; i < 1000; i++ {
+		kd.set([]byte("key-"+strconv.Itoa(i)), &keydirMemEntry{fileId: 1, valueSize: 1, entryOffset: uint32(i)})
+	}
+	assert.Equal(t, 1000, kd.len())
+	for _, shard := range kd.shards {
+		assert.NotZero(t, shard.len())
+	}
+
+	for i := 0; i < 1000; i++ {
+		ent, err := kd.get([]byte("key-" + strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.NotNil(t, ent)
+		assert.Equal(t, uint32(i), ent.entryOffset)
+	}
+
+	count := 0
+	require.NoError(t, kd.rangeKeys(func(key []byte, ent *keydirMemEntry) bool {
+		count++
+		return count < 10
+	}))
+	assert.Equal(t, 10, count)
+
+	require.NoError(t, kd.merged(2, []*keydirFileEntry{
+		{keydirMemEntry: keydirMemEntry{fileId: 1, valueSize: 2}, keySize: 5, key: []byte("key-1")},
+		{keydirMemEntry: keydirMemEntry{fileId: 1, valueSize: 2}, keySize: 5, key: []byte("other")},
+	}))
+	ent, _ := kd.get([]byte("key-1"))
+	assert.Equal(t, uint16(2), ent.valueSize)
+	// the key not indexed has been deleted.
+	assert.Equal(t, 1000, kd.len())
+
+	kd.del([]byte("key-1"), &keydirMemEntry{fileId: 2, flags: entryFlag_tombstone})
+	ent, _ = kd.get([]byte("key-1"))
+	assert.Nil(t, ent)
+	assert.Equal(t, 999, kd.len())
+}
+
+func Test_DB_keydirShards(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for _, mode := range []IndexMode{IndexModeMemory, IndexModeCompact} {
+		path := "/tmp/esl-" + strconv.Itoa(int(mode))
+		open := func() *DB {
+			db, err := Open(path,
+				WithFileSystem(fs),
+				WithMaxFileBytes(256),
+				WithCompactThreshold(1000), // avoid auto merge
+				WithIndexMode(mode),
+				WithKeydirShards(4),
+			)
+			require.NoError(t, err)
+			return db
+		}
+
+		db := open()
+		require.IsType(t, &keydirShards{}, db.keyDir)
+		putKeys(t, db, 0, 50)
+		putKeys(t, db, 0, 10)
+		assert.Len(t, db.ListKeys(), 50)
+		require.NoError(t, db.merge())
+		assertKeys(t, db, 0, 50)
+		require.NoError(t, db.Close())
+
+		db = open()
+		assertKeys(t, db, 0, 50)
+		require.NoError(t, db.Close())
+	}
+}
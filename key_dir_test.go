@@ -12,6 +12,9 @@ func Test_decodeKeydirEntry(t *testing.T) {
 		valueSize:   10,
 		entryOffset: 10,
 		valueOffset: 20,
+		rawSize:     30,
+		flags:       codecIdSnappy,
+		seq:         1 << 40,
 	}
 	encoded := entry.bytes()
 	assert.Equal(t, keydirMem_Size, len(encoded))
@@ -24,6 +27,9 @@ func Test_decodeKeydirEntry(t *testing.T) {
 	assert.Equal(t, entry.valueSize, entry2.valueSize)
 	assert.Equal(t, entry.entryOffset, entry2.entryOffset)
 	assert.Equal(t, entry.valueOffset, entry2.valueOffset)
+	assert.Equal(t, entry.rawSize, entry2.rawSize)
+	assert.Equal(t, entry.seq, entry2.seq)
+	assert.Equal(t, codecIdSnappy, entry2.codec())
 }
 
 func Test_decodeKeydirFileEntry(t *testing.T) {
@@ -52,3 +58,36 @@ func Test_decodeKeydirFileEntry(t *testing.T) {
 	assert.Equal(t, entry.keySize, entry2.keySize)
 
 }
+
+func Test_keydirMemTable_merged(t *testing.T) {
+	kd := newKeyDir()
+	kd.set([]byte("old"), &keydirMemEntry{fileId: 1, valueSize: 1, seq: 1})
+	kd.set([]byte("new"), &keydirMemEntry{fileId: 3, valueSize: 1, seq: 5})
+	kd.set([]byte("expired"), &keydirMemEntry{fileId: 1, valueSize: 1, seq: 4})
+	kd.set([]byte("deleted"), &keydirMemEntry{fileId: 1, valueSize: 1, seq: 3})
+	kd.del([]byte("deleted"), &keydirMemEntry{fileId: 3, flags: entryFlag_tombstone, seq: 6})
+	assert.Equal(t, 3, kd.len())
+
+	// the merged entry of "new" is older than the live one, "deleted" is deleted
+	// after merge started, and "expired" is dropped by the merge process.
+	assert.NoError(t, kd.merged(3, []*keydirFileEntry{
+		{keydirMemEntry: keydirMemEntry{fileId: 2, valueSize: 2, seq: 1}, keySize: 3, key: []byte("old")},
+		{keydirMemEntry: keydirMemEntry{fileId: 2, valueSize: 2, seq: 2}, keySize: 3, key: []byte("new")},
+		{keydirMemEntry: keydirMemEntry{fileId: 2, valueSize: 2, seq: 3}, keySize: 7, key: []byte("deleted")},
+		{keydirMemEntry: keydirMemEntry{fileId: 2, flags: entryFlag_tombstone, seq: 4}, keySize: 7, key: []byte("expired")},
+	}))
+
+	ent, _ := kd.get([]byte("old"))
+	assert.Equal(t, uint16(2), ent.fileId)
+	ent, _ = kd.get([]byte("new"))
+	assert.Equal(t, uint16(3), ent.fileId)
+	ent, _ = kd.get([]byte("deleted"))
+	assert.Nil(t, ent)
+	ent, _ = kd.get([]byte("expired"))
+	assert.Nil(t, ent)
+	assert.Equal(t, 2, kd.len())
+
+	seq, err := kd.maxSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), seq)
+}
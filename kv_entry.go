@@ -10,20 +10,46 @@ import (
 	"github.com/yeqown/enchanted-sleeve/byteslice"
 )
 
+// The layout of records is versioned by formatVersion, which MUST be bumped if
+// the layout is changed.
 const (
-	kvEntry_fixedBytes     = 12
+	kvEntry_fixedBytes     = 25
 	kvEntry_tsTimestampOff = 4
-	kvEntry_keySizeOff     = kvEntry_tsTimestampOff + 4
+	kvEntry_seqOff         = kvEntry_tsTimestampOff + 8
+	kvEntry_keySizeOff     = kvEntry_seqOff + 8
 	kvEntry_valueSizeOff   = kvEntry_keySizeOff + 2
-	kvEntry_keyOff         = kvEntry_valueSizeOff + 2
+	kvEntry_flagsOff       = kvEntry_valueSizeOff + 2
+	kvEntry_keyOff         = kvEntry_flagsOff + 1
+)
+
+const (
+	// entryFlag_codecMask is the mask of codec id in flags, the value is
+	// compressed by the codec if it's not zero.
+	entryFlag_codecMask uint8 = 0x07
+	// entryFlag_bucket indicates the key is prefixed by the id of bucket, see Bucket.
+	entryFlag_bucket uint8 = 0x08
+	// entryFlag_operand indicates the value is an operand of merge operator, see
+	// MergeOperator.
+	entryFlag_operand uint8 = 0x10
+	// entryFlag_tombstone indicates the entry deletes the key, the value of it is
+	// empty unless it's a range tombstone. A value without the flag is legal even
+	// if it's empty.
+	entryFlag_tombstone uint8 = 0x20
+	// entryFlag_rangeTombstone indicates the entry deletes the keys in [key, value),
+	// the value is empty if the range has no upper bound. It's always set with
+	// entryFlag_tombstone, so that the key itself is deleted even if the range is
+	// not recognized.
+	entryFlag_rangeTombstone uint8 = 0x40
 )
 
 // kvEntry is a single key value pair in an ESL file.
 type kvEntry struct {
 	crc         uint32
-	tsTimestamp uint32 // 32 bit timestamp, internal use only
+	tsTimestamp uint64 // unix timestamp in nanoseconds, internal use only
+	seq         uint64 // sequence number, it's increasing in the order of writing.
 	keySize     uint16 // key size in bytes, max 1024 bytes
-	valueSize   uint16 // value size in bytes
+	valueSize   uint16 // value size in bytes (stored in file)
+	flags       uint8  // flags of the entry, such as codec id.
 	key         []byte
 	value       []byte
 }
@@ -33,12 +59,16 @@ type kvEntry struct {
 func _checksumEntry(ent *kvEntry) uint32 {
 	data := make([]byte, kvEntry_fixedBytes-kvEntry_tsTimestampOff+ent.keySize+ent.valueSize)
 	pos := 0
-	binary.BigEndian.PutUint32(data, ent.tsTimestamp)
-	pos += 4
+	binary.BigEndian.PutUint64(data, ent.tsTimestamp)
+	pos += 8
+	binary.BigEndian.PutUint64(data[pos:], ent.seq)
+	pos += 8
 	binary.BigEndian.PutUint16(data[pos:], ent.keySize)
 	pos += 2
 	binary.BigEndian.PutUint16(data[pos:], ent.valueSize)
 	pos += 2
+	data[pos] = ent.flags
+	pos += 1
 	copy(data[pos:], ent.key)
 	pos += int(ent.keySize)
 	copy(data[pos:], ent.value)
@@ -90,22 +120,64 @@ func (ent *kvEntry) encode(data []byte) []byte {
 
 	// binary.BigEndian.PutUint32(data, ent.crc)
 
-	binary.BigEndian.PutUint32(data[kvEntry_tsTimestampOff:], ent.tsTimestamp)
+	binary.BigEndian.PutUint64(data[kvEntry_tsTimestampOff:], ent.tsTimestamp)
+	binary.BigEndian.PutUint64(data[kvEntry_seqOff:], ent.seq)
 	binary.BigEndian.PutUint16(data[kvEntry_keySizeOff:], ent.keySize)
 	binary.BigEndian.PutUint16(data[kvEntry_valueSizeOff:], ent.valueSize)
+	data[kvEntry_flagsOff] = ent.flags
 	copy(data[kvEntry_keyOff:], ent.key)
 	copy(data[kvEntry_keyOff+ent.keySize:], ent.value)
 
-	// fill crc at last.
-	ent.crc = _checksumRaw(data[kvEntry_tsTimestampOff:])
+	// fill crc at last, data may be larger than the entry.
+	ent.crc = _checksumRaw(data[kvEntry_tsTimestampOff:n])
 	binary.BigEndian.PutUint32(data, ent.crc)
 
-	return data
+	return data[:n]
+}
+
+// timestamp returns the time when the entry was written.
+func (ent *kvEntry) timestamp() time.Time {
+	return time.Unix(0, int64(ent.tsTimestamp))
+}
+
+// codec returns the codec id which compresses the value, 0 means the value
+// is not compressed.
+func (ent *kvEntry) codec() uint8 {
+	return ent.flags & entryFlag_codecMask
 }
 
-// tombstone indicates the kvEntry contains a tombstone value.
+// rawValueSize returns the size of value before compression.
+func (ent *kvEntry) rawValueSize() (uint16, error) {
+	if ent.codec() == 0 {
+		return ent.valueSize, nil
+	}
+
+	n, err := decodedLen(ent.codec(), ent.value)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint16(n), nil
+}
+
+// plainValue returns the value before compression.
+func (ent *kvEntry) plainValue() ([]byte, error) {
+	rawSize, err := ent.rawValueSize()
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(ent.codec(), ent.value, rawSize)
+}
+
+// tombstone indicates the kvEntry deletes the key.
 func (ent *kvEntry) tombstone() bool {
-	return ent.value == nil
+	return ent.flags&entryFlag_tombstone != 0
+}
+
+// rangeTombstone indicates the kvEntry deletes the keys in [key, value).
+func (ent *kvEntry) rangeTombstone() bool {
+	return ent.flags&entryFlag_rangeTombstone != 0
 }
 
 var (
@@ -113,9 +185,10 @@ var (
 		New: func() interface{} {
 			return &kvEntry{
 				crc:         0,
-				tsTimestamp: uint32(time.Now().Unix()),
+				tsTimestamp: uint64(time.Now().UnixNano()),
 				keySize:     0,
 				valueSize:   0,
+				flags:       0,
 				key:         nil,
 				value:       nil,
 			}
@@ -127,20 +200,40 @@ func newEntry(key, value []byte) *kvEntry {
 	ent := keyEntryPool.Get().(*kvEntry)
 
 	ent.crc = 0
-	ent.tsTimestamp = uint32(time.Now().Unix())
+	ent.tsTimestamp = uint64(time.Now().UnixNano())
+	ent.seq = 0
 	ent.keySize = uint16(len(key))
 	ent.valueSize = uint16(len(value))
+	ent.flags = 0
 	ent.key = key
 	ent.value = value
 
 	return ent
 }
 
+// newTombstone creates the entry which deletes key.
+func newTombstone(key []byte) *kvEntry {
+	ent := newEntry(key, nil)
+	ent.flags = entryFlag_tombstone
+
+	return ent
+}
+
+// newRangeTombstone creates the entry which deletes the keys in r.
+func newRangeTombstone(r keyRange) *kvEntry {
+	ent := newEntry(r.start, r.end)
+	ent.flags = entryFlag_tombstone | entryFlag_rangeTombstone
+
+	return ent
+}
+
 func releaseEntry(ent *kvEntry) {
 	ent.crc = 0
 	ent.tsTimestamp = 0
+	ent.seq = 0
 	ent.keySize = 0
 	ent.valueSize = 0
+	ent.flags = 0
 	ent.key = nil
 	ent.value = nil
 
@@ -154,9 +247,11 @@ func decodeEntryFromHeader(header []byte) (*kvEntry, error) {
 
 	ent := &kvEntry{
 		crc:         binary.BigEndian.Uint32(header),
-		tsTimestamp: binary.BigEndian.Uint32(header[kvEntry_tsTimestampOff:]),
+		tsTimestamp: binary.BigEndian.Uint64(header[kvEntry_tsTimestampOff:]),
+		seq:         binary.BigEndian.Uint64(header[kvEntry_seqOff:]),
 		keySize:     binary.BigEndian.Uint16(header[kvEntry_keySizeOff:]),
 		valueSize:   binary.BigEndian.Uint16(header[kvEntry_valueSizeOff:]),
+		flags:       header[kvEntry_flagsOff],
 		key:         nil,
 		value:       nil,
 	}
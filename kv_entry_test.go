@@ -21,14 +21,15 @@ func Test_checksum(t *testing.T) {
 			args: args{
 				ent: &kvEntry{
 					crc:         0,
-					tsTimestamp: 1702878103,
+					tsTimestamp: 1702878103000000000,
+					seq:         1,
 					keySize:     5,
 					valueSize:   5,
 					key:         []byte("hello"),
 					value:       []byte("world"),
 				},
 			},
-			want: 4020150805,
+			want: 3943948004,
 		},
 	}
 	for _, tt := range tests {
@@ -58,7 +59,8 @@ func Test_checksum(t *testing.T) {
 func Test_kvEntry_bytes(t *testing.T) {
 	entry := &kvEntry{
 		crc:         0,
-		tsTimestamp: 1702878103,
+		tsTimestamp: 1702878103000000000,
+		seq:         1,
 		keySize:     5,
 		valueSize:   5,
 		key:         []byte("hello"),
@@ -67,18 +69,31 @@ func Test_kvEntry_bytes(t *testing.T) {
 
 	got := entry.encode(nil)
 	want := []byte{
-		0xef,
-		0x9e,
-		0xa2,
-		0x15,
-		0x65,
-		0x7f,
-		0xdb,
-		0x97,
+		0xeb,
+		0x13,
+		0xde,
+		0xe4,
+		0x17,
+		0xa1,
+		0xd6,
+		0x9c,
+		0xc9,
+		0x1b,
+		0x26,
+		0x0,
+		0x0,
+		0x0,
+		0x0,
+		0x0,
+		0x0,
+		0x0,
+		0x0,
+		0x1,
 		0x0,
 		0x5,
 		0x0,
 		0x5,
+		0x0,
 		0x68,
 		0x65,
 		0x6c,
@@ -101,6 +116,7 @@ func Test_kvEntry_encodeAndDecode(t *testing.T) {
 	valueSize := uint16(len(value))
 
 	entry := newEntry(key, value)
+	entry.seq = 42
 	assert.Equal(t, keySize, entry.keySize)
 	assert.Equal(t, valueSize, entry.valueSize)
 	encoded := entry.encode(nil)
@@ -115,12 +131,20 @@ func Test_kvEntry_encodeAndDecode(t *testing.T) {
 
 	assert.Equal(t, entry.crc, entry2.crc)
 	assert.Equal(t, entry.tsTimestamp, entry2.tsTimestamp)
+	assert.Equal(t, entry.seq, entry2.seq)
 	assert.Equal(t, entry.keySize, entry2.keySize)
 	assert.Equal(t, entry.valueSize, entry2.valueSize)
 	assert.Equal(t, int(entry.keySize), cap(entry2.key))
 	assert.Equal(t, int(entry.keySize), len(entry2.key))
 	assert.Equal(t, int(entry.valueSize), cap(entry2.value))
 	assert.Equal(t, int(entry.valueSize), len(entry2.value))
+
+	// encode into a larger buffer, the following bytes are not checksummed.
+	buf := make([]byte, len(encoded)+8)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	assert.Equal(t, encoded, entry.encode(buf))
 }
 
 func Test_estimateEntry(t *testing.T) {
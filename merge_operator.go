@@ -0,0 +1,469 @@
+package esl
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The operands are appended as the records flagged by entryFlag_operand, and
+// the value of operand record is formed as:
+//
+// | operator_id(1) | operand |
+//
+// The keydir locates the latest operand of key, and the operandIndex locates
+// the former operands and the base record which they are applied to. Operands
+// are folded into the value while reading, and the merge process writes the
+// folded value into the merged file.
+const (
+	counterOperatorId uint8 = 1
+
+	// maxPendingOperands is the maximum number of operands of a key which are not
+	// folded. The value is folded and written as a whole once it's reached, so
+	// reading a key never folds too many operands.
+	maxPendingOperands = 32
+)
+
+// MergeOperator folds the operands of a key into its value, such as increasing
+// a counter or appending to a list. Writing an operand is as cheap as writing a
+// record, it does not read or rewrite the whole value.
+type MergeOperator interface {
+	// ID identifies the operator in records, it must not be 0, and 1 is reserved
+	// by CounterOperator.
+	ID() uint8
+	// Merge returns the value of key after applying operands in order to existing,
+	// existing is nil if the key does not exist.
+	Merge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// CounterOperator adds the operands to the value as int64, both of them are
+// 8 bytes in big endian, see DB.Increment.
+var CounterOperator MergeOperator = counterOperator{}
+
+type counterOperator struct{}
+
+func (counterOperator) ID() uint8 { return counterOperatorId }
+
+func (counterOperator) Merge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	n, err := decodeCounter(existing)
+	if err != nil {
+		return nil, err
+	}
+	for _, operand := range operands {
+		delta, err := decodeCounter(operand)
+		if err != nil {
+			return nil, err
+		}
+		n += delta
+	}
+
+	return encodeCounter(n), nil
+}
+
+func encodeCounter(n int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(n))
+
+	return data
+}
+
+// decodeCounter decodes the counter, nil means 0.
+func decodeCounter(data []byte) (int64, error) {
+	if data == nil {
+		return 0, nil
+	}
+	if len(data) != 8 {
+		return 0, errors.Errorf("invalid counter size: %d", len(data))
+	}
+
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+// fold applies the operands to existing in order, each operand is prefixed by
+// the id of its operator.
+func (o *options) fold(key, existing []byte, operands [][]byte) ([]byte, error) {
+	value := existing
+	for i := 0; i < len(operands); {
+		if len(operands[i]) == 0 {
+			return nil, ErrEntryCorrupted
+		}
+
+		// the adjacent operands of the same operator are applied together.
+		id := operands[i][0]
+		batch := [][]byte{operands[i][1:]}
+		for i++; i < len(operands) && len(operands[i]) > 0 && operands[i][0] == id; i++ {
+			batch = append(batch, operands[i][1:])
+		}
+
+		op, ok := o.mergeOperators[id]
+		if !ok {
+			return nil, errors.Wrapf(ErrMergeOperatorNotFound, "operator id %d", id)
+		}
+		var err error
+		if value, err = op.Merge(key, value, batch); err != nil {
+			return nil, errors.Wrapf(err, "merge operands of operator %d", id)
+		}
+	}
+
+	return value, nil
+}
+
+// foldEntries folds the operand entries into base, pending is ordered from the
+// newest to the oldest, and base is nil if the operands are not applied to any
+// record. The folded entry inherits the timestamp and sequence number of the
+// newest operand.
+func foldEntries(fold foldFunc, base *kvEntry, pending []*kvEntry) (*kvEntry, error) {
+	latest := pending[0]
+	if fold == nil {
+		return nil, errors.Wrap(ErrMergeOperatorNotFound, "no merge operator")
+	}
+
+	var existing []byte
+	if base != nil && !base.tombstone() {
+		var err error
+		if existing, err = base.plainValue(); err != nil {
+			return nil, err
+		}
+	}
+	operands := make([][]byte, len(pending))
+	for i, e := range pending {
+		operands[len(pending)-1-i] = e.value
+	}
+
+	value, err := fold(latest.key, existing, operands)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > 0xFFFF {
+		return nil, errors.Wrapf(&ValueTooLargeError{Size: len(value), Limit: 0xFFFF}, "folded value of key %q", latest.key)
+	}
+
+	return &kvEntry{
+		tsTimestamp: latest.tsTimestamp,
+		seq:         latest.seq,
+		keySize:     latest.keySize,
+		valueSize:   uint16(len(value)),
+		flags:       latest.flags &^ (entryFlag_operand | entryFlag_codecMask),
+		key:         latest.key,
+		value:       value,
+	}, nil
+}
+
+type foldFunc func(key, existing []byte, operands [][]byte) ([]byte, error)
+
+// operandChain locates the operands of key which are not folded, and the record
+// which they are applied to.
+type operandChain struct {
+	// base is nil if the key does not exist before the operands.
+	base *keydirMemEntry
+	// operands are ordered from the oldest to the newest.
+	operands []*keydirMemEntry
+}
+
+// operandIndex indexes the operand chains of keys, it's updated with the keydir
+// while holding the activeLock.
+type operandIndex struct {
+	mu     sync.RWMutex
+	chains map[string]*operandChain
+}
+
+func newOperandIndex() *operandIndex {
+	return &operandIndex{
+		chains: make(map[string]*operandChain),
+	}
+}
+
+// index indexes the entry of key before it's set into keyDir, the chain of key
+// is removed if the entry is not an operand.
+func (idx *operandIndex) index(keyDir keydir, key []byte, ent *keydirMemEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !ent.operand() {
+		delete(idx.chains, string(key))
+		return
+	}
+
+	chain, ok := idx.chains[string(key)]
+	if !ok {
+		chain = &operandChain{}
+		if base, err := keyDir.get(key); err == nil && !absent(base) {
+			chain.base = base
+		}
+		idx.chains[string(key)] = chain
+	}
+	chain.operands = append(chain.operands, ent)
+}
+
+// delRange removes the chains of keys in r, the covered keys are collected while
+// holding the read lock, see keydirMemTable.delRange. It's called while holding
+// activeLock, so that no operand is appended in between.
+func (idx *operandIndex) delRange(r keyRange) {
+	idx.mu.RLock()
+	keys := make([]string, 0, 16)
+	for key := range idx.chains {
+		if r.contains(unsafeBytes(key)) {
+			keys = append(keys, key)
+		}
+	}
+	idx.mu.RUnlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, key := range keys {
+		delete(idx.chains, key)
+	}
+}
+
+// lookup returns the chain of key whose newest operand is the entry of clue, they
+// are told by sequence numbers, see DB.keyUnchanged.
+func (idx *operandIndex) lookup(key []byte, clue *keydirMemEntry) (operandChain, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	chain, ok := idx.chains[string(key)]
+	if !ok {
+		return operandChain{}, false
+	}
+	latest := chain.operands[len(chain.operands)-1]
+	if latest.seq != clue.seq {
+		return operandChain{}, false
+	}
+
+	// the operands are only appended, so the snapshot is immutable.
+	n := len(chain.operands)
+	return operandChain{base: chain.base, operands: chain.operands[:n:n]}, true
+}
+
+// pending returns the number of operands of key which are not folded.
+func (idx *operandIndex) pending(key []byte) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if chain, ok := idx.chains[string(key)]; ok {
+		return len(chain.operands)
+	}
+
+	return 0
+}
+
+// merged rebases the chains on the merged entries. The operands in merged files
+// have been folded into the merged entries, and the operands written after merge
+// started are located in the active file or newer.
+func (idx *operandIndex) merged(activeFileId uint16, keydirs []*keydirFileEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, keydir := range keydirs {
+		chain, ok := idx.chains[string(keydir.key)]
+		if !ok {
+			continue
+		}
+		if chain.operands[len(chain.operands)-1].seq <= keydir.seq {
+			delete(idx.chains, string(keydir.key))
+			continue
+		}
+
+		operands := make([]*keydirMemEntry, 0, len(chain.operands))
+		for _, ent := range chain.operands {
+			if ent.fileId >= activeFileId {
+				operands = append(operands, ent)
+			}
+		}
+		chain.base = nil
+		if !keydir.tombstone() {
+			chain.base = &keydir.keydirMemEntry
+		}
+		chain.operands = operands
+	}
+}
+
+// readOperands reads the entry of key by folding its operands, clue locates the
+// newest operand of key.
+func (db *DB) readOperands(key []byte, clue *keydirMemEntry) (*kvEntry, error) {
+	if db.opt.indexMode == IndexModeHint {
+		return nil, ErrOperandsUnsupported
+	}
+
+	chain, ok := db.operands.lookup(key, clue)
+	for !ok {
+		// the key has been written since clue was looked up.
+		var err error
+		if clue, err = db.keyDir.get(key); err != nil {
+			return nil, errors.Wrap(err, "lookup keydir failed")
+		}
+		if absent(clue) {
+			return nil, ErrKeyNotFound
+		}
+		if !clue.operand() {
+			return db.readRecord(key, clue, false)
+		}
+		chain, ok = db.operands.lookup(key, clue)
+	}
+
+	var existing []byte
+	if chain.base != nil {
+		base, err := db.readRecord(key, chain.base, false)
+		if err != nil {
+			return nil, err
+		}
+		existing = base.value
+	}
+
+	var latest *kvEntry
+	operands := make([][]byte, len(chain.operands))
+	for i, ent := range chain.operands {
+		operand, err := db.readRecord(key, ent, false)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = operand.value
+		latest = operand
+	}
+
+	value, err := db.opt.fold(key, existing, operands)
+	if err != nil {
+		return nil, err
+	}
+	return &kvEntry{
+		tsTimestamp: latest.tsTimestamp,
+		seq:         latest.seq,
+		keySize:     uint16(len(key)),
+		valueSize:   uint16(len(value)),
+		key:         key,
+		value:       value,
+	}, nil
+}
+
+// checkOperand checks whether the operand of op could be written.
+func (db *DB) checkOperand(key []byte, op MergeOperator, operand []byte) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.opt.indexMode == IndexModeHint {
+		return ErrOperandsUnsupported
+	}
+	if _, ok := db.opt.mergeOperators[op.ID()]; !ok {
+		return errors.Wrapf(ErrMergeOperatorNotFound, "operator id %d", op.ID())
+	}
+	// the operand is prefixed by the id of operator.
+	if err := db.opt.validate(key, nil); err != nil {
+		return err
+	}
+	if len(operand)+1 > int(db.opt.maxValueBytes) {
+		return &ValueTooLargeError{Size: len(operand) + 1, Limit: int(db.opt.maxValueBytes)}
+	}
+
+	return nil
+}
+
+// PutOperand appends the operand of key, which is applied to the value of key
+// by op while reading. The operator must be registered by WithMergeOperator.
+func (db *DB) PutOperand(key []byte, op MergeOperator, operand []byte) error {
+	return db.PutOperandContext(context.Background(), key, op, operand)
+}
+
+// PutOperandContext is the same as PutOperand, but it gives up waiting if ctx is done.
+func (db *DB) PutOperandContext(ctx context.Context, key []byte, op MergeOperator, operand []byte) error {
+	if err := db.checkOperand(key, op, operand); err != nil {
+		return err
+	}
+
+	if db.operands.pending(key) >= maxPendingOperands {
+		_, err := db.applyOperand(ctx, key, op, operand)
+		return err
+	}
+
+	entry := newEntry(key, append([]byte{op.ID()}, operand...))
+	entry.flags = entryFlag_operand
+	defer releaseEntry(entry)
+
+	return db.write(ctx, entry, PriorityNormal)
+}
+
+// applyOperand applies the operand to the current value of key atomically, and
+// returns the new value. The operand is appended unless there are too many
+// operands not folded, then the new value is written as a whole.
+func (db *DB) applyOperand(ctx context.Context, key []byte, op MergeOperator, operand []byte) ([]byte, error) {
+	stored := append([]byte{op.ID()}, operand...)
+	for {
+		// spin to wait for compaction finish
+		if err := waitWhile(ctx, &db.inCompaction); err != nil {
+			return nil, err
+		}
+
+		clue, err := db.keyDir.get(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "lookup keydir failed")
+		}
+		var existing []byte
+		if !absent(clue) {
+			cur, err := db.readClue(key, clue, false)
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				if db.inCompaction.Load() {
+					// the data file may be merged while reading.
+					continue
+				}
+				return nil, err
+			}
+			if err == nil {
+				existing = cur.value
+			}
+		}
+
+		value, err := db.opt.fold(key, existing, [][]byte{stored})
+		if err != nil {
+			return nil, err
+		}
+
+		entry := newEntry(key, stored)
+		entry.flags = entryFlag_operand
+		if db.operands.pending(key) >= maxPendingOperands {
+			if len(value) > int(db.opt.maxValueBytes) {
+				releaseEntry(entry)
+				return nil, &ValueTooLargeError{Size: len(value), Limit: int(db.opt.maxValueBytes)}
+			}
+			entry.value, entry.valueSize, entry.flags = value, uint16(len(value)), 0
+			if err = db.compressEntry(entry); err != nil {
+				releaseEntry(entry)
+				return nil, err
+			}
+		}
+
+		err = db.writeIf(ctx, entry, PriorityNormal, db.keyUnchanged(key, clue))
+		releaseEntry(entry)
+		if errors.Is(err, errConditionFailed) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return value, nil
+	}
+}
+
+// Increment adds delta to the counter of key atomically and returns the new value,
+// the counter is 0 if the key does not exist. The counter is stored as 8 bytes in
+// big endian, and delta is appended as an operand of CounterOperator.
+func (db *DB) Increment(key []byte, delta int64) (int64, error) {
+	return db.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is the same as Increment, but it gives up waiting if ctx is done.
+func (db *DB) IncrementContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	operand := encodeCounter(delta)
+	if err := db.checkOperand(key, CounterOperator, operand); err != nil {
+		return 0, err
+	}
+
+	value, err := db.applyOperand(ctx, key, CounterOperator, operand)
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeCounter(value)
+}
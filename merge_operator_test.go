@@ -0,0 +1,236 @@
+package esl
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appendOperator appends the operands to the value, separated by comma.
+type appendOperator struct{}
+
+func (appendOperator) ID() uint8 { return 2 }
+
+func (appendOperator) Merge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	parts := operands
+	if existing != nil {
+		parts = append([][]byte{existing}, operands...)
+	}
+
+	return bytes.Join(parts, []byte(",")), nil
+}
+
+func openOperandTestDB(t *testing.T, fs afero.Fs, options ...Option) *DB {
+	options = append(options,
+		WithFileSystem(fs),
+		WithMaxFileBytes(256),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithMergeOperator(appendOperator{}),
+	)
+	db, err := Open("/tmp/esl", options...)
+	require.NoError(t, err)
+
+	return db
+}
+
+func Test_options_fold(t *testing.T) {
+	o := defaultOptions()
+	WithMergeOperator(appendOperator{}).apply(o)
+
+	value, err := o.fold([]byte("key"), encodeCounter(1), [][]byte{
+		append([]byte{counterOperatorId}, encodeCounter(2)...),
+		append([]byte{counterOperatorId}, encodeCounter(-5)...),
+	})
+	require.NoError(t, err)
+	n, err := decodeCounter(value)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-2), n)
+
+	value, err = o.fold([]byte("key"), nil, [][]byte{{2, 'a'}, {2, 'b'}})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b"), value)
+
+	_, err = o.fold([]byte("key"), nil, [][]byte{{9, 'a'}})
+	assert.ErrorIs(t, err, ErrMergeOperatorNotFound)
+
+	assert.Panics(t, func() { WithMergeOperator(CounterOperator) })
+}
+
+func Test_DB_Increment(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db := openOperandTestDB(t, fs)
+
+	key := []byte("counter")
+	for i := 1; i <= 10; i++ {
+		n, err := db.Increment(key, 2)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2*i), n)
+	}
+	n, err := db.Increment(key, -5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), n)
+
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, encodeCounter(15), value)
+	assert.ElementsMatch(t, []Key{key}, db.ListKeys())
+
+	// the operands are not folded until there are too many of them.
+	assert.Equal(t, 11, db.operands.pending(key))
+	for i := 0; i < 2*maxPendingOperands; i++ {
+		_, err = db.Increment(key, 1)
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, db.operands.pending(key), maxPendingOperands)
+
+	// the value is not a counter.
+	require.NoError(t, db.Put([]byte("text"), []byte("text")))
+	_, err = db.Increment([]byte("text"), 1)
+	assert.Error(t, err)
+
+	// the operands are folded by the merge process, and restored after reopening.
+	require.NoError(t, db.merge())
+	n, err = db.Increment(key, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(15+2*maxPendingOperands+1), n)
+	pending := db.operands.pending(key)
+	require.NoError(t, db.Close())
+
+	db = openOperandTestDB(t, fs)
+	defer db.Close()
+	value, err = db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, encodeCounter(15+2*maxPendingOperands+1), value)
+	assert.Equal(t, pending, db.operands.pending(key))
+}
+
+func Test_DB_Increment_concurrency(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithAsyncWrite(16)}} {
+		db := openOperandTestDB(t, afero.NewMemMapFs(), options...)
+
+		key := []byte("counter")
+		wg := sync.WaitGroup{}
+		results := make(chan int64, 400)
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					n, err := db.Increment(key, 1)
+					if !assert.NoError(t, err) {
+						return
+					}
+					results <- n
+				}
+			}()
+		}
+		wg.Wait()
+		close(results)
+
+		// each increment gets a distinct value.
+		seen := make(map[int64]struct{}, 400)
+		for n := range results {
+			seen[n] = struct{}{}
+		}
+		assert.Len(t, seen, 400)
+
+		value, err := db.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, encodeCounter(400), value)
+		require.NoError(t, db.Close())
+	}
+}
+
+func Test_DB_PutOperand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db := openOperandTestDB(t, fs)
+
+	key := []byte("list")
+	require.NoError(t, db.Put(key, []byte("a")))
+	require.NoError(t, db.PutOperand(key, appendOperator{}, []byte("b")))
+	require.NoError(t, db.PutOperand(key, appendOperator{}, []byte("c")))
+
+	value, err := db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b,c"), value)
+	values, errs := db.MultiGet([][]byte{key})
+	require.NoError(t, errs[0])
+	assert.Equal(t, []byte("a,b,c"), values[0])
+
+	// the operands are applied to nothing after the key is deleted.
+	require.NoError(t, db.Delete(key))
+	require.NoError(t, db.PutOperand(key, appendOperator{}, []byte("d")))
+	value, err = db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("d"), value)
+
+	// the operands written after merge started are kept.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.PutOperand(key, appendOperator{}, []byte{'0' + byte(i)}))
+	}
+	db.activeLock.Lock()
+	require.NoError(t, db.archive())
+	db.activeLock.Unlock()
+	require.NoError(t, db.PutOperand(key, appendOperator{}, []byte("e")))
+	require.NoError(t, db.merge())
+	assert.Equal(t, 1, db.operands.pending(key))
+
+	want := []byte("d,0,1,2,3,4,5,6,7,8,9,e")
+	value, err = db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, want, value)
+	require.NoError(t, db.Close())
+
+	db = openOperandTestDB(t, fs)
+	value, err = db.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, want, value)
+	require.NoError(t, db.Close())
+
+	// the operator must be registered to read the operands.
+	db, err = Open("/tmp/esl", WithFileSystem(fs), WithCompactThreshold(1000))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get(key)
+	assert.ErrorIs(t, err, ErrMergeOperatorNotFound)
+	assert.ErrorIs(t, db.PutOperand(key, appendOperator{}, []byte("f")), ErrMergeOperatorNotFound)
+}
+
+func Test_operandIndex_lookup(t *testing.T) {
+	db := openOperandTestDB(t, afero.NewMemMapFs())
+	defer db.Close()
+
+	key := []byte("list")
+	require.NoError(t, db.PutOperand(key, appendOperator{}, []byte("a")))
+	clue, err := db.keyDir.get(key)
+	require.NoError(t, err)
+
+	chain, ok := db.operands.lookup(key, clue)
+	require.True(t, ok)
+	assert.Len(t, chain.operands, 1)
+
+	// the operand moved by merge is the same one.
+	moved := *clue
+	moved.fileId, moved.entryOffset = moved.fileId+1, 0
+	_, ok = db.operands.lookup(key, &moved)
+	assert.True(t, ok)
+
+	// the older operand at the same location is not.
+	old := *clue
+	old.seq--
+	_, ok = db.operands.lookup(key, &old)
+	assert.False(t, ok)
+}
+
+func Test_DB_PutOperand_unsupported(t *testing.T) {
+	db := openOperandTestDB(t, afero.NewMemMapFs(), WithIndexMode(IndexModeHint))
+	defer db.Close()
+
+	_, err := db.Increment([]byte("counter"), 1)
+	assert.ErrorIs(t, err, ErrOperandsUnsupported)
+	assert.ErrorIs(t, db.PutOperand([]byte("list"), appendOperator{}, []byte("a")), ErrOperandsUnsupported)
+}
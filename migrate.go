@@ -0,0 +1,170 @@
+package esl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// legacyEntry_fixedBytes is the size of record header of format version 1,
+// which has no format header at the beginning of files:
+//
+// | crc(4) | tstamp(4) | key_sz(2) | value_sz(2) | key | value |
+//
+// The timestamp is in seconds, and the record is a tombstone if value is empty.
+const legacyEntry_fixedBytes = 12
+
+// Migrate converts the data files written by format version 1 in path into the
+// current format in place, so that path could be opened by Open. The records
+// keep their timestamps, and they are numbered in the order of writing. The hint
+// files of version 1 are removed, they are rebuilt by the next merge process.
+// The DB of path MUST NOT be opened while migrating.
+//
+// The data files are converted from the oldest to the newest, and each one is
+// replaced by renaming, so that Migrate could be called again if it's
+// interrupted. The data files in the current format are left as they are.
+func Migrate(path string, options ...Option) error {
+	dbOpts := defaultOptions()
+	for _, opt := range options {
+		opt.apply(dbOpts)
+	}
+	fs := dbOpts.fs
+
+	snap, err := takeDBPathSnap(fs, path)
+	if err != nil {
+		return errors.Wrap(err, "Migrate takeDBPathSnap")
+	}
+
+	var seq uint64
+	for _, filename := range snap.dataFiles {
+		fileId, err := fileIdFromFilename(filename)
+		if err != nil {
+			return errors.Wrap(err, "Migrate "+filename)
+		}
+		legacy, err := isLegacyFile(fs, filename)
+		if err != nil {
+			return errors.Wrap(err, "Migrate "+filename)
+		}
+		if !legacy {
+			// the file has been migrated before interrupted.
+			err = scanDataFile(fs, dbOpts.encryption(), filename, fileId, 0, -1, nil,
+				func(entry *kvEntry, _ *keydirMemEntry) error {
+					seq = max(seq, entry.seq)
+					return nil
+				})
+			if err != nil {
+				return errors.Wrap(err, "Migrate scan "+filename)
+			}
+			continue
+		}
+
+		if seq, err = migrateDataFile(fs, path, fileId, seq); err != nil {
+			return errors.Wrap(err, "Migrate "+filename)
+		}
+	}
+
+	return nil
+}
+
+// isLegacyFile reports whether the file is written by format version 1, an empty
+// file is not.
+func isLegacyFile(fs FileSystem, filename string) (bool, error) {
+	fd, err := fs.OpenFile(filename, os.O_RDONLY, 0666)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = fd.Close() }()
+
+	magic := make([]byte, len(formatMagic))
+	n, err := fd.ReadAt(magic, 0)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	// a legacy file could be shorter than magic if it's torn.
+	return n < len(magic) || string(magic) != formatMagic, nil
+}
+
+// migrateDataFile rewrites the legacy data file fileId in the current format,
+// the records are numbered after seq, and the last sequence number is returned.
+// The torn record at the tail is dropped.
+func migrateDataFile(fs FileSystem, path string, fileId uint16, seq uint64) (_ uint64, err error) {
+	filename := dataFilename(path, fileId)
+	data, err := afero.ReadFile(fs, filename)
+	if err != nil {
+		return seq, err
+	}
+
+	tmpFilename := filename + ".migrating"
+	fd, err := fs.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return seq, err
+	}
+	defer func() {
+		if err != nil {
+			_ = fd.Close()
+			_ = fs.Remove(tmpFilename)
+		}
+	}()
+
+	w := bufio.NewWriter(fd)
+	if _, err = w.Write(formatHeader(0)); err != nil {
+		return seq, err
+	}
+	for off := 0; off+legacyEntry_fixedBytes <= len(data); {
+		header := data[off : off+legacyEntry_fixedBytes]
+		keySize := int(binary.BigEndian.Uint16(header[8:]))
+		valueSize := int(binary.BigEndian.Uint16(header[10:]))
+		end := off + legacyEntry_fixedBytes + keySize + valueSize
+		if end > len(data) {
+			break
+		}
+		if crc32.ChecksumIEEE(data[off+4:end]) != binary.BigEndian.Uint32(header) {
+			return seq, errors.Wrapf(ErrEntryCorrupted, "checksum mismatch at %d", off)
+		}
+
+		key := data[off+legacyEntry_fixedBytes : off+legacyEntry_fixedBytes+keySize]
+		var entry *kvEntry
+		if valueSize == 0 {
+			entry = newTombstone(key)
+		} else {
+			entry = newEntry(key, data[end-valueSize:end])
+		}
+		seq++
+		entry.seq = seq
+		entry.tsTimestamp = uint64(binary.BigEndian.Uint32(header[4:])) * uint64(time.Second)
+		_, err = entry.write(w)
+		releaseEntry(entry)
+		if err != nil {
+			return seq, err
+		}
+		off = end
+	}
+
+	if err = w.Flush(); err != nil {
+		return seq, err
+	}
+	if err = fd.Sync(); err != nil {
+		return seq, err
+	}
+	if err = fd.Close(); err != nil {
+		return seq, err
+	}
+
+	// the legacy hint file is removed first, since it could not be read along
+	// with the migrated data file.
+	if err = fs.Remove(hintFilename(path, fileId)); err != nil && !os.IsNotExist(err) {
+		return seq, err
+	}
+
+	return seq, fs.Rename(tmpFilename, filename)
+}
@@ -0,0 +1,86 @@
+package esl
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyRecord encodes the record of format version 1.
+func legacyRecord(key, value string, tstamp uint32) []byte {
+	data := make([]byte, legacyEntry_fixedBytes+len(key)+len(value))
+	binary.BigEndian.PutUint32(data[4:], tstamp)
+	binary.BigEndian.PutUint16(data[8:], uint16(len(key)))
+	binary.BigEndian.PutUint16(data[10:], uint16(len(value)))
+	copy(data[legacyEntry_fixedBytes:], key)
+	copy(data[legacyEntry_fixedBytes+len(key):], value)
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+
+	return data
+}
+
+func Test_Migrate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/tmp/esl"
+
+	var file1, file2 []byte
+	file1 = append(file1, legacyRecord("key-1", "value-1", 100)...)
+	file1 = append(file1, legacyRecord("key-2", "value-2", 101)...)
+	file2 = append(file2, legacyRecord("key-1", "value-1-new", 102)...)
+	file2 = append(file2, legacyRecord("key-2", "", 103)...)
+	// the torn record at the tail is dropped.
+	file2 = append(file2, legacyRecord("key-3", "value-3", 104)[:legacyEntry_fixedBytes+2]...)
+	require.NoError(t, afero.WriteFile(fs, dataFilename(path, 1), file1, 0644))
+	require.NoError(t, afero.WriteFile(fs, hintFilename(path, 1), []byte("legacy hint"), 0644))
+	require.NoError(t, afero.WriteFile(fs, dataFilename(path, 2), file2, 0644))
+
+	_, err := Open(path, WithFileSystem(fs))
+	require.ErrorIs(t, err, ErrIncompatibleFormat)
+
+	require.NoError(t, Migrate(path, WithFileSystem(fs)))
+	exists, err := afero.Exists(fs, hintFilename(path, 1))
+	require.NoError(t, err)
+	assert.False(t, exists)
+	// migrate again is a no-op.
+	require.NoError(t, Migrate(path, WithFileSystem(fs)))
+
+	db, err := Open(path, WithFileSystem(fs))
+	require.NoError(t, err)
+	defer db.Close()
+
+	value, meta, err := db.GetWithMeta([]byte("key-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "value-1-new", string(value))
+	assert.Equal(t, uint64(3), meta.Seq)
+	assert.Equal(t, time.Unix(102, 0), meta.Timestamp)
+	_, err = db.Get([]byte("key-2"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = db.Get([]byte("key-3"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// the new writes are numbered after the migrated records.
+	require.NoError(t, db.Put([]byte("key-2"), []byte("value-2-new")))
+	_, meta, err = db.GetWithMeta([]byte("key-2"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), meta.Seq)
+}
+
+func Test_Migrate_corrupted(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/tmp/esl"
+
+	record := legacyRecord("key", "value", 100)
+	record[len(record)-1] ^= 0xFF
+	require.NoError(t, afero.WriteFile(fs, dataFilename(path, 1), record, 0644))
+
+	assert.ErrorIs(t, Migrate(path, WithFileSystem(fs)), ErrEntryCorrupted)
+	// the legacy file is kept.
+	data, err := afero.ReadFile(fs, dataFilename(path, 1))
+	require.NoError(t, err)
+	assert.Equal(t, record, data)
+}
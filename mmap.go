@@ -0,0 +1,175 @@
+package esl
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// mmapFile is the read-only mapping of an immutable data file. It's reference
+// counted, the mapping is unmapped after the last reference is released, so
+// that the borrowed slices are valid even if the data file has been removed by
+// merge process.
+type mmapFile struct {
+	data   []byte
+	cipher *fileCipher
+	refs   atomic.Int32
+	// report reports the error of unmapping, since the last reference may be
+	// released by a reader which has no error to return. It could be nil.
+	report func(err error)
+}
+
+// ReadAt implements io.ReaderAt by copying from the mapping.
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// slice returns the borrowed bytes in [off, off+n), it's nil if out of range.
+func (m *mmapFile) slice(off uint32, n uint16) []byte {
+	end := uint64(off) + uint64(n)
+	if end > uint64(len(m.data)) {
+		return nil
+	}
+
+	return m.data[off:end:end]
+}
+
+func (m *mmapFile) acquire() {
+	m.refs.Add(1)
+}
+
+func (m *mmapFile) release() {
+	if m.refs.Add(-1) == 0 && m.data != nil {
+		if err := munmap(m.data); err != nil && m.report != nil {
+			m.report(errors.Wrap(err, "munmap data file failed"))
+		}
+		m.data = nil
+	}
+}
+
+// mmapCache keeps the mappings of immutable data files, each file is mapped once
+// and shared by readers.
+type mmapCache struct {
+	fs   FileSystem
+	enc  *encryption
+	path string
+	// report reports the errors those could not be returned, see mmapFile.
+	report func(err error)
+
+	mu    sync.Mutex
+	files map[uint16]*mmapFile
+}
+
+func newMmapCache(fs FileSystem, enc *encryption, path string, report func(err error)) *mmapCache {
+	return &mmapCache{
+		fs:     fs,
+		enc:    enc,
+		path:   path,
+		report: report,
+		files:  make(map[uint16]*mmapFile, 16),
+	}
+}
+
+// acquire returns the mapping of data file fileId, the caller must release it
+// after reading.
+func (mc *mmapCache) acquire(fileId uint16) (*mmapFile, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if m, ok := mc.files[fileId]; ok {
+		m.acquire()
+		return m, nil
+	}
+
+	m, err := mc.mmap(fileId)
+	if err != nil {
+		return nil, err
+	}
+	// one reference is held by the cache until it's retired.
+	m.refs.Store(2)
+	mc.files[fileId] = m
+
+	return m, nil
+}
+
+func (mc *mmapCache) mmap(fileId uint16) (*mmapFile, error) {
+	fd, err := mc.fs.OpenFile(dataFilename(mc.path, fileId), os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	defer func() { _ = fd.Close() }()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "read file stat failed")
+	}
+
+	m := &mmapFile{report: mc.report}
+	if st.Size() > 0 {
+		if m.data, err = mmap(fd, int(st.Size())); err != nil {
+			return nil, errors.Wrap(err, "mmap data file failed")
+		}
+	}
+	if m.cipher, err = readFileHeader(m, mc.enc); err != nil {
+		if m.data != nil {
+			_ = munmap(m.data)
+		}
+		return nil, errors.Wrap(err, "read file cipher failed")
+	}
+
+	return m, nil
+}
+
+// retire drops the mappings of data files those id is less than fileId, they
+// are unmapped after the in-flight readers release them. It's called after the
+// data files are rewritten by merge process.
+func (mc *mmapCache) retire(fileId uint16) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for id, m := range mc.files {
+		if id < fileId {
+			delete(mc.files, id)
+			m.release()
+		}
+	}
+}
+
+// close drops all mappings.
+func (mc *mmapCache) close() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for id, m := range mc.files {
+		delete(mc.files, id)
+		m.release()
+	}
+}
+
+// canMmap reports whether the data files of fs could be mapped.
+func canMmap(fs FileSystem) bool {
+	return mmapSupported && isOsFs(fs)
+}
+
+// mmap maps the file of afero.OsFs.
+func mmap(fd afero.File, size int) ([]byte, error) {
+	f, ok := fd.(*os.File)
+	if !ok {
+		return nil, errors.New("not an os file")
+	}
+
+	return mmapOsFile(f, size)
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package esl
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mmapSupported is false, so that the data files are read by ReadAt.
+const mmapSupported = false
+
+func mmapOsFile(*os.File, int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmap([]byte) error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package esl
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_mmapFile_ReadAt(t *testing.T) {
+	m := &mmapFile{data: []byte("hello world")}
+
+	buf := make([]byte, 5)
+	n, err := m.ReadAt(buf, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "world", string(buf))
+
+	n, err = m.ReadAt(buf, 8)
+	assert.Error(t, err)
+	assert.Equal(t, 3, n)
+
+	assert.Equal(t, "hello", string(m.slice(0, 5)))
+	assert.Nil(t, m.slice(8, 5))
+}
+
+func Test_mmapFile_release(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported")
+	}
+
+	// the data is not mapped, so munmap fails and the error is reported.
+	var reported error
+	m := &mmapFile{data: []byte("hello world"), report: func(err error) { reported = err }}
+	m.acquire()
+	m.release()
+	assert.Error(t, reported)
+	assert.Nil(t, m.data)
+}
+
+func Test_DB_mmapReads(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported")
+	}
+
+	path := t.TempDir()
+	db, err := Open(path,
+		WithMaxFileBytes(256),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithMmapReads(),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NotNil(t, db.mmaps)
+
+	putKeys(t, db, 0, 30)
+	putKeys(t, db, 0, 10)
+	assertKeys(t, db, 0, 30)
+	assert.NotEmpty(t, db.mmaps.files)
+
+	// the view of immutable data file is borrowed from the mapping.
+	view, release, err := db.GetView([]byte("key-15"))
+	require.NoError(t, err)
+	assert.Equal(t, "value-15", string(view))
+	clue, err := db.keyDir.get([]byte("key-15"))
+	require.NoError(t, err)
+	m := db.mmaps.files[clue.fileId]
+	require.NotNil(t, m)
+	assert.Same(t, &m.data[clue.valueOffset], &view[0])
+
+	// the mapping is kept until the view is released even if the data file has
+	// been merged.
+	require.NoError(t, db.merge())
+	assert.Empty(t, db.mmaps.files)
+	assert.Equal(t, "value-15", string(view))
+	release()
+	assert.Nil(t, m.data)
+	assertKeys(t, db, 0, 30)
+
+	// the view of active data file is copied.
+	require.NoError(t, db.Put([]byte("active"), []byte("value")))
+	view, release, err = db.GetView([]byte("active"))
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(view))
+	release()
+
+	_, release, err = db.GetView([]byte("absent"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	release()
+}
+
+func Test_DB_mmapReads_encryption(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported")
+	}
+
+	db, err := Open(t.TempDir(),
+		WithMaxFileBytes(256),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithMmapReads(),
+		WithEncryption(testKeyRing(1)),
+		WithCompression(CodecSnappy),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	putKeys(t, db, 0, 30)
+	require.NoError(t, db.Put([]byte("large"), compressibleValue(1)))
+	putKeys(t, db, 30, 40)
+	assertKeys(t, db, 0, 40)
+
+	view, release, err := db.GetView([]byte("large"))
+	require.NoError(t, err)
+	assert.Equal(t, compressibleValue(1), view)
+	release()
+}
+
+func Test_DB_mmapReads_fallback(t *testing.T) {
+	db, err := Open("/tmp/esl",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(256),
+		WithMmapReads(),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Nil(t, db.mmaps)
+
+	putKeys(t, db, 0, 30)
+	assertKeys(t, db, 0, 30)
+	view, release, err := db.GetView([]byte("key-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "value-1", string(view))
+	release()
+}
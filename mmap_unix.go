@@ -0,0 +1,18 @@
+//go:build unix
+
+package esl
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+func mmapOsFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
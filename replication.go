@@ -0,0 +1,392 @@
+package esl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The replication protocol is quite simple, the replica connects to the primary
+// and sends a handshake with its head position (active file id, offset and the
+// generation of active file), then the primary streams the records since the
+// position as frames:
+//
+// handshake: | magic(4) | file_id(2) | offset(4) | generation(8) |
+// record:    | frameRecord(1) | file_id(2) | offset(4) | generation(8) | size(4) | record |
+// error:     | frameError(1)  | code(1) | size(2) | message |
+//
+// Records are written into the replica's data files at the same position as the
+// primary, and the data files of replica are stamped with the same generations,
+// so the active data file of replica is always the same as primary's. If the data
+// file of the replica's position has been rewritten by merge process of primary,
+// the position is lost, since the tombstones may have been dropped, and the
+// replica should be restored from a backup of primary.
+//
+// Records are sent in plaintext even if the encryption is enabled, the replica
+// encrypts them by its own keys, so the connection between primary and replica
+// must be protected by the network, for example, a private network or a tunnel.
+// The replica must enable or disable the encryption as the primary does to keep
+// the same positions.
+const (
+	replicationMagic = "ESLR"
+
+	replicationHandshakeSize   = 4 + 2 + 4 + 8
+	replicationRecordFrameSize = 2 + 4 + 8 + 4
+
+	frameRecord byte = 1
+	frameError  byte = 2
+
+	errorCodeUnknown      byte = 0
+	errorCodePositionLost byte = 1
+
+	replicaRetryInterval = time.Second
+)
+
+// ServeReplication accepts replicas from ln and streams records to them. It
+// blocks until ln is closed, and the error from ln.Accept would be returned.
+// The errors of each replica are reported by WithOnError.
+//
+// NOTE: records are sent in plaintext even if the encryption is enabled.
+func (db *DB) ServeReplication(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go db.serveReplica(conn)
+	}
+}
+
+func (db *DB) serveReplica(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	pos, err := readHandshake(conn)
+	if err != nil {
+		db.opt.hooks.reportError(errors.Wrapf(err, "replication: read handshake from %s", conn.RemoteAddr()))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := db.subscribe(ctx, nil, &pos, true)
+	if err != nil {
+		_ = writeErrorFrame(conn, errors.Wrap(ErrReplicationPositionLost, err.Error()))
+		return
+	}
+
+	// replica never sends anything after handshake, so any read returns means
+	// the connection is broken.
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		cancel()
+	}()
+
+	bw := bufio.NewWriter(conn)
+	for ev := range w.out {
+		if err = writeRecordFrame(bw, ev); err != nil {
+			return
+		}
+		// flush while there is no more pending events.
+		if len(w.out) == 0 {
+			if err = bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	if w.err != nil {
+		_ = bw.Flush()
+		_ = writeErrorFrame(conn, errors.Wrap(ErrReplicationPositionLost, w.err.Error()))
+	}
+}
+
+func writeHandshake(w io.Writer, pos Position) error {
+	buf := make([]byte, replicationHandshakeSize)
+	copy(buf, replicationMagic)
+	binary.BigEndian.PutUint16(buf[4:], pos.FileId)
+	binary.BigEndian.PutUint32(buf[6:], pos.Offset)
+	binary.BigEndian.PutUint64(buf[10:], pos.Generation)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHandshake(r io.Reader) (Position, error) {
+	buf := make([]byte, replicationHandshakeSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Position{}, err
+	}
+	if string(buf[:4]) != replicationMagic {
+		return Position{}, errors.New("invalid replication magic")
+	}
+
+	return Position{
+		FileId:     binary.BigEndian.Uint16(buf[4:]),
+		Offset:     binary.BigEndian.Uint32(buf[6:]),
+		Generation: binary.BigEndian.Uint64(buf[10:]),
+	}, nil
+}
+
+// writeRecordFrame writes the record of event as a frame, the record is not
+// encrypted, replica encrypts it by its own keys if the encryption is enabled.
+func writeRecordFrame(w io.Writer, ev *ChangeEvent) error {
+	record := ev.entry().encode(nil)
+	header := make([]byte, 1+replicationRecordFrameSize)
+	header[0] = frameRecord
+	binary.BigEndian.PutUint16(header[1:], ev.Position.FileId)
+	binary.BigEndian.PutUint32(header[3:], ev.Position.Offset)
+	binary.BigEndian.PutUint64(header[7:], ev.Position.Generation)
+	binary.BigEndian.PutUint32(header[15:], uint32(len(record)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
+
+func writeErrorFrame(w io.Writer, cause error) error {
+	code := errorCodeUnknown
+	if errors.Is(cause, ErrReplicationPositionLost) {
+		code = errorCodePositionLost
+	}
+
+	msg := cause.Error()
+	if len(msg) > 0xFFFF {
+		msg = msg[:0xFFFF]
+	}
+
+	buf := make([]byte, 4+len(msg))
+	buf[0] = frameError
+	buf[1] = code
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(msg)))
+	copy(buf[4:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a record frame, if the primary sends an error frame, the
+// error would be returned. The record larger than maxSize is refused before
+// it's read.
+func readFrame(r io.Reader, maxSize uint32) (Position, *kvEntry, error) {
+	typ := make([]byte, 1)
+	if _, err := io.ReadFull(r, typ); err != nil {
+		return Position{}, nil, err
+	}
+
+	switch typ[0] {
+	case frameRecord:
+	case frameError:
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return Position{}, nil, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(header[1:]))
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return Position{}, nil, err
+		}
+		if header[0] == errorCodePositionLost {
+			return Position{}, nil, errors.Wrap(ErrReplicationPositionLost, string(msg))
+		}
+		return Position{}, nil, errors.New(string(msg))
+	default:
+		return Position{}, nil, errors.Errorf("unknown frame type: %d", typ[0])
+	}
+
+	header := make([]byte, replicationRecordFrameSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Position{}, nil, err
+	}
+	pos := Position{
+		FileId:     binary.BigEndian.Uint16(header),
+		Offset:     binary.BigEndian.Uint32(header[2:]),
+		Generation: binary.BigEndian.Uint64(header[6:]),
+	}
+	size := binary.BigEndian.Uint32(header[14:])
+	if size < kvEntry_fixedBytes {
+		return Position{}, nil, ErrInvalidEntryHeader
+	}
+	if size > maxSize {
+		return Position{}, nil, errors.Wrapf(ErrInvalidEntryHeader, "record size %d exceeds %d", size, maxSize)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return Position{}, nil, err
+	}
+
+	entry, err := decodeEntryFromHeader(record[:kvEntry_fixedBytes])
+	if err != nil {
+		return Position{}, nil, err
+	}
+	if uint32(kvEntry_fixedBytes)+uint32(entry.keySize)+uint32(entry.valueSize) != size {
+		return Position{}, nil, ErrInvalidEntryHeader
+	}
+	copy(entry.key, record[kvEntry_fixedBytes:])
+	copy(entry.value, record[kvEntry_fixedBytes+uint32(entry.keySize):])
+	if !entry.validateChecksum() {
+		return Position{}, nil, ErrEntryCorrupted
+	}
+
+	return pos, entry, nil
+}
+
+// replica tails the primary and applies records into the DB.
+type replica struct {
+	addr string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// OpenReplica opens the DB in read-only mode and starts tailing the primary
+// listening on primaryAddr. The replica keeps reconnecting to the primary until
+// it's promoted by Promote or closed. The replica never merges data files until
+// it's promoted.
+//
+// If the position of replica is lost, for example, the data file has been
+// rewritten by merge process of primary, the replica stops tailing and the error
+// wrapping ErrReplicationPositionLost is reported by WithOnError, the replica
+// should be restored from a backup of primary, see BackupToDir.
+func OpenReplica(path, primaryAddr string, options ...Option) (*DB, error) {
+	options = append(options, WithReadOnly())
+	db, err := Open(path, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replica{
+		addr: primaryAddr,
+		stop: make(chan struct{}),
+	}
+	db.replica = r
+
+	r.wg.Add(1)
+	go db.startReplicaRoutine(r)
+
+	return db, nil
+}
+
+// Promote stops tailing the primary and makes the replica writable, so it
+// could be used as the primary.
+func (db *DB) Promote() error {
+	db.stopReplica()
+	db.readOnly.Store(false)
+
+	return nil
+}
+
+func (db *DB) stopReplica() {
+	r := db.replica
+	if r == nil {
+		return
+	}
+
+	r.stopOnce.Do(func() { close(r.stop) })
+
+	r.mu.Lock()
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+func (db *DB) startReplicaRoutine(r *replica) {
+	defer r.wg.Done()
+
+	for {
+		err := db.tail(r)
+		if errors.Is(err, ErrReplicationPositionLost) {
+			db.opt.hooks.reportError(errors.Wrap(err, "replication stopped"))
+			return
+		}
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// tail connects to the primary and applies records until the connection is broken.
+func (db *DB) tail(r *replica) error {
+	conn, err := net.Dial("tcp", r.addr)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+		r.mu.Unlock()
+		_ = conn.Close()
+		return nil
+	default:
+	}
+	r.conn = conn
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.conn = nil
+		r.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	db.activeLock.RLock()
+	head := db.head()
+	db.activeLock.RUnlock()
+
+	if err = writeHandshake(conn, head); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	for {
+		pos, entry, err := readFrame(br, db.opt.maxRecordBytes())
+		if err != nil {
+			return errors.Wrap(err, "read frame")
+		}
+
+		if err = db.applyReplicated(pos, entry); err != nil {
+			return err
+		}
+	}
+}
+
+// applyReplicated writes the entry at pos of the data files, the active data
+// file would be archived until it's the same as pos.FileId, and the new data
+// files are stamped with the generation of primary's.
+func (db *DB) applyReplicated(pos Position, e *kvEntry) error {
+	db.activeLock.Lock()
+	defer db.activeLock.Unlock()
+
+	for db.activeFileId < pos.FileId {
+		if err := db.archiveAs(pos.Generation); err != nil {
+			return errors.Wrap(err, "db archive failed")
+		}
+	}
+
+	if pos.FileId != db.activeFileId || pos.Offset != db.activeDataFileOff || pos.Generation != db.activeGeneration {
+		return errors.Wrapf(ErrReplicationPositionLost, "record(%d, %d, %d) mismatches the head(%d, %d, %d)",
+			pos.FileId, pos.Offset, pos.Generation, db.activeFileId, db.activeDataFileOff, db.activeGeneration)
+	}
+
+	return db.appendEntry(e)
+}
@@ -0,0 +1,219 @@
+package esl
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startPrimary(t *testing.T, db *DB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = db.ServeReplication(ln)
+	}()
+
+	return ln
+}
+
+func waitReplicaHead(t *testing.T, primary, replica *DB) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		primary.activeLock.RLock()
+		want := Position{FileId: primary.activeFileId, Offset: primary.activeDataFileOff}
+		empty := primary.activeCipher.headerSize()
+		primary.activeLock.RUnlock()
+
+		replica.activeLock.RLock()
+		got := Position{FileId: replica.activeFileId, Offset: replica.activeDataFileOff}
+		replica.activeLock.RUnlock()
+
+		if want == got {
+			return
+		}
+		// primary has archived the active file, but no record is written into
+		// the new active file yet, so replica is still at the end of the last file.
+		if want.Offset == empty && got.FileId+1 == want.FileId {
+			info, err := primary.filesystem().Stat(dataFilename(primary.path, got.FileId))
+			if err == nil && info.Size() == int64(got.Offset) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.FailNow(t, "replica could not catch up primary")
+}
+
+func Test_Replication(t *testing.T) {
+	primary, err := Open(
+		"/tmp/esl-primary",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer primary.Close()
+
+	ln := startPrimary(t, primary)
+	defer ln.Close()
+
+	// records those are committed before replica starts.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, primary.Put([]byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i))))
+	}
+
+	replicaFs := afero.NewMemMapFs()
+	replica, err := OpenReplica("/tmp/esl-replica", ln.Addr().String(), WithFileSystem(replicaFs))
+	require.NoError(t, err)
+	defer replica.Close()
+
+	waitReplicaHead(t, primary, replica)
+
+	// records those are committed after replica starts.
+	for i := 20; i < 30; i++ {
+		require.NoError(t, primary.Put([]byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i))))
+	}
+	require.NoError(t, primary.Delete([]byte("key-0")))
+
+	waitReplicaHead(t, primary, replica)
+
+	for i := 1; i < 30; i++ {
+		value, err := replica.Get([]byte("key-" + strconv.Itoa(i)))
+		require.NoError(t, err)
+		assert.Equal(t, "value-"+strconv.Itoa(i), string(value))
+	}
+	_, err = replica.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// data files of replica should be the same as primary's.
+	snap, err := takeDBPathSnap(replicaFs, "/tmp/esl-replica")
+	require.NoError(t, err)
+	assert.Equal(t, primary.activeFileId, snap.lastDataFileId)
+
+	// replica is read-only until promoted.
+	assert.ErrorIs(t, replica.Put([]byte("key"), []byte("value")), ErrReadOnly)
+	assert.ErrorIs(t, replica.Delete([]byte("key-1")), ErrReadOnly)
+
+	require.NoError(t, replica.Promote())
+	require.NoError(t, replica.Put([]byte("key"), []byte("value")))
+	value, err := replica.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func Test_Replication_positionLost(t *testing.T) {
+	primary, err := Open("/tmp/esl-primary", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer primary.Close()
+
+	ln := startPrimary(t, primary)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// replica is ahead of primary.
+	require.NoError(t, writeHandshake(conn, Position{FileId: 10, Offset: 100}))
+	_, _, err = readFrame(conn, defaultOptions().maxRecordBytes())
+	assert.ErrorIs(t, err, ErrReplicationPositionLost)
+}
+
+func Test_Replication_merged(t *testing.T) {
+	primary, err := Open(
+		"/tmp/esl-primary",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer primary.Close()
+
+	ln := startPrimary(t, primary)
+	defer ln.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, primary.Put([]byte("key-"+strconv.Itoa(i)), []byte("value")))
+	}
+
+	replicaFs := afero.NewMemMapFs()
+	replica, err := OpenReplica("/tmp/esl-replica", ln.Addr().String(), WithFileSystem(replicaFs))
+	require.NoError(t, err)
+	waitReplicaHead(t, primary, replica)
+	// the replica never merges its data files.
+	assert.ErrorIs(t, replica.MergeContext(context.Background()), ErrReadOnly)
+	require.NoError(t, replica.Close())
+
+	// the data file of replica's position is rewritten by primary, and the
+	// tombstone of key-0 is dropped.
+	require.NoError(t, primary.Delete([]byte("key-0")))
+	for i := 10; i < 20; i++ {
+		require.NoError(t, primary.Put([]byte("key-"+strconv.Itoa(i)), []byte("value")))
+	}
+	require.NoError(t, primary.MergeContext(context.Background()))
+
+	lost := make(chan error, 1)
+	replica, err = OpenReplica("/tmp/esl-replica", ln.Addr().String(), WithFileSystem(replicaFs),
+		WithOnError(func(err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		}))
+	require.NoError(t, err)
+	defer replica.Close()
+
+	select {
+	case err = <-lost:
+		assert.ErrorIs(t, err, ErrReplicationPositionLost)
+	case <-time.After(3 * time.Second):
+		require.FailNow(t, "position lost is not reported")
+	}
+	// nothing is applied from the merged files.
+	value, err := replica.Get([]byte("key-0"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func Test_readFrame(t *testing.T) {
+	entry := newEntry([]byte("key"), []byte("value"))
+	keydir := &keydirMemEntry{
+		fileId:      3,
+		valueSize:   entry.valueSize,
+		entryOffset: 128,
+		valueOffset: 128 + kvEntry_fixedBytes + uint32(entry.keySize),
+	}
+	ev, err := newChangeEvent(entry, keydir, 5, true)
+	require.NoError(t, err)
+	releaseEntry(entry)
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, writeRecordFrame(buf, ev))
+
+	pos, got, err := readFrame(buf, defaultOptions().maxRecordBytes())
+	require.NoError(t, err)
+	assert.Equal(t, Position{FileId: 3, Offset: 128, Generation: 5}, pos)
+	assert.Equal(t, []byte("key"), got.key)
+	assert.Equal(t, []byte("value"), got.value)
+	assert.Equal(t, ev.tsTimestamp, got.tsTimestamp)
+
+	buf.Reset()
+	require.NoError(t, writeErrorFrame(buf, ErrReplicationPositionLost))
+	_, _, err = readFrame(buf, defaultOptions().maxRecordBytes())
+	assert.ErrorIs(t, err, ErrReplicationPositionLost)
+
+	// the oversize record is refused before it's read.
+	buf.Reset()
+	require.NoError(t, writeRecordFrame(buf, ev))
+	_, _, err = readFrame(buf, kvEntry_fixedBytes+uint32(len("key")+len("value"))-1)
+	assert.ErrorIs(t, err, ErrInvalidEntryHeader)
+}
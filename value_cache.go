@@ -0,0 +1,146 @@
+package esl
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// valueCacheEntryOverhead is the estimated memory cost of a cached value
+// besides its key and value.
+const valueCacheEntryOverhead = 96
+
+// CacheStats describes the value cache, see WithValueCache.
+type CacheStats struct {
+	// Hits is the number of Get served by the cache.
+	Hits uint64
+	// Misses is the number of Get those read the value from data files.
+	Misses uint64
+	// Entries is the number of cached values.
+	Entries int
+	// Bytes is the estimated memory cost of cached values.
+	Bytes int64
+}
+
+// valueCacheKey locates the value by the location of entry, so that the cached
+// value is never hit after the key is overwritten.
+type valueCacheKey struct {
+	key         string
+	fileId      uint16
+	valueOffset uint32
+}
+
+type valueCacheItem struct {
+	key   valueCacheKey
+	value []byte
+}
+
+func (item *valueCacheItem) cost() int64 {
+	return int64(len(item.key.key) + len(item.value) + valueCacheEntryOverhead)
+}
+
+// valueCache is a LRU cache of decoded values bounded in bytes.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[valueCacheKey]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[valueCacheKey]*list.Element, 1024),
+	}
+}
+
+// get returns a copy of the cached value of the key located by clue.
+func (c *valueCache) get(key []byte, clue *keydirMemEntry) ([]byte, bool) {
+	c.mu.Lock()
+	elem, ok := c.items[valueCacheKey{key: unsafeString(key), fileId: clue.fileId, valueOffset: clue.valueOffset}]
+	var value []byte
+	if ok {
+		c.ll.MoveToFront(elem)
+		value = append([]byte(nil), elem.Value.(*valueCacheItem).value...)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+
+	return value, true
+}
+
+// add caches a copy of the value, the least recently used values are evicted
+// if the cache is full.
+func (c *valueCache) add(key []byte, clue *keydirMemEntry, value []byte) {
+	item := &valueCacheItem{
+		key:   valueCacheKey{key: string(key), fileId: clue.fileId, valueOffset: clue.valueOffset},
+		value: append([]byte(nil), value...),
+	}
+	if item.cost() > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[item.key]; ok {
+		c.remove(elem)
+	}
+	c.items[item.key] = c.ll.PushFront(item)
+	c.size += item.cost()
+
+	for c.size > c.capacity {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *valueCache) remove(elem *list.Element) {
+	item := c.ll.Remove(elem).(*valueCacheItem)
+	delete(c.items, item.key)
+	c.size -= item.cost()
+}
+
+// purge removes the values located in data files those id is less than fileId,
+// since the data files are rewritten by merge process.
+func (c *valueCache) purge(fileId uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.items {
+		if key.fileId < fileId {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *valueCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: c.ll.Len(),
+		Bytes:   c.size,
+	}
+}
+
+// CacheStats returns the stats of value cache, it's empty if the value cache is
+// disabled.
+func (db *DB) CacheStats() CacheStats {
+	if db.valueCache == nil {
+		return CacheStats{}
+	}
+
+	return db.valueCache.stats()
+}
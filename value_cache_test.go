@@ -0,0 +1,85 @@
+package esl
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_valueCache(t *testing.T) {
+	item := valueCacheItem{key: valueCacheKey{key: "key-0"}, value: []byte("value-0")}
+	c := newValueCache(3 * item.cost())
+
+	for i := 0; i < 4; i++ {
+		clue := &keydirMemEntry{fileId: uint16(i), valueOffset: uint32(i)}
+		c.add([]byte("key-"+strconv.Itoa(i)), clue, []byte("value-"+strconv.Itoa(i)))
+	}
+	assert.Equal(t, 3, c.ll.Len())
+	assert.Equal(t, 3*item.cost(), c.size)
+
+	// key-0 is evicted as the least recently used one.
+	_, ok := c.get([]byte("key-0"), &keydirMemEntry{fileId: 0, valueOffset: 0})
+	assert.False(t, ok)
+	value, ok := c.get([]byte("key-1"), &keydirMemEntry{fileId: 1, valueOffset: 1})
+	assert.True(t, ok)
+	assert.Equal(t, "value-1", string(value))
+
+	// the value of other location is missed.
+	_, ok = c.get([]byte("key-1"), &keydirMemEntry{fileId: 1, valueOffset: 2})
+	assert.False(t, ok)
+
+	// key-2 is evicted since key-1 has been used recently.
+	c.add([]byte("key-4"), &keydirMemEntry{fileId: 4, valueOffset: 4}, []byte("value-4"))
+	_, ok = c.get([]byte("key-2"), &keydirMemEntry{fileId: 2, valueOffset: 2})
+	assert.False(t, ok)
+
+	c.purge(4)
+	stats := c.stats()
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3, Entries: 1, Bytes: item.cost()}, stats)
+
+	// the value larger than capacity is not cached.
+	c.add([]byte("large"), &keydirMemEntry{}, make([]byte, 4*item.cost()))
+	assert.Equal(t, 1, c.ll.Len())
+}
+
+func Test_DB_valueCache(t *testing.T) {
+	db, err := Open("/tmp/esl",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(256),
+		WithCompactThreshold(1000), // avoid auto merge
+		WithValueCache(1<<20),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, CacheStats{}, db.CacheStats())
+
+	putKeys(t, db, 0, 30)
+	assertKeys(t, db, 0, 30)
+	assertKeys(t, db, 0, 30)
+	stats := db.CacheStats()
+	assert.Equal(t, uint64(30), stats.Hits)
+	assert.Equal(t, uint64(30), stats.Misses)
+	assert.Equal(t, 30, stats.Entries)
+
+	// the cached value is a copy.
+	value, err := db.Get([]byte("key-1"))
+	require.NoError(t, err)
+	value[0] = 'x'
+	assertKeys(t, db, 1, 2)
+
+	// overwritten and merged values are not hit.
+	require.NoError(t, db.Put([]byte("key-1"), []byte("new-value-1")))
+	value, err = db.Get([]byte("key-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "new-value-1", string(value))
+	require.NoError(t, db.Delete([]byte("key-2")))
+	_, err = db.Get([]byte("key-2"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, db.merge())
+	assert.Less(t, db.CacheStats().Entries, 30)
+	assertKeys(t, db, 3, 30)
+}
@@ -0,0 +1,558 @@
+package esl
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ChangeOp is the operation type of ChangeEvent.
+type ChangeOp uint8
+
+const (
+	ChangeOpPut ChangeOp = iota + 1
+	ChangeOpDelete
+	// ChangeOpMerge means an operand is appended, see DB.PutOperand.
+	ChangeOpMerge
+	// ChangeOpDeleteRange means the keys in [Key, Value) are deleted, see
+	// DB.DeleteRange.
+	ChangeOpDeleteRange
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeOpPut:
+		return "put"
+	case ChangeOpDelete:
+		return "delete"
+	case ChangeOpMerge:
+		return "merge"
+	case ChangeOpDeleteRange:
+		return "delete_range"
+	}
+
+	return "unknown"
+}
+
+// Position locates a record in data files, it is formed by the data file id
+// and the offset of the record in the data file.
+type Position struct {
+	FileId uint16
+	Offset uint32
+	// Generation is the generation of the data file, it tells whether the data
+	// file has been rewritten by merge process since the position was taken.
+	Generation uint64
+}
+
+// ChangeEvent is a committed change of a key.
+type ChangeEvent struct {
+	Op  ChangeOp
+	Key []byte
+	// Value is nil if Op is ChangeOpDelete, the operand if Op is ChangeOpMerge, or
+	// the end of range if Op is ChangeOpDeleteRange.
+	Value []byte
+
+	// Position is where the record is stored.
+	Position Position
+
+	// size is the number of bytes the record costs in the data file.
+	size uint32
+	// tsTimestamp, seq and flags are the same as the record.
+	tsTimestamp uint64
+	seq         uint64
+	flags       uint8
+	// stored is the value stored in the data file, it may be compressed.
+	stored []byte
+}
+
+// Timestamp returns the time when the record was written.
+func (e *ChangeEvent) Timestamp() time.Time {
+	return time.Unix(0, int64(e.tsTimestamp))
+}
+
+// Next returns the position right after the record, it could be used as the
+// position to resume watching by WatchFrom.
+func (e *ChangeEvent) Next() Position {
+	return Position{
+		FileId:     e.Position.FileId,
+		Offset:     e.Position.Offset + e.size,
+		Generation: e.Position.Generation,
+	}
+}
+
+// newChangeEvent creates the event of the entry, keydir locates the entry in the
+// data file, since the entry may be encrypted in the data file. generation is
+// the generation of the data file.
+func newChangeEvent(e *kvEntry, keydir *keydirMemEntry, generation uint64, shouldCopy bool) (*ChangeEvent, error) {
+	ev := &ChangeEvent{
+		Op:    ChangeOpPut,
+		Key:   e.key,
+		Value: e.value,
+		Position: Position{
+			FileId:     keydir.fileId,
+			Offset:     keydir.entryOffset,
+			Generation: generation,
+		},
+		size:        keydir.valueOffset + uint32(keydir.valueSize) - keydir.entryOffset,
+		tsTimestamp: e.tsTimestamp,
+		seq:         e.seq,
+		flags:       e.flags,
+		stored:      e.value,
+	}
+
+	if shouldCopy {
+		ev.Key = append([]byte(nil), e.key...)
+		ev.stored = append([]byte(nil), e.value...)
+		ev.Value = ev.stored
+	}
+
+	if e.rangeTombstone() {
+		ev.Op = ChangeOpDeleteRange
+		return ev, nil
+	}
+	if e.tombstone() {
+		ev.Op = ChangeOpDelete
+		ev.Value = nil
+		return ev, nil
+	}
+	if e.flags&entryFlag_operand != 0 {
+		// the operand is prefixed by the id of its operator.
+		ev.Op = ChangeOpMerge
+		ev.Value = ev.stored[1:]
+		return ev, nil
+	}
+
+	if codec := e.codec(); codec != 0 {
+		rawSize, err := e.rawValueSize()
+		if err != nil {
+			return nil, err
+		}
+		if ev.Value, err = decompress(codec, ev.stored, rawSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return ev, nil
+}
+
+// entry rebuilds the record of the event, it encodes the same bytes as the
+// record in the data file if the data file is not encrypted.
+func (e *ChangeEvent) entry() *kvEntry {
+	return &kvEntry{
+		tsTimestamp: e.tsTimestamp,
+		seq:         e.seq,
+		keySize:     uint16(len(e.Key)),
+		valueSize:   uint16(len(e.stored)),
+		flags:       e.flags,
+		key:         e.Key,
+		value:       e.stored,
+	}
+}
+
+// watcher receives change events which key has the prefix.
+type watcher struct {
+	prefix []byte
+	// raw indicates the events of buckets are delivered too, it's used by
+	// replication.
+	raw bool
+
+	mu     sync.Mutex
+	queue  []*ChangeEvent
+	notify chan struct{}
+	closed bool
+	done   chan struct{}
+
+	out chan *ChangeEvent
+	// err is the reason why out is closed unexpectedly, it's safe to read
+	// after out is closed.
+	err error
+}
+
+func newWatcher(prefix []byte) *watcher {
+	return &watcher{
+		prefix: append([]byte(nil), prefix...),
+		queue:  make([]*ChangeEvent, 0, 16),
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		out:    make(chan *ChangeEvent, 64),
+	}
+}
+
+func (w *watcher) match(ev *ChangeEvent) bool {
+	if ev.flags&entryFlag_bucket != 0 && !w.raw {
+		return false
+	}
+
+	return bytes.HasPrefix(ev.Key, w.prefix)
+}
+
+// push appends the event into queue, it never blocks the writer even if
+// the watcher consumes slowly.
+func (w *watcher) push(ev *ChangeEvent) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+
+	w.wakeup()
+}
+
+func (w *watcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.done)
+}
+
+func (w *watcher) wakeup() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes all queued events.
+func (w *watcher) pop() []*ChangeEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := w.queue
+	w.queue = make([]*ChangeEvent, 0, 16)
+
+	return events
+}
+
+func (w *watcher) send(ctx context.Context, ev *ChangeEvent) bool {
+	if !w.match(ev) {
+		return true
+	}
+
+	select {
+	case w.out <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-w.done:
+		return false
+	}
+}
+
+// watchHub dispatches committed change events to all watchers.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	// count is the number of watchers, so that DB.write could skip
+	// building change event quickly without lock.
+	count atomic.Int32
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]struct{}, 4),
+	}
+}
+
+func (h *watchHub) active() bool {
+	return h.count.Load() > 0
+}
+
+func (h *watchHub) add(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.watchers[w] = struct{}{}
+	h.count.Store(int32(len(h.watchers)))
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.watchers, w)
+	h.count.Store(int32(len(h.watchers)))
+}
+
+func (h *watchHub) publish(ev *ChangeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		if w.match(ev) {
+			w.push(ev)
+		}
+	}
+}
+
+// close stops all watchers, their channels would be closed.
+func (h *watchHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		w.stop()
+	}
+}
+
+// Watch returns a channel to receive change events those key has the prefix,
+// events are delivered in the order they are committed. An empty prefix watches
+// all keys. The channel will be closed when ctx is done or DB is closed.
+//
+// NOTE: the slow consumer would not block the writers, events are queued in
+// memory until they are consumed.
+func (db *DB) Watch(ctx context.Context, prefix []byte) (<-chan *ChangeEvent, error) {
+	w, err := db.subscribe(ctx, prefix, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.out, nil
+}
+
+// WatchFrom is similar to Watch, but it replays the records those are committed
+// since pos from data files before delivering the new committed events. It's
+// useful to resume watching from the position (ChangeEvent.Next) that consumer
+// has handled.
+//
+// NOTE: merge process rewrites immutable data files, so the offset in the data
+// file which has been rewritten since pos was taken is not valid anymore, and
+// ErrPositionLost is returned, the consumer should resync from a full snapshot.
+// A position with zero Offset replays the data file from its beginning whatever
+// it has been rewritten or not, the merged files contain the latest version of
+// all keys only.
+func (db *DB) WatchFrom(ctx context.Context, prefix []byte, pos Position) (<-chan *ChangeEvent, error) {
+	w, err := db.subscribe(ctx, prefix, &pos, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.out, nil
+}
+
+// subscribe registers a watcher, if from is not nil, the records since from
+// would be replayed first. The events of buckets are delivered only if raw is true.
+func (db *DB) subscribe(ctx context.Context, prefix []byte, from *Position, raw bool) (*watcher, error) {
+	w := newWatcher(prefix)
+	w.raw = raw
+
+	db.activeLock.Lock()
+	head := db.head()
+	if from != nil && (from.FileId > head.FileId || (from.FileId == head.FileId && from.Offset > head.Offset)) {
+		db.activeLock.Unlock()
+		return nil, errors.Errorf("position(%d, %d) is beyond the head(%d, %d)",
+			from.FileId, from.Offset, head.FileId, head.Offset)
+	}
+	if from != nil {
+		if err := db.checkPosition(*from); err != nil {
+			db.activeLock.Unlock()
+			return nil, err
+		}
+	}
+	db.watchHub.add(w)
+	db.activeLock.Unlock()
+
+	go db.runWatcher(ctx, w, from, head)
+
+	return w, nil
+}
+
+func (db *DB) runWatcher(ctx context.Context, w *watcher, from *Position, head Position) {
+	defer close(w.out)
+	defer db.watchHub.remove(w)
+
+	if from != nil {
+		err := db.replay(*from, head, func(ev *ChangeEvent) bool {
+			return w.send(ctx, ev)
+		})
+		if err != nil {
+			w.err = err
+			return
+		}
+	}
+
+	for {
+		for _, ev := range w.pop() {
+			if !w.send(ctx, ev) {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		case <-w.notify:
+		}
+	}
+}
+
+// head returns the position right after the last written record, it MUST be
+// called while holding activeLock.
+func (db *DB) head() Position {
+	return Position{FileId: db.activeFileId, Offset: db.activeDataFileOff, Generation: db.activeGeneration}
+}
+
+// checkPosition returns ErrPositionLost if the data file of pos has been removed
+// or rewritten by merge process since pos was taken, the position with zero
+// Offset is always valid.
+func (db *DB) checkPosition(pos Position) error {
+	if pos.Offset == 0 {
+		return nil
+	}
+
+	generation, err := readFileGeneration(db.filesystem(), dataFilename(db.path, pos.FileId))
+	if os.IsNotExist(err) {
+		return errors.Wrapf(ErrPositionLost, "data file %d has been merged", pos.FileId)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "read generation of data file %d", pos.FileId)
+	}
+	if generation != pos.Generation {
+		return errors.Wrapf(ErrPositionLost, "data file %d has been rewritten, generation %d != %d",
+			pos.FileId, generation, pos.Generation)
+	}
+
+	return nil
+}
+
+// replay reads the records in [from, to) from data files, and calls fn with
+// each record in the order they were written. Replay stops if fn returns false.
+// ErrPositionLost is returned if the data file of from is rewritten by merge
+// process, see checkPosition.
+func (db *DB) replay(from, to Position, fn func(ev *ChangeEvent) bool) error {
+	// the wider counter ends even if to.FileId is the greatest file id.
+	for id := int(from.FileId); id <= int(to.FileId); id++ {
+		fileId := uint16(id)
+		off, end := int64(0), int64(-1)
+		if fileId == from.FileId {
+			off = int64(from.Offset)
+		}
+		if fileId == to.FileId {
+			end = int64(to.Offset)
+		}
+
+		filename := dataFilename(db.path, fileId)
+		if exists, _ := afero.Exists(db.filesystem(), filename); !exists && off == 0 {
+			// the data file has been merged.
+			continue
+		}
+
+		var check *Position
+		if fileId == from.FileId {
+			check = &from
+		}
+		if stopped, err := db.replayFile(fileId, off, end, check, fn); stopped || err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayFile reads the records in [off, end) of the data file, end is -1 if
+// the data file is read to the end. If check is not nil, it's checked by
+// checkPosition before reading. It reports whether fn stops the replay.
+func (db *DB) replayFile(fileId uint16, off, end int64, check *Position, fn func(ev *ChangeEvent) bool) (bool, error) {
+	stopped := errors.New("replay stopped")
+
+	for db.inCompaction.Load() {
+		// spin to wait for compaction finish
+		time.Sleep(time.Millisecond)
+	}
+
+	if check != nil {
+		if err := db.checkPosition(*check); err != nil {
+			return false, err
+		}
+	}
+
+	filename := dataFilename(db.path, fileId)
+	generation, err := readFileGeneration(db.filesystem(), filename)
+	if err != nil {
+		return false, errors.Wrapf(err, "replay data file %d", fileId)
+	}
+
+	err = scanDataFile(db.filesystem(), db.opt.encryption(), filename, fileId, off, end, nil,
+		func(entry *kvEntry, keydir *keydirMemEntry) error {
+			ev, err := newChangeEvent(entry, keydir, generation, false)
+			if err != nil {
+				return err
+			}
+			if !fn(ev) {
+				return stopped
+			}
+			return nil
+		})
+	if errors.Is(err, stopped) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "replay data file %d", fileId)
+	}
+
+	return false, nil
+}
+
+// ScanModifiedSince calls fn with each record written at or after t, in the
+// order they were written. The data files those were not modified since t are
+// skipped without reading. The scan stops if fn returns false. The records of
+// buckets are not scanned.
+//
+// It's useful to export the changes incrementally or to audit the recent
+// changes, the timestamp of the record is ChangeEvent.Timestamp.
+//
+// NOTE: merge process rewrites immutable data files, the merged files keep
+// the original timestamps of records, but only the latest version of keys.
+// The merge process waits until the scan is done, so fn MUST NOT wait for it.
+func (db *DB) ScanModifiedSince(t time.Time, fn func(ev *ChangeEvent) bool) error {
+	// compactLock is held for the scan, so that merge could not replace the
+	// data files between reading their modification time and records.
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+
+	db.activeLock.Lock()
+	head := db.head()
+	db.activeLock.Unlock()
+
+	// the wider counter ends even if head.FileId is the greatest file id.
+	for id := 0; id <= int(head.FileId); id++ {
+		fileId := uint16(id)
+		info, err := db.filesystem().Stat(dataFilename(db.path, fileId))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// the data file has been merged or never been created.
+				continue
+			}
+			return errors.Wrapf(err, "stat data file %d", fileId)
+		}
+		// the records are written before the data file is modified.
+		if info.ModTime().Before(t) {
+			continue
+		}
+
+		end := int64(-1)
+		if fileId == head.FileId {
+			end = int64(head.Offset)
+		}
+		stopped, err := db.replayFile(fileId, 0, end, nil, func(ev *ChangeEvent) bool {
+			if ev.flags&entryFlag_bucket != 0 || ev.Timestamp().Before(t) {
+				return true
+			}
+			return fn(ev)
+		})
+		if stopped || err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
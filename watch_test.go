@@ -0,0 +1,262 @@
+package esl
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveEvents(t *testing.T, ch <-chan *ChangeEvent, n int) []*ChangeEvent {
+	events := make([]*ChangeEvent, 0, n)
+	timeout := time.After(time.Second)
+	for len(events) < n {
+		select {
+		case ev, ok := <-ch:
+			require.True(t, ok, "channel closed unexpectedly")
+			events = append(events, ev)
+		case <-timeout:
+			require.FailNow(t, "receive events timeout", "got %d, want %d", len(events), n)
+		}
+	}
+
+	return events
+}
+
+func Test_DB_Watch(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := db.Watch(ctx, []byte("user:"))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("user:1"), []byte("alice")))
+	require.NoError(t, db.Put([]byte("order:1"), []byte("ignored")))
+	require.NoError(t, db.Put([]byte("user:2"), []byte("bob")))
+	require.NoError(t, db.Delete([]byte("user:1")))
+
+	events := receiveEvents(t, ch, 3)
+	assert.Equal(t, ChangeOpPut, events[0].Op)
+	assert.Equal(t, []byte("user:1"), events[0].Key)
+	assert.Equal(t, []byte("alice"), events[0].Value)
+	assert.Equal(t, Position{FileId: initDataFileId, Offset: formatHeaderSize}, events[0].Position)
+
+	assert.Equal(t, ChangeOpPut, events[1].Op)
+	assert.Equal(t, []byte("user:2"), events[1].Key)
+	assert.Equal(t, []byte("bob"), events[1].Value)
+
+	assert.Equal(t, ChangeOpDelete, events[2].Op)
+	assert.Equal(t, []byte("user:1"), events[2].Key)
+	assert.Nil(t, events[2].Value)
+	assert.Equal(t, events[1].Next(), events[2].Position)
+
+	// cancel the context, the channel should be closed.
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "channel is not closed")
+	}
+}
+
+func Test_DB_WatchFrom(t *testing.T) {
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var resume Position
+	for i := 0; i < 20; i++ {
+		key := []byte("key-" + strconv.Itoa(i))
+		require.NoError(t, db.Put(key, []byte("value-"+strconv.Itoa(i))))
+
+		if i == 9 {
+			resume = Position{FileId: db.activeFileId, Offset: db.activeDataFileOff}
+		}
+	}
+	// make sure the records are spread over multiple files.
+	require.Greater(t, db.activeFileId, uint16(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// replay from the very beginning.
+	ch, err := db.WatchFrom(ctx, nil, Position{FileId: initDataFileId})
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key-20"), []byte("value-20")))
+
+	events := receiveEvents(t, ch, 21)
+	for i, ev := range events {
+		assert.Equal(t, ChangeOpPut, ev.Op)
+		assert.Equal(t, "key-"+strconv.Itoa(i), string(ev.Key))
+		assert.Equal(t, "value-"+strconv.Itoa(i), string(ev.Value))
+	}
+
+	// resume from the middle.
+	ch, err = db.WatchFrom(ctx, []byte("key-1"), resume)
+	require.NoError(t, err)
+	events = receiveEvents(t, ch, 9) // key-1x and key-20 is not matched
+	for i, ev := range events {
+		assert.Equal(t, "key-1"+strconv.Itoa(i), string(ev.Key))
+	}
+
+	// position beyond the head.
+	_, err = db.WatchFrom(ctx, nil, Position{FileId: db.activeFileId + 1})
+	assert.Error(t, err)
+}
+
+func Test_DB_WatchFrom_merged(t *testing.T) {
+	db, err := Open(
+		"/tmp/esl",
+		WithFileSystem(afero.NewMemMapFs()),
+		WithMaxFileBytes(100),
+		WithCompactThreshold(1000), // avoid auto merge
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Put([]byte("key"), []byte("value-"+strconv.Itoa(i))))
+	}
+	require.Greater(t, db.activeFileId, uint16(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.WatchFrom(ctx, nil, Position{FileId: initDataFileId})
+	require.NoError(t, err)
+	resume := receiveEvents(t, ch, 1)[0].Next()
+
+	// the data file of resume is rewritten by merge process.
+	require.NoError(t, db.MergeContext(ctx))
+	_, err = db.WatchFrom(ctx, nil, resume)
+	assert.ErrorIs(t, err, ErrPositionLost)
+
+	// the beginning of data file is still valid.
+	ch, err = db.WatchFrom(ctx, nil, Position{FileId: db.activeFileId - 1})
+	require.NoError(t, err)
+	events := receiveEvents(t, ch, 1)
+	assert.Equal(t, "key", string(events[0].Key))
+	assert.Equal(t, uint64(1), events[0].Position.Generation)
+}
+
+func Test_DB_replay_lastFileId(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the replay ends even if the file id is the greatest one.
+	last := Position{FileId: math.MaxUint16}
+	err = db.replay(last, last, func(ev *ChangeEvent) bool { return true })
+	assert.NoError(t, err)
+}
+
+func Test_DB_Watch_close(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()))
+	require.NoError(t, err)
+
+	ch, err := db.Watch(context.Background(), nil)
+	require.NoError(t, err)
+	assert.True(t, db.watchHub.active())
+
+	require.NoError(t, db.Close())
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "channel is not closed")
+	}
+
+	// watcher should be removed after channel closed.
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, db.watchHub.active())
+}
+
+func Test_DB_ScanModifiedSince(t *testing.T) {
+	db, err := Open("/tmp/esl", WithFileSystem(afero.NewMemMapFs()), WithMaxFileBytes(256))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Put([]byte("old-"+strconv.Itoa(i)), []byte("value")))
+	}
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+
+	bucket, err := db.Bucket("bucket")
+	require.NoError(t, err)
+	require.NoError(t, bucket.Put([]byte("new-0"), []byte("value")))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte("new-"+strconv.Itoa(i)), []byte("value")))
+	}
+	require.NoError(t, db.Delete([]byte("old-0")))
+
+	events := make([]*ChangeEvent, 0, 11)
+	err = db.ScanModifiedSince(since, func(ev *ChangeEvent) bool {
+		events = append(events, ev)
+		return true
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 11)
+	for i, ev := range events[:10] {
+		assert.Equal(t, ChangeOpPut, ev.Op)
+		assert.Equal(t, "new-"+strconv.Itoa(i), string(ev.Key))
+		assert.False(t, ev.Timestamp().Before(since))
+		if i > 0 {
+			// the writes within one second are ordered.
+			assert.True(t, ev.Timestamp().After(events[i-1].Timestamp()))
+		}
+	}
+	assert.Equal(t, ChangeOpDelete, events[10].Op)
+	assert.Equal(t, "old-0", string(events[10].Key))
+
+	_, meta, err := db.GetWithMeta([]byte("new-9"))
+	require.NoError(t, err)
+	assert.Equal(t, events[9].Timestamp(), meta.Timestamp)
+
+	// the scan stops if fn returns false.
+	count := 0
+	err = db.ScanModifiedSince(since, func(ev *ChangeEvent) bool {
+		count++
+		return count < 3
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count = 0
+	err = db.ScanModifiedSince(time.Now().Add(time.Hour), func(ev *ChangeEvent) bool {
+		count++
+		return true
+	})
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	// merge could not replace the data files while scanning.
+	var mergeErr error
+	count = 0
+	err = db.ScanModifiedSince(since, func(ev *ChangeEvent) bool {
+		if count == 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			mergeErr = db.MergeContext(ctx)
+			cancel()
+		}
+		count++
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 11, count)
+	assert.ErrorIs(t, mergeErr, context.DeadlineExceeded)
+}
@@ -0,0 +1,274 @@
+package esl
+
+import (
+	"context"
+	"sync"
+)
+
+// WritePriority decides the lane of write in the async writer, the writes in
+// high priority lane are written before the normal ones. The priority is ignored
+// if the async writer is disabled.
+type WritePriority uint8
+
+const (
+	PriorityNormal WritePriority = iota
+	PriorityHigh
+
+	writePriorities = 2
+)
+
+const (
+	// writeBatchEntries and writeBatchBytes limit the size of a batch.
+	writeBatchEntries = 256
+	writeBatchBytes   = 4 << 20 // 4MB
+)
+
+type writeRequest struct {
+	ctx   context.Context
+	entry *kvEntry
+	// cond is evaluated right before the entry is written, the entry is dropped
+	// if it returns false. It could be nil.
+	cond func() bool
+	done chan error
+}
+
+var writeRequestPool = sync.Pool{
+	New: func() any {
+		return &writeRequest{done: make(chan error, 1)}
+	},
+}
+
+// writer takes the write requests from many callers, and writes them in sequence
+// by batch, each batch costs one Write call.
+type writer struct {
+	db    *DB
+	lanes [writePriorities]chan *writeRequest
+
+	// mu protects closed, the submitters hold the read lock while sending, so
+	// that no request is sent after the writer is stopped.
+	mu      sync.RWMutex
+	closed  bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newWriter(db *DB, queueSize int) *writer {
+	w := &writer{
+		db:      db,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for i := range w.lanes {
+		w.lanes[i] = make(chan *writeRequest, queueSize)
+	}
+
+	return w
+}
+
+// submit queues the entry into the lane of priority, and waits until it's written.
+// The entry is dropped if ctx is done before it's written, or cond returns false,
+// see DB.writeIf.
+func (w *writer) submit(ctx context.Context, e *kvEntry, priority WritePriority, cond func() bool) error {
+	req, err := w.enqueue(ctx, e, priority, cond)
+	if err != nil {
+		return err
+	}
+
+	return w.wait(req)
+}
+
+// submitBatch queues the entries into the lane of priority in order, and waits
+// until all of them are written. The error of the first failed entry is returned.
+func (w *writer) submitBatch(ctx context.Context, entries []*kvEntry, priority WritePriority) error {
+	reqs := make([]*writeRequest, 0, len(entries))
+	var enqueueErr error
+	for _, e := range entries {
+		req, err := w.enqueue(ctx, e, priority, nil)
+		if err != nil {
+			enqueueErr = err
+			break
+		}
+		reqs = append(reqs, req)
+	}
+
+	var err error
+	for _, req := range reqs {
+		if waitErr := w.wait(req); err == nil {
+			err = waitErr
+		}
+	}
+	if err == nil {
+		err = enqueueErr
+	}
+
+	return err
+}
+
+// enqueue sends the request of entry into the lane of priority.
+func (w *writer) enqueue(ctx context.Context, e *kvEntry, priority WritePriority, cond func() bool,
+) (*writeRequest, error) {
+	if priority >= writePriorities {
+		priority = PriorityHigh
+	}
+
+	req := writeRequestPool.Get().(*writeRequest)
+	req.ctx = ctx
+	req.entry = e
+	req.cond = cond
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		writeRequestPool.Put(req)
+		return nil, ErrClosed
+	}
+	select {
+	case w.lanes[priority] <- req:
+	case <-ctx.Done():
+		writeRequestPool.Put(req)
+		return nil, ctx.Err()
+	}
+
+	return req, nil
+}
+
+// wait waits until the request is completed, and recycles it.
+func (w *writer) wait(req *writeRequest) error {
+	// the writer checks ctx before writing, so it's not long to wait.
+	err := <-req.done
+	req.ctx = nil
+	req.entry = nil
+	req.cond = nil
+	writeRequestPool.Put(req)
+
+	return err
+}
+
+// close stops the writer after all queued requests are written.
+func (w *writer) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	<-w.stopped
+}
+
+func (w *writer) run() {
+	defer close(w.stopped)
+
+	batch := make([]*writeRequest, 0, writeBatchEntries)
+	for {
+		var req *writeRequest
+		select {
+		case req = <-w.lanes[PriorityHigh]:
+		default:
+			select {
+			case req = <-w.lanes[PriorityHigh]:
+			case req = <-w.lanes[PriorityNormal]:
+			case <-w.stop:
+				// no more requests would be sent, write the queued ones.
+				for batch = w.collect(batch[:0]); len(batch) > 0; batch = w.collect(batch[:0]) {
+					w.write(batch)
+				}
+				return
+			}
+		}
+
+		batch = w.collect(append(batch[:0], req))
+		w.write(batch)
+	}
+}
+
+// collect takes the queued requests into batch without blocking, the high
+// priority lane is drained first.
+func (w *writer) collect(batch []*writeRequest) []*writeRequest {
+	size := 0
+	for _, req := range batch {
+		size += len(req.entry.key) + len(req.entry.value)
+	}
+
+	for priority := writePriorities - 1; priority >= 0; priority-- {
+		for len(batch) < writeBatchEntries && size < writeBatchBytes {
+			select {
+			case req := <-w.lanes[priority]:
+				batch = append(batch, req)
+				size += len(req.entry.key) + len(req.entry.value)
+				continue
+			default:
+			}
+			break
+		}
+	}
+
+	return batch
+}
+
+// write appends the entries of batch to the active data file, and completes
+// each request. The active data file is archived once it's full. The requests
+// those ctx is done are dropped. The condition of request is evaluated after
+// the former requests of batch are written, so that it sees their changes.
+func (w *writer) write(batch []*writeRequest) {
+	db := w.db
+	db.activeLock.Lock()
+	defer db.activeLock.Unlock()
+
+	var err error
+	pending := make([]*writeRequest, 0, len(batch))
+	for _, req := range batch {
+		if err != nil {
+			// the requests after the failure are failed too, since the state of
+			// active data file is unknown.
+			req.done <- err
+			continue
+		}
+		if ctxErr := req.ctx.Err(); ctxErr != nil {
+			req.done <- ctxErr
+			continue
+		}
+		if req.cond != nil {
+			err = w.flush(pending)
+			pending = pending[:0]
+			if err != nil {
+				req.done <- err
+				continue
+			}
+			if !req.cond() {
+				req.done <- errConditionFailed
+				continue
+			}
+		}
+		pending = append(pending, req)
+	}
+	if err == nil {
+		_ = w.flush(pending)
+	}
+}
+
+// flush appends the entries of requests and completes them, the error of the
+// first failed request is returned. It MUST be called while holding activeLock.
+func (w *writer) flush(reqs []*writeRequest) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	entries := make([]*kvEntry, len(reqs))
+	for i, req := range reqs {
+		entries[i] = req.entry
+	}
+
+	written, err := w.db.appendBatch(entries)
+	for i, req := range reqs {
+		if i < written {
+			req.done <- nil
+		} else {
+			req.done <- err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,93 @@
+package esl
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writer_collect(t *testing.T) {
+	w := newWriter(nil, 8)
+	for i := 0; i < 4; i++ {
+		w.lanes[PriorityNormal] <- &writeRequest{entry: newEntry([]byte("normal-"+strconv.Itoa(i)), nil)}
+	}
+	for i := 0; i < 2; i++ {
+		w.lanes[PriorityHigh] <- &writeRequest{entry: newEntry([]byte("high-"+strconv.Itoa(i)), nil)}
+	}
+
+	batch := w.collect(nil)
+	require.Len(t, batch, 6)
+	keys := make([]string, 0, len(batch))
+	for _, req := range batch {
+		keys = append(keys, string(req.entry.key))
+	}
+	assert.Equal(t, []string{"high-0", "high-1", "normal-0", "normal-1", "normal-2", "normal-3"}, keys)
+}
+
+func Test_DB_asyncWrite(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	open := func(options ...Option) *DB {
+		options = append(options,
+			WithFileSystem(fs),
+			WithMaxFileBytes(1024),
+			WithCompactThreshold(1000), // avoid auto merge
+		)
+		db, err := Open("/tmp/esl", options...)
+		require.NoError(t, err)
+		return db
+	}
+
+	db := open(WithAsyncWrite(16), WithSyncWrites())
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			priority := PriorityNormal
+			if g%2 == 0 {
+				priority = PriorityHigh
+			}
+			for i := g * 100; i < (g+1)*100; i++ {
+				key, value := []byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i))
+				assert.NoError(t, db.PutWithPriority(key, value, priority))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assertKeys(t, db, 0, 800)
+	assert.Greater(t, db.activeFileId, initDataFileId)
+	require.NoError(t, db.Delete([]byte("key-0")))
+	_, err := db.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Put([]byte("key-0"), []byte("value-0")), ErrClosed)
+
+	db = open()
+	defer db.Close()
+	assertKeys(t, db, 1, 800)
+	_, err = db.Get([]byte("key-0"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func Test_writer_dropCancelled(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	db, err := Open("/tmp/esl", WithFileSystem(fs), WithAsyncWrite(16))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := &writeRequest{ctx: ctx, entry: newEntry([]byte("key"), []byte("value")), done: make(chan error, 1)}
+	db.writer.write([]*writeRequest{req})
+	assert.ErrorIs(t, <-req.done, context.Canceled)
+
+	_, err = db.Get([]byte("key"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Equal(t, uint32(formatHeaderSize), db.activeDataFileOff)
+}